@@ -1,35 +1,188 @@
 package main
 
 import (
-	"crypto/sha256"
-	"errors"
-	"fmt"
-	"github.com/peeta98/httpfromtcp/internal/headers"
+	"context"
+	"crypto/subtle"
+	"flag"
+	"github.com/peeta98/httpfromtcp/internal/accesslog"
+	"github.com/peeta98/httpfromtcp/internal/client"
+	"github.com/peeta98/httpfromtcp/internal/compress"
+	"github.com/peeta98/httpfromtcp/internal/conditional"
+	"github.com/peeta98/httpfromtcp/internal/fileserver"
+	"github.com/peeta98/httpfromtcp/internal/proxy"
 	"github.com/peeta98/httpfromtcp/internal/request"
 	"github.com/peeta98/httpfromtcp/internal/response"
 	"github.com/peeta98/httpfromtcp/internal/server"
-	"io"
+	"github.com/peeta98/httpfromtcp/internal/sse"
+	"github.com/peeta98/httpfromtcp/internal/websocket"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
-const port = 42069
+var (
+	addr         = flag.String("addr", ":42069", `address to listen on, such as "127.0.0.1:8080" or "unix:/run/app.sock"`)
+	maxConns     = flag.Int("max-conns", 1024, "maximum number of concurrent connections, answered with 503 beyond that; 0 for no limit")
+	accessLog    = flag.String("access-log", "combined", `access log format: "common", "combined" or "json"`)
+	metricsPath  = flag.String("metrics-path", "/metrics", "path serving Prometheus metrics; empty to disable")
+	h2c          = flag.Bool("h2c", true, "serve cleartext HTTP/2 to clients using prior knowledge or Upgrade: h2c")
+	proxyTarget  = flag.String("proxy-target", "https://httpbin.org", "upstream server that /httpbin/ requests are forwarded to; several, comma-separated, are load balanced")
+	proxyBalance = flag.String("proxy-balance", "round-robin", `how requests are spread over several -proxy-target servers: "round-robin", "least-conn" or "hash" (by client IP)`)
+	proxyHealth  = flag.String("proxy-health-check", "", "path requested from each -proxy-target server to check its health; empty to disable")
+	forwardProxy = flag.Bool("forward-proxy", false, "act as a forward proxy for absolute-form and CONNECT requests")
+	forwardAllow = flag.String("forward-proxy-allow", "", `comma-separated destinations the forward proxy may reach, such as "example.com", "*.example.com:443" or "*:80"; empty for any`)
+	forwardAuth  = flag.String("forward-proxy-auth", "", `"user:password" clients of the forward proxy must send in Proxy-Authorization; empty for none`)
+)
+
+var assetsHandler = fileserver.New(fileserver.Config{
+	Root:            "assets",
+	StripPrefix:     "/assets",
+	ListDirectories: true,
+})
+
+var echoUpgrader = &websocket.Upgrader{}
+
+// upstreamPool keeps connections to proxied servers alive between
+// requests.
+var (
+	upstreamPool = &client.Pool{}
+	upstream     = &client.Client{Pool: upstreamPool}
+)
+
+// proxyHandler forwards /httpbin/ requests to -proxy-target. It is set up
+// once the flags are parsed.
+var proxyHandler server.Handler
+
+// forwardHandler serves forward proxy requests when -forward-proxy is set.
+var forwardHandler server.Handler
+
+const shutdownTimeout = 30 * time.Second
+
+// routes are the paths handler serves, used to label request metrics.
+var routes = []string{"/", "/yourproblem", "/myproblem", "/httpbin", "/video", "/events", "/ws/echo", "/assets"}
 
 func main() {
-	server, err := server.Serve(port, handler)
+	flag.Parse()
+
+	// When started by systemd socket activation or by a previous instance
+	// handing over during a restart, the listening socket is inherited.
+	listener, err := server.ListenOrInherit(*addr)
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+
+	logFormat, err := accesslog.ParseFormat(*accessLog)
+	if err != nil {
+		log.Fatalf("Invalid -access-log: %v", err)
+	}
+
+	proxyCfg := proxy.ReverseConfig{
+		StripPrefix: "/httpbin",
+		Client:      upstream,
+		Retries:     1,
+	}
+	var targets []*url.URL
+	for _, raw := range strings.Split(*proxyTarget, ",") {
+		target, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || target.Host == "" {
+			log.Fatalf("Invalid -proxy-target: %q", raw)
+		}
+		targets = append(targets, target)
+	}
+	if len(targets) == 1 && *proxyHealth == "" {
+		proxyCfg.Target = targets[0]
+	} else {
+		strategy, err := proxy.ParseStrategy(*proxyBalance)
+		if err != nil {
+			log.Fatalf("Invalid -proxy-balance: %v", err)
+		}
+		balancer, err := proxy.NewBalancer(proxy.BalancerConfig{
+			Targets:         targets,
+			Strategy:        strategy,
+			HealthCheckPath: *proxyHealth,
+		})
+		if err != nil {
+			log.Fatalf("Invalid -proxy-target: %v", err)
+		}
+		defer balancer.Close()
+		proxyCfg.Balancer = balancer
+	}
+	proxyHandler = proxy.NewReverse(proxyCfg)
+
+	if *forwardProxy {
+		// Tunnels leave the server's connection count once hijacked, so
+		// they get a limit of their own.
+		forwardCfg := proxy.ForwardConfig{Client: upstream, MaxTunnels: *maxConns}
+		if *forwardAllow != "" {
+			for _, entry := range strings.Split(*forwardAllow, ",") {
+				forwardCfg.Allow = append(forwardCfg.Allow, strings.TrimSpace(entry))
+			}
+		}
+		if *forwardAuth != "" {
+			user, password, ok := strings.Cut(*forwardAuth, ":")
+			if !ok {
+				log.Fatal("Invalid -forward-proxy-auth: want user:password")
+			}
+			forwardCfg.Authenticate = func(u, p string) bool {
+				return subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 &&
+					subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+			}
+		}
+		forwardHandler = proxy.NewForward(forwardCfg)
+	}
+
+	opts := []server.Option{
+		server.WithMaxConnections(*maxConns, server.OverloadReject),
+		server.WithMetrics(*metricsPath),
+		server.WithRouteLabel(server.RouteLabels(routes...)),
+	}
+	if *h2c {
+		opts = append(opts, server.WithH2C())
+	}
+	srv, err := server.ServeListener(listener,
+		server.Chain(handler, server.RequestID, accesslog.New(os.Stdout, logFormat), compress.Middleware),
+		opts...,
+	)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+	upstreamPool.RegisterMetrics(srv.Metrics())
+	log.Println("Server started on", srv.Addr())
+
+	if err := server.NotifyReady(); err != nil {
+		log.Printf("Error notifying parent process: %v", err)
+	}
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+waitForSignal:
+	for {
+		select {
+		case err := <-srv.Err():
+			log.Fatalf("Server stopped: %v", err)
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP || sig == syscall.SIGUSR2 {
+				child, err := srv.Handoff()
+				if err != nil {
+					log.Printf("Error restarting: %v", err)
+					continue
+				}
+				log.Printf("Handed listener over to process %d, draining", child.Pid)
+			}
+			break waitForSignal
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error draining connections: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
 
@@ -37,6 +190,11 @@ func handler(w *response.Writer, req *request.Request) {
 	reqPath := req.RequestLine.RequestTarget
 	reqMethod := req.RequestLine.Method
 
+	if forwardHandler != nil && proxy.IsForwardRequest(req) {
+		forwardHandler(w, req)
+		return
+	}
+
 	if reqPath == "/yourproblem" {
 		handler400(w, req)
 		return
@@ -47,16 +205,31 @@ func handler(w *response.Writer, req *request.Request) {
 		return
 	}
 
-	if strings.HasPrefix(reqPath, "/httpbin") {
+	if path, _, _ := strings.Cut(reqPath, "?"); path == "/httpbin" || strings.HasPrefix(path, "/httpbin/") {
 		proxyHandler(w, req)
 		return
 	}
 
-	if reqPath == "/video" && reqMethod == "GET" {
+	if reqPath == "/video" && (reqMethod == "GET" || reqMethod == "HEAD") {
 		videoHandler(w, req)
 		return
 	}
 
+	if reqPath == "/events" {
+		eventsHandler(w, req)
+		return
+	}
+
+	if reqPath == "/ws/echo" {
+		echoHandler(w, req)
+		return
+	}
+
+	if strings.HasPrefix(reqPath, "/assets/") {
+		assetsHandler(w, req)
+		return
+	}
+
 	handler200(w, req)
 }
 
@@ -94,8 +267,7 @@ func handler500(w *response.Writer, _ *request.Request) {
 	w.WriteBody(body)
 }
 
-func handler200(w *response.Writer, _ *request.Request) {
-	w.WriteStatusLine(response.StatusCodeOK)
+func handler200(w *response.Writer, req *request.Request) {
 	body := []byte(`<html>
   <head>
     <title>200 OK</title>
@@ -107,90 +279,65 @@ func handler200(w *response.Writer, _ *request.Request) {
 </html>`)
 	headers := response.GetDefaultHeaders(len(body))
 	headers.Override("Content-Type", "text/html")
+	conditional.SetValidators(headers, conditional.StrongETag(body), time.Time{})
+	if conditional.Check(w, req, headers) {
+		return
+	}
+
+	w.WriteStatusLine(response.StatusCodeOK)
 	w.WriteHeaders(headers)
 	w.WriteBody(body)
 }
 
-func proxyHandler(w *response.Writer, req *request.Request) {
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-	url := "https://httpbin.org/" + target
-	fmt.Println("Proxying to", url)
-
-	resp, err := http.Get(url)
+func echoHandler(w *response.Writer, req *request.Request) {
+	conn, err := echoUpgrader.Upgrade(w, req)
 	if err != nil {
-		handler500(w, req)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Unexpected status: %s\n", resp.Status)
-		handler500(w, req)
 		return
 	}
+	defer conn.Close()
 
-	w.WriteStatusLine(response.StatusCodeOK)
-
-	h := response.GetDefaultHeaders(0)
-	h.Remove("Content-Length")
-	h.Set("Transfer-Encoding", "chunked")
-	h.Set("Trailer", "X-Content-SHA256")
-	h.Set("Trailer", "X-Content-Length")
-	w.WriteHeaders(h)
-
-	const maxChunkSize = 1024
-	buf := make([]byte, maxChunkSize)
-	var fullRespBody []byte
+	// Hijacked connections don't hold up shutdown, so close this one when
+	// the server stops.
+	stop := context.AfterFunc(req.Context(), func() { conn.Close() })
+	defer stop()
 
 	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			fmt.Printf("Read %d bytes: %s\n", n, buf[:n])
-			_, err = w.WriteChunkedBody(buf[:n])
-			if err != nil {
-				fmt.Println("Error writing chunked body:", err)
-				break
-			}
-			fullRespBody = append(fullRespBody, buf[:n]...)
-		}
-
+		typ, data, err := conn.ReadMessage()
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			fmt.Println("Error reading response body:", err)
+			return
+		}
+		if err := conn.WriteMessage(typ, data); err != nil {
 			return
 		}
 	}
+}
 
-	_, err = w.WriteChunkedBodyDone()
+// eventsHandler streams the time every second. Event IDs count up, so a
+// client that reconnects carries on from the last one it saw.
+func eventsHandler(w *response.Writer, req *request.Request) {
+	stream, err := sse.NewStream(w, req, sse.Config{Retry: 2 * time.Second})
 	if err != nil {
-		fmt.Println("Error writing chunked body done:", err)
+		return
 	}
+	defer stream.Close()
 
-	trailerHeaders := headers.NewHeaders()
-	checksum := fmt.Sprintf("%x", sha256.Sum256(fullRespBody))
-	bodyLen := fmt.Sprintf("%d", len(fullRespBody))
-	trailerHeaders.Set("X-Content-SHA256", checksum)
-	trailerHeaders.Set("X-Content-Length", bodyLen)
-
-	err = w.WriteTrailers(trailerHeaders)
-	if err != nil {
-		fmt.Println("Error writing trailers:", err)
+	id, _ := strconv.Atoi(stream.LastEventID())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			id++
+			err := stream.Send(sse.Event{ID: strconv.Itoa(id), Event: "tick", Data: now.Format(time.RFC3339)})
+			if err != nil {
+				return
+			}
+		case <-stream.Done():
+			return
+		}
 	}
 }
 
 func videoHandler(w *response.Writer, req *request.Request) {
-	w.WriteStatusLine(response.StatusCodeOK)
-
-	body, err := os.ReadFile("assets/vim.mp4")
-	if err != nil {
-		handler500(w, req)
-		return
-	}
-
-	headers := response.GetDefaultHeaders(len(body))
-	headers.Override("Content-Type", "video/mp4")
-	w.WriteHeaders(headers)
-	w.WriteBody(body)
+	fileserver.ServeFile(w, req, "assets/vim.mp4")
 }
@@ -0,0 +1,184 @@
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Format int
+
+const (
+	// FormatCommon is the Common Log Format:
+	//   host ident authuser [date] "request line" status bytes
+	FormatCommon Format = iota
+	// FormatCombined is the Common Log Format followed by the quoted
+	// Referer and User-Agent headers.
+	FormatCombined
+	// FormatJSON writes one JSON object per request through log/slog and
+	// also records the request duration and ID.
+	FormatJSON
+)
+
+// ParseFormat returns the Format named by s: "common", "combined" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "common", "clf":
+		return FormatCommon, nil
+	case "combined":
+		return FormatCombined, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown access log format: %q", s)
+}
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// entry holds what is recorded about a single request.
+type entry struct {
+	RemoteAddr string
+	Method     string
+	Target     string
+	Proto      string
+	Status     response.StatusCode
+	Bytes      int64
+	Start      time.Time
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+	RequestID  string
+}
+
+// New returns a middleware that writes one line per request to out in the
+// given format.
+func New(out io.Writer, format Format) server.Middleware {
+	if format == FormatJSON {
+		return NewSlog(slog.New(slog.NewJSONHandler(out, nil)))
+	}
+
+	var mu sync.Mutex
+	return middleware(func(e entry) {
+		line := formatCommon(e)
+		if format == FormatCombined {
+			line += fmt.Sprintf(" %s %s", quote(e.Referer), quote(e.UserAgent))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(out, line+"\n")
+	})
+}
+
+// NewSlog returns a middleware that logs every request as a structured
+// record through logger.
+func NewSlog(logger *slog.Logger) server.Middleware {
+	return middleware(func(e entry) {
+		attrs := []slog.Attr{
+			slog.String("remote_addr", e.RemoteAddr),
+			slog.String("method", e.Method),
+			slog.String("target", e.Target),
+			slog.String("proto", e.Proto),
+			slog.Int("status", int(e.Status)),
+			slog.Int64("bytes", e.Bytes),
+			slog.Duration("duration", e.Duration),
+			slog.String("user_agent", e.UserAgent),
+		}
+		if e.Referer != "" {
+			attrs = append(attrs, slog.String("referer", e.Referer))
+		}
+		if e.RequestID != "" {
+			attrs = append(attrs, slog.String("request_id", e.RequestID))
+		}
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+func middleware(record func(entry)) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+
+			referer, _ := req.Headers.Get("Referer")
+			userAgent, _ := req.Headers.Get("User-Agent")
+			requestID, _ := server.RequestIDFromContext(req.Context())
+			record(entry{
+				RemoteAddr: remoteHost(req.RemoteAddr),
+				Method:     req.RequestLine.Method,
+				Target:     req.RequestLine.RequestTarget,
+				Proto:      "HTTP/" + req.RequestLine.HttpVersion,
+				Status:     w.StatusCode(),
+				Bytes:      w.BytesWritten(),
+				Start:      start,
+				Duration:   time.Since(start),
+				Referer:    referer,
+				UserAgent:  userAgent,
+				RequestID:  requestID,
+			})
+		}
+	}
+}
+
+func formatCommon(e entry) string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = fmt.Sprintf("%d", e.Bytes)
+	}
+	requestLine := fmt.Sprintf("%s %s %s", e.Method, e.Target, e.Proto)
+	return fmt.Sprintf("%s - - [%s] %s %d %s",
+		orDash(e.RemoteAddr), e.Start.Format(clfTimeFormat), quote(requestLine), e.Status, bytes)
+}
+
+// remoteHost drops the port from a TCP address. Unix socket peers are
+// usually unnamed and logged as "-".
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// quote wraps s in double quotes, escaping quotes, backslashes and
+// control characters so a client cannot forge log lines.
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	handler := func(w *response.Writer, _ *request.Request) {
+		body := []byte("not found")
+		w.WriteStatusLine(response.StatusCodeNotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	raw := "GET /missing?q=1 HTTP/1.1\r\nHost: localhost\r\nUser-Agent: curl/8.0 \"evil\"\r\nReferer: http://example.com/\r\n\r\n"
+
+	// Test: Common Log Format
+	out := &bytes.Buffer{}
+	serve(t, New(out, FormatCommon)(handler), raw)
+	assert.Regexp(t, regexp.MustCompile(`^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /missing\?q=1 HTTP/1\.1" 404 9\n$`), out.String())
+
+	// Test: Combined Log Format escapes quotes
+	out.Reset()
+	serve(t, New(out, FormatCombined)(handler), raw)
+	assert.True(t, strings.HasSuffix(out.String(), `404 9 "http://example.com/" "curl/8.0 \"evil\""`+"\n"), out.String())
+
+	// Test: JSON through slog, including the request ID
+	out.Reset()
+	serve(t, server.Chain(handler, server.RequestID, New(out, FormatJSON)), raw)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "request", record["msg"])
+	assert.Equal(t, "192.0.2.1", record["remote_addr"])
+	assert.Equal(t, "GET", record["method"])
+	assert.Equal(t, "/missing?q=1", record["target"])
+	assert.Equal(t, float64(404), record["status"])
+	assert.Equal(t, float64(9), record["bytes"])
+	assert.Equal(t, `curl/8.0 "evil"`, record["user_agent"])
+	assert.Contains(t, record, "duration")
+	assert.Len(t, record["request_id"], 16)
+
+	// Test: Control characters cannot forge extra lines
+	assert.Equal(t, `"a\x0ab"`, quote("a\nb"))
+	assert.Equal(t, `"-"`, quote(""))
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("JSON")
+	require.NoError(t, err)
+	assert.Equal(t, FormatJSON, format)
+
+	_, err = ParseFormat("apache")
+	assert.Error(t, err)
+}
+
+func serve(t *testing.T, handler server.Handler, raw string) {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 54321}
+	handler(response.NewWriter(&bytes.Buffer{}), req)
+}
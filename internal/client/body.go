@@ -0,0 +1,160 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// fixedReader reads a body delimited by Content-Length.
+type fixedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (f *fixedReader) Read(p []byte) (int, error) {
+	if f.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= int64(n)
+	if errors.Is(err, io.EOF) {
+		if f.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	if err == nil && f.remaining == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+type chunkedState int
+
+const (
+	chunkSize chunkedState = iota
+	chunkData
+	chunkDataEnd
+	chunkTrailers
+	chunkDone
+)
+
+// chunkedReader decodes a chunked body (RFC 9112 section 7.1), storing
+// its trailer fields in trailers.
+type chunkedReader struct {
+	r         *bufio.Reader
+	state     chunkedState
+	remaining int64
+	trailers  headers.Headers
+	err       error
+}
+
+func newChunkedReader(r *bufio.Reader, trailers headers.Headers) *chunkedReader {
+	return &chunkedReader{r: r, trailers: trailers}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.err == nil {
+		switch c.state {
+		case chunkSize:
+			c.err = c.readChunkSize()
+		case chunkData:
+			if len(p) == 0 {
+				return 0, nil
+			}
+			if int64(len(p)) > c.remaining {
+				p = p[:c.remaining]
+			}
+			n, err := c.r.Read(p)
+			c.remaining -= int64(n)
+			if c.remaining == 0 {
+				c.state = chunkDataEnd
+			}
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			c.err = err
+			return n, err
+		case chunkDataEnd:
+			line, err := c.readLine()
+			if err == nil && line != "" {
+				err = fmt.Errorf("%w: missing CRLF after chunk data", response.ErrMalformedChunk)
+			}
+			c.err = err
+			c.state = chunkSize
+		case chunkTrailers:
+			c.err = c.readTrailers()
+		case chunkDone:
+			c.err = io.EOF
+		}
+	}
+	return 0, c.err
+}
+
+func (c *chunkedReader) readChunkSize() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	// Chunk extensions are ignored.
+	size, _, _ := strings.Cut(line, ";")
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%w: invalid chunk size %q", response.ErrMalformedChunk, line)
+	}
+	if n == 0 {
+		c.state = chunkTrailers
+		return nil
+	}
+	c.remaining = n
+	c.state = chunkData
+	return nil
+}
+
+func (c *chunkedReader) readTrailers() error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		_, done, err := c.trailers.Parse([]byte(line + "\r\n"))
+		if err != nil {
+			return fmt.Errorf("%w: %w", response.ErrMalformedHeader, err)
+		}
+		if done {
+			c.state = chunkDone
+			return nil
+		}
+	}
+}
+
+// readLine reads a CRLF terminated line, without the CRLF.
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return "", c.lineError(err)
+	}
+	if !strings.HasSuffix(string(line), "\r\n") {
+		return "", fmt.Errorf("%w: line not terminated by CRLF", response.ErrMalformedChunk)
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+func (c *chunkedReader) lineError(err error) error {
+	switch {
+	case errors.Is(err, io.EOF):
+		return io.ErrUnexpectedEOF
+	case errors.Is(err, bufio.ErrBufferFull):
+		return fmt.Errorf("%w: line too long", response.ErrMalformedChunk)
+	}
+	return err
+}
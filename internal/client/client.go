@@ -0,0 +1,470 @@
+// Package client is an HTTP/1.1 client that writes requests in wire format
+// and parses response heads with response.ReadResponseHead.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultDialTimeout bounds connecting to a server, TLS handshake
+// included, when Client.DialTimeout is zero.
+const DefaultDialTimeout = 30 * time.Second
+
+// aLongTimeAgo is a deadline in the past, used to interrupt blocked I/O
+// when a request's context is done.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Request is a request to be sent by a Client.
+type Request struct {
+	Method  string
+	URL     *url.URL
+	Headers headers.Headers
+	// Body, if not nil, is sent after the headers: with Content-Length
+	// when ContentLength is zero or more, and chunked otherwise.
+	Body          io.Reader
+	ContentLength int64
+	// Trailers are sent after a chunked body.
+	Trailers headers.Headers
+
+	ctx context.Context
+}
+
+// NewRequest returns a request for rawURL, which must be an http or https
+// URL. The length of body is known without reading it for the types
+// bytes.Reader, bytes.Buffer and strings.Reader; any other body is sent
+// chunked unless ContentLength is set.
+func NewRequest(ctx context.Context, method, rawURL string, body io.Reader) (*Request, error) {
+	if ctx == nil {
+		return nil, errors.New("client: nil context")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("client: unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("client: no host in URL %q", rawURL)
+	}
+
+	req := &Request{
+		Method:        method,
+		URL:           u,
+		Headers:       headers.NewHeaders(),
+		Body:          body,
+		ContentLength: -1,
+		ctx:           ctx,
+	}
+	switch b := body.(type) {
+	case nil:
+		req.ContentLength = 0
+	case *bytes.Reader:
+		req.ContentLength = int64(b.Len())
+	case *bytes.Buffer:
+		req.ContentLength = int64(b.Len())
+	case *strings.Reader:
+		req.ContentLength = int64(b.Len())
+	}
+	return req, nil
+}
+
+// Context returns the request's context, which bounds the whole exchange
+// including reading the response body.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// Client sends requests. Without a Pool it uses one connection per
+// request and asks the server to close it.
+type Client struct {
+	// TLSConfig is used for https URLs. When nil, the default
+	// configuration is used with the URL's host as server name.
+	TLSConfig *tls.Config
+	// DialTimeout bounds connecting, TLS handshake included. Zero means
+	// DefaultDialTimeout.
+	DialTimeout time.Duration
+	// Pool, if not nil, keeps connections alive for reuse once a
+	// response body has been read to the end.
+	Pool *Pool
+}
+
+// DefaultClient is the Client used by Get.
+var DefaultClient = &Client{}
+
+// Get sends a GET request for rawURL with DefaultClient.
+func Get(ctx context.Context, rawURL string) (*Response, error) {
+	return DefaultClient.Get(ctx, rawURL)
+}
+
+// Get sends a GET request for rawURL.
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	req, err := NewRequest(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends req and reads the response's status line and headers. Any
+// status is returned without error. The caller must close the response's
+// Body, which releases the connection.
+func (c *Client) Do(req *Request) (*Response, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	resp, reused, err := c.roundTrip(req, true)
+	// The server may close an idle connection just as it is reused. A
+	// request that is safe to repeat is sent again on a new connection.
+	if err != nil && reused && req.Body == nil && isIdempotent(req.Method) &&
+		req.Context().Err() == nil && isStaleConnError(err) {
+		resp, _, err = c.roundTrip(req, false)
+	}
+	return resp, err
+}
+
+// roundTrip sends req on a pooled connection, if reuse allows and one is
+// idle, or a new one. It reports whether the connection was reused.
+func (c *Client) roundTrip(req *Request, reuse bool) (*Response, bool, error) {
+	ctx := req.Context()
+	key := poolKey(req.URL)
+	var conn net.Conn
+	if c.Pool != nil && reuse {
+		conn = c.Pool.get(key)
+	}
+	reused := conn != nil
+	if conn == nil {
+		if c.Pool != nil {
+			c.Pool.misses.Add(1)
+		}
+		var err error
+		conn, err = c.dial(ctx, req.URL)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Cancelling the context interrupts whatever I/O is under way, up to
+	// the last read of the body.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	fail := func(err error) (*Response, bool, error) {
+		stop()
+		conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+			err = ctxErr
+		}
+		return nil, reused, err
+	}
+
+	if err := writeRequest(conn, req, c.Pool != nil); err != nil {
+		return fail(err)
+	}
+
+	var (
+		resp     *Response
+		leftover []byte
+		err      error
+	)
+	for {
+		resp, leftover, err = readResponseHead(io.MultiReader(bytes.NewReader(leftover), conn))
+		if err != nil {
+			return fail(err)
+		}
+		// Interim responses such as 100 Continue are skipped.
+		code := resp.StatusLine.StatusCode
+		if code >= 200 || code == response.StatusCodeSwitchingProtocols {
+			break
+		}
+	}
+
+	framing, length, err := resp.head.Framing(req.Method)
+	if err != nil {
+		return fail(err)
+	}
+	rest := bytes.NewReader(leftover)
+	src := bufio.NewReader(io.MultiReader(rest, conn))
+	var r io.Reader
+	switch framing {
+	case response.FramingNone:
+		r = &fixedReader{}
+	case response.FramingChunked:
+		r = newChunkedReader(src, resp.Trailers)
+	case response.FramingContentLength:
+		r = &fixedReader{r: src, remaining: length}
+	default:
+		// Without framing, the body runs until the server closes the
+		// connection.
+		r = src
+	}
+	b := &body{r: r, conn: conn, ctx: ctx, stop: stop}
+	if c.Pool != nil && framing != response.FramingUntilClose && keepAlive(resp) {
+		b.reuse = func() bool {
+			// Anything read past the body means the connection is out
+			// of step with the server.
+			if rest.Len() > 0 || src.Buffered() > 0 {
+				return false
+			}
+			c.Pool.put(key, conn)
+			return true
+		}
+	}
+	if framing == response.FramingNone || (framing == response.FramingContentLength && length == 0) {
+		b.release(true)
+	}
+	resp.Body = b
+	return resp, reused, nil
+}
+
+func (c *Client) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	timeout := c.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort(u))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return conn, nil
+	}
+
+	config := c.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// hostPort returns the address to dial for u, with the scheme's default
+// port when it has none.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// validateRequest checks that req can be written without changing its
+// meaning, so bad input from the caller can't add headers or requests of
+// its own.
+func validateRequest(req *Request) error {
+	if !headers.IsToken(req.Method) {
+		return fmt.Errorf("client: invalid method %q", req.Method)
+	}
+	target := req.URL.RequestURI()
+	for i := 0; i < len(target); i++ {
+		if c := target[i]; c <= ' ' || c == 0x7f {
+			return fmt.Errorf("client: invalid request target %q", target)
+		}
+	}
+	if !headers.ValidValue(req.URL.Host) {
+		return fmt.Errorf("client: invalid host %q", req.URL.Host)
+	}
+	for _, fields := range []headers.Headers{req.Headers, req.Trailers} {
+		for name, value := range fields {
+			if !headers.IsToken(name) {
+				return fmt.Errorf("client: invalid header name %q", name)
+			}
+			if !headers.ValidValue(value) {
+				return fmt.Errorf("client: invalid value for header %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// writeRequest writes req in HTTP/1.1 wire format. Unless keepAlive is
+// set, it asks the server to close the connection after responding.
+func writeRequest(w io.Writer, req *Request, keepAlive bool) error {
+	bw := bufio.NewWriter(w)
+
+	target := req.URL.RequestURI()
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", req.Method, target)
+
+	h := headers.NewHeaders()
+	for k, v := range req.Headers {
+		h.Override(k, v)
+	}
+	if _, ok := h.Get("Host"); !ok {
+		h.Set("Host", req.URL.Host)
+	}
+	if keepAlive {
+		h.Remove("Connection")
+	} else {
+		h.Override("Connection", "close")
+	}
+	chunked := req.Body != nil && req.ContentLength < 0
+	h.Remove("Transfer-Encoding")
+	h.Remove("Content-Length")
+	switch {
+	case chunked:
+		h.Set("Transfer-Encoding", "chunked")
+	case req.ContentLength > 0 || req.Method == "POST" || req.Method == "PUT" || req.Method == "PATCH":
+		h.Set("Content-Length", fmt.Sprint(req.ContentLength))
+	}
+	if err := response.WriteHeaders(bw, h); err != nil {
+		return err
+	}
+
+	switch {
+	case chunked:
+		if err := writeChunked(bw, req.Body, req.Trailers); err != nil {
+			return err
+		}
+	case req.ContentLength > 0:
+		if req.Body == nil {
+			return errors.New("client: ContentLength set without a Body")
+		}
+		n, err := io.CopyN(bw, req.Body, req.ContentLength)
+		if err != nil {
+			return fmt.Errorf("client: body ended after %d of %d bytes: %w", n, req.ContentLength, err)
+		}
+	}
+	return bw.Flush()
+}
+
+func writeChunked(w io.Writer, body io.Reader, trailers headers.Headers) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := fmt.Fprintf(w, "%x\r\n%s\r\n", n, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(w, "0\r\n"); err != nil {
+		return err
+	}
+	return response.WriteHeaders(w, trailers)
+}
+
+// body is a response body. Once it has been read to the end, its
+// connection goes back to the pool if reuse allows; otherwise closing the
+// body closes the connection.
+type body struct {
+	r    io.Reader
+	conn net.Conn
+	ctx  context.Context
+	stop func() bool
+	// reuse, if set, offers the connection to the pool and reports
+	// whether it was taken.
+	reuse    func() bool
+	released bool
+	closed   bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errors.New("client: read on closed response body")
+	}
+	if b.released {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.release(true)
+	} else if err != nil {
+		if ctxErr := b.ctx.Err(); ctxErr != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+			err = ctxErr
+		}
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	return b.release(false)
+}
+
+// release gives up the connection, to the pool when the body was read to
+// the end and the connection can be reused.
+func (b *body) release(eof bool) error {
+	if b.released {
+		return nil
+	}
+	b.released = true
+	// stop reports false once cancellation has already set a deadline in
+	// the past on the connection.
+	if b.stop() && eof && b.reuse != nil && b.reuse() {
+		return nil
+	}
+	return b.conn.Close()
+}
+
+// keepAlive reports whether the server left the connection open after
+// resp.
+func keepAlive(resp *Response) bool {
+	if resp.StatusLine.HttpVersion != "1.1" || resp.StatusLine.StatusCode == response.StatusCodeSwitchingProtocols {
+		return false
+	}
+	value, _ := resp.Headers.Get("Connection")
+	for _, token := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "close") {
+			return false
+		}
+	}
+	return true
+}
+
+// isIdempotent reports whether a request with method can be sent twice
+// with the same effect as once.
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// isStaleConnError reports whether err looks like a reused connection
+// having been closed by the server before it answered.
+func isStaleConnError(err error) bool {
+	return errors.Is(err, response.ErrIncompleteResponse) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,276 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	for name, tc := range map[string]struct {
+		method   string
+		reply    string
+		body     string
+		trailers map[string]string
+	}{
+		"Content-Length": {
+			reply: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			body:  "hello",
+		},
+		"chunked with trailers": {
+			reply:    "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: abc\r\n\r\n",
+			body:     "hello world",
+			trailers: map[string]string{"x-sum": "abc"},
+		},
+		"close-delimited": {
+			reply: "HTTP/1.0 200 OK\r\n\r\nuntil the end",
+			body:  "until the end",
+		},
+		"interim response skipped": {
+			reply: "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			body:  "ok",
+		},
+		"HEAD has no body": {
+			method: "HEAD",
+			reply:  "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+		},
+		"304 has no body": {
+			reply: "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr, _ := serveScript(t, tc.reply)
+			method := tc.method
+			if method == "" {
+				method = "GET"
+			}
+			req, err := NewRequest(context.Background(), method, "http://"+addr+"/x", nil)
+			require.NoError(t, err)
+
+			// Test: The body is read according to its framing
+			resp, err := (&Client{}).Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.body, string(body))
+			for k, v := range tc.trailers {
+				assert.Equal(t, v, resp.Trailers[k])
+			}
+		})
+	}
+}
+
+func TestAgainstServer(t *testing.T) {
+	srv, err := server.ServeAddr("127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Method")
+		w.WriteStatusLine(response.StatusCodeOK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("got "))
+		w.WriteChunkedBody(req.Body)
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Method", req.RequestLine.Method)
+		w.WriteTrailers(trailers)
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Our client and server understand each other
+	req, err := NewRequest(context.Background(), "POST", "http://"+srv.Addr().String()+"/", strings.NewReader("ping"))
+	require.NoError(t, err)
+	resp, err := DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "got ping", string(body))
+	assert.Equal(t, "POST", resp.Trailers["x-method"])
+}
+
+func TestRequestWireFormat(t *testing.T) {
+	// Test: A request with a known length is parsed by our own parser
+	addr, requests := serveScript(t, "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n")
+	req, err := NewRequest(context.Background(), "POST", "http://"+addr+"/items?id=1", strings.NewReader(`{"a":1}`))
+	require.NoError(t, err)
+	req.Headers.Set("Content-Type", "application/json")
+	resp, err := DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, response.StatusCode(201), resp.StatusLine.StatusCode)
+	assert.Equal(t, "Created", resp.StatusLine.ReasonPhrase)
+
+	got, err := request.RequestFromReader(bytes.NewReader(<-requests))
+	require.NoError(t, err)
+	assert.Equal(t, "POST", got.RequestLine.Method)
+	assert.Equal(t, "/items?id=1", got.RequestLine.RequestTarget)
+	assert.Equal(t, addr, got.Headers["host"])
+	assert.Equal(t, "application/json", got.Headers["content-type"])
+	assert.Equal(t, "close", got.Headers["connection"])
+	assert.Equal(t, `{"a":1}`, string(got.Body))
+
+	// Test: A body of unknown length is sent chunked, with trailers
+	addr, requests = serveScript(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	req, err = NewRequest(context.Background(), "PUT", "http://"+addr+"/", io.MultiReader(strings.NewReader("abc")))
+	require.NoError(t, err)
+	req.Trailers = map[string]string{"x-sum": "1"}
+	resp, err = DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	raw := string(<-requests)
+	assert.Contains(t, raw, "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(raw, "\r\n\r\n3\r\nabc\r\n0\r\nx-sum: 1\r\n\r\n"), raw)
+}
+
+func TestMalformedResponses(t *testing.T) {
+	for name, tc := range map[string]struct {
+		reply   string
+		headErr error
+		bodyErr error
+	}{
+		"bad status line":   {reply: "HTTP/1.1 OK\r\n\r\n", headErr: response.ErrMalformedStatusLine},
+		"bad version":       {reply: "HTTP/2 200 OK\r\n\r\n", headErr: response.ErrUnsupportedVersion},
+		"bad header":        {reply: "HTTP/1.1 200 OK\r\nBad Header: x\r\n\r\n", headErr: response.ErrMalformedHeader},
+		"truncated head":    {reply: "HTTP/1.1 200 OK\r\nContent-", headErr: response.ErrIncompleteResponse},
+		"bad length":        {reply: "HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n", headErr: response.ErrInvalidContentLength},
+		"short body":        {reply: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello", bodyErr: io.ErrUnexpectedEOF},
+		"bad chunk size":    {reply: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", bodyErr: response.ErrMalformedChunk},
+		"truncated chunked": {reply: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel", bodyErr: io.ErrUnexpectedEOF},
+		"missing chunk end": {reply: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhello\r\n0\r\n\r\n", bodyErr: response.ErrMalformedChunk},
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr, _ := serveScript(t, tc.reply)
+
+			// Test: Errors are reported where they are found
+			resp, err := Get(context.Background(), "http://"+addr+"/")
+			if tc.headErr != nil {
+				assert.ErrorIs(t, err, tc.headErr)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			_, err = io.ReadAll(resp.Body)
+			assert.ErrorIs(t, err, tc.bodyErr)
+		})
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			// Never answer.
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	// Test: Cancelling the context abandons the request
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = Get(ctx, "http://"+listener.Addr().String()+"/")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNewRequest(t *testing.T) {
+	// Test: Only http and https URLs are accepted
+	_, err := NewRequest(context.Background(), "GET", "ftp://example.com/", nil)
+	assert.Error(t, err)
+	_, err = NewRequest(context.Background(), "GET", "/relative", nil)
+	assert.Error(t, err)
+
+	// Test: Default ports follow the scheme
+	req, err := NewRequest(context.Background(), "GET", "https://example.com/a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:443", hostPort(req.URL))
+	assert.Equal(t, int64(0), req.ContentLength)
+	req, err = NewRequest(context.Background(), "GET", "http://[::1]:8080/a", bytes.NewReader([]byte("abc")))
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:8080", hostPort(req.URL))
+	assert.Equal(t, int64(3), req.ContentLength)
+}
+
+func TestInvalidRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	for name, modify := range map[string]func(req *Request){
+		"method with a space":      func(req *Request) { req.Method = "GET / HTTP/1.1\r\nX:" },
+		"empty method":             func(req *Request) { req.Method = "" },
+		"CR LF in the target":      func(req *Request) { req.URL.RawQuery = "a\r\nX-Injected: 1" },
+		"CR LF in a header value":  func(req *Request) { req.Headers.Set("X-A", "v\r\nTransfer-Encoding: chunked") },
+		"NUL in a header value":    func(req *Request) { req.Headers.Set("X-A", "v\x00") },
+		"colon in a header name":   func(req *Request) { req.Headers.Set("X-A: v\r\nX-B", "w") },
+		"empty header name":        func(req *Request) { req.Headers.Set("", "v") },
+		"LF in a trailer value":    func(req *Request) { req.Trailers = headers.Headers{"x-sum": "1\nx-b: 2"} },
+		"space in a trailer name":  func(req *Request) { req.Trailers = headers.Headers{"x sum": "1"} },
+		"CR LF in the Host header": func(req *Request) { req.Headers.Set("Host", "a\r\nX-B: 1") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			req, err := NewRequest(context.Background(), "GET", "http://"+listener.Addr().String()+"/", nil)
+			require.NoError(t, err)
+			modify(req)
+
+			// Test: The request is refused before anything is sent
+			_, err = DefaultClient.Do(req)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "client: invalid")
+			listener.(*net.TCPListener).SetDeadline(time.Now().Add(20 * time.Millisecond))
+			_, err = listener.Accept()
+			assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		})
+	}
+}
+
+// serveScript accepts one connection, sends reply once the request has
+// arrived, and closes it. The raw request is sent on the returned
+// channel.
+func serveScript(t *testing.T, reply string) (string, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// The request is complete once nothing more arrives for a
+		// moment; a test server doesn't need to parse it.
+		var raw []byte
+		buf := make([]byte, 4096)
+		for {
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			n, err := conn.Read(buf)
+			raw = append(raw, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		requests <- raw
+		conn.Write([]byte(reply))
+	}()
+	return listener.Addr().String(), requests
+}
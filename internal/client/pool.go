@@ -0,0 +1,200 @@
+package client
+
+import (
+	"errors"
+	"github.com/peeta98/httpfromtcp/internal/metrics"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxIdlePerHost is the number of idle connections a Pool keeps
+	// for each host when MaxIdlePerHost is zero.
+	DefaultMaxIdlePerHost = 2
+	// DefaultIdleTimeout is how long a Pool keeps a connection idle when
+	// IdleTimeout is zero.
+	DefaultIdleTimeout = 90 * time.Second
+)
+
+// healthCheckWait is how long a connection taken from the pool is watched
+// for the server having closed it.
+const healthCheckWait = time.Millisecond
+
+// Pool keeps connections open after their response has been read so later
+// requests to the same scheme, host and port can reuse them. A Pool is
+// meant to be shared by clients with the same TLS configuration.
+type Pool struct {
+	// MaxIdlePerHost caps the idle connections kept for each scheme, host
+	// and port. Zero means DefaultMaxIdlePerHost.
+	MaxIdlePerHost int
+	// IdleTimeout is how long a connection may stay idle before it is
+	// closed. Zero means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*idleConn
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	discarded atomic.Uint64
+}
+
+// PoolStats counts how requests got their connection.
+type PoolStats struct {
+	// Hits are requests sent on an idle pooled connection.
+	Hits uint64
+	// Misses are requests that needed a new connection.
+	Misses uint64
+	// Discarded are idle connections that failed the health check on
+	// reuse.
+	Discarded uint64
+	// Idle is the number of connections idle in the pool.
+	Idle int
+}
+
+type idleConn struct {
+	conn  net.Conn
+	key   string
+	timer *time.Timer
+}
+
+// Stats returns the pool's counters.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	idle := 0
+	for _, conns := range p.idle {
+		idle += len(conns)
+	}
+	p.mu.Unlock()
+	return PoolStats{
+		Hits:      p.hits.Load(),
+		Misses:    p.misses.Load(),
+		Discarded: p.discarded.Load(),
+		Idle:      idle,
+	}
+}
+
+// RegisterMetrics exposes the pool's counters in r.
+func (p *Pool) RegisterMetrics(r *metrics.Registry) {
+	r.CounterFunc("http_client_pool_hits_total", "Requests sent on an idle pooled connection.", func() float64 {
+		return float64(p.hits.Load())
+	})
+	r.CounterFunc("http_client_pool_misses_total", "Requests that needed a new connection.", func() float64 {
+		return float64(p.misses.Load())
+	})
+	r.CounterFunc("http_client_pool_discarded_total", "Idle connections closed because they failed the health check on reuse.", func() float64 {
+		return float64(p.discarded.Load())
+	})
+	r.GaugeFunc("http_client_pool_idle_connections", "Connections idle in the pool.", func() float64 {
+		return float64(p.Stats().Idle)
+	})
+}
+
+// CloseIdle closes every idle connection. Connections in use are returned
+// to the pool as usual.
+func (p *Pool) CloseIdle() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, conns := range idle {
+		for _, ic := range conns {
+			ic.timer.Stop()
+			ic.conn.Close()
+		}
+	}
+}
+
+// get returns a healthy idle connection for key, most recently used
+// first, or nil if there is none.
+func (p *Pool) get(key string) net.Conn {
+	for {
+		ic := p.pop(key)
+		if ic == nil {
+			return nil
+		}
+		if healthy(ic.conn) {
+			p.hits.Add(1)
+			return ic.conn
+		}
+		p.discarded.Add(1)
+		ic.conn.Close()
+	}
+}
+
+func (p *Pool) pop(key string) *idleConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	ic := conns[len(conns)-1]
+	p.idle[key] = conns[:len(conns)-1]
+	ic.timer.Stop()
+	return ic
+}
+
+// put adds conn to the idle connections for key, or closes it when there
+// are enough already.
+func (p *Pool) put(key string, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[key]) >= p.maxIdlePerHost() {
+		conn.Close()
+		return
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]*idleConn)
+	}
+	ic := &idleConn{conn: conn, key: key}
+	ic.timer = time.AfterFunc(p.idleTimeout(), func() { p.expire(ic) })
+	p.idle[key] = append(p.idle[key], ic)
+}
+
+// expire closes ic if it is still idle when its timeout fires.
+func (p *Pool) expire(ic *idleConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[ic.key]
+	for i, c := range conns {
+		if c == ic {
+			p.idle[ic.key] = append(conns[:i], conns[i+1:]...)
+			ic.conn.Close()
+			return
+		}
+	}
+}
+
+func (p *Pool) maxIdlePerHost() int {
+	if p.MaxIdlePerHost > 0 {
+		return p.MaxIdlePerHost
+	}
+	return DefaultMaxIdlePerHost
+}
+
+func (p *Pool) idleTimeout() time.Duration {
+	if p.IdleTimeout > 0 {
+		return p.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// poolKey identifies the connections that can serve a request for u.
+func poolKey(u *url.URL) string {
+	return u.Scheme + "://" + hostPort(u)
+}
+
+// healthy reports whether an idle connection can be reused: the server
+// must neither have closed it nor sent anything while it sat idle.
+func healthy(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(healthCheckWait))
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+	return n == 0 && errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/metrics"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolReuse(t *testing.T) {
+	addr, conns := serveKeepAlive(t, func(n int, req *request.Request) string {
+		return okReply(req.RequestLine.RequestTarget)
+	})
+	pool := &Pool{}
+	c := &Client{Pool: pool}
+
+	// Test: Sequential requests share one connection
+	for _, path := range []string{"/a", "/b", "/c"} {
+		assert.Equal(t, path, get(t, c, "http://"+addr+path))
+	}
+	assert.Equal(t, int32(1), conns.Load())
+	stats := pool.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 1, stats.Idle)
+
+	// Test: A body closed before its end does not return the connection
+	resp, err := c.Get(context.Background(), "http://"+addr+"/partial")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 0, pool.Stats().Idle)
+	assert.Equal(t, "/d", get(t, c, "http://"+addr+"/d"))
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: Idle connections can be closed
+	pool.CloseIdle()
+	assert.Equal(t, 0, pool.Stats().Idle)
+}
+
+func TestPoolNoReuse(t *testing.T) {
+	for name, reply := range map[string]string{
+		"Connection: close": "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok",
+		"HTTP/1.0":          "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok",
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr, conns := serveKeepAlive(t, func(int, *request.Request) string { return reply })
+			pool := &Pool{}
+			c := &Client{Pool: pool}
+
+			// Test: The connection is not kept when the server won't reuse it
+			for range 2 {
+				assert.Equal(t, "ok", get(t, c, "http://"+addr+"/"))
+			}
+			assert.Equal(t, 0, pool.Stats().Idle)
+			assert.Equal(t, uint64(0), pool.Stats().Hits)
+			assert.Equal(t, int32(2), conns.Load())
+		})
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	// The server closes each connection after its response, without
+	// saying so in the response.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				if _, _, err := request.ReadRequest(conn); err == nil {
+					conn.Write([]byte(okReply("fresh")))
+				}
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+	pool := &Pool{}
+	c := &Client{Pool: pool}
+
+	// Test: An idle connection the server closed is discarded on reuse
+	assert.Equal(t, "fresh", get(t, c, "http://"+addr+"/"))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "fresh", get(t, c, "http://"+addr+"/"))
+	stats := pool.Stats()
+	assert.Equal(t, uint64(1), stats.Discarded)
+	assert.Equal(t, uint64(0), stats.Hits)
+	assert.Equal(t, int32(2), conns.Load())
+}
+
+func TestPoolRetryStaleConn(t *testing.T) {
+	// The server reads the second request on a connection, then hangs up
+	// without answering.
+	addr, conns := serveKeepAlive(t, func(n int, req *request.Request) string {
+		if n > 1 {
+			return ""
+		}
+		return okReply(req.RequestLine.Method)
+	})
+	pool := &Pool{}
+	c := &Client{Pool: pool}
+	assert.Equal(t, "GET", get(t, c, "http://"+addr+"/"))
+
+	// Test: A bodiless idempotent request is retried on a new connection
+	assert.Equal(t, "GET", get(t, c, "http://"+addr+"/"))
+	assert.Equal(t, uint64(1), pool.Stats().Hits)
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: A POST is not retried
+	req, err := NewRequest(context.Background(), "POST", "http://"+addr+"/", nil)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	assert.Error(t, err)
+}
+
+func TestPoolLimits(t *testing.T) {
+	addr, _ := serveKeepAlive(t, func(n int, req *request.Request) string {
+		return okReply("ok")
+	})
+	pool := &Pool{MaxIdlePerHost: 1, IdleTimeout: 50 * time.Millisecond}
+	c := &Client{Pool: pool}
+
+	// Test: At most MaxIdlePerHost connections are kept per host
+	var bodies []io.ReadCloser
+	for range 3 {
+		resp, err := c.Get(context.Background(), "http://"+addr+"/")
+		require.NoError(t, err)
+		bodies = append(bodies, resp.Body)
+	}
+	for _, b := range bodies {
+		_, err := io.ReadAll(b)
+		require.NoError(t, err)
+		b.Close()
+	}
+	assert.Equal(t, 1, pool.Stats().Idle)
+
+	// Test: Connections idle for longer than IdleTimeout are closed
+	assert.Eventually(t, func() bool { return pool.Stats().Idle == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestPoolMetrics(t *testing.T) {
+	addr, _ := serveKeepAlive(t, func(n int, req *request.Request) string {
+		return okReply("ok")
+	})
+	pool := &Pool{}
+	c := &Client{Pool: pool}
+	r := metrics.NewRegistry()
+	pool.RegisterMetrics(r)
+	get(t, c, "http://"+addr+"/")
+	get(t, c, "http://"+addr+"/")
+
+	// Test: Hits, misses and idle connections are exposed
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+	assert.Contains(t, buf.String(), "http_client_pool_hits_total 1\n")
+	assert.Contains(t, buf.String(), "http_client_pool_misses_total 1\n")
+	assert.Contains(t, buf.String(), "http_client_pool_idle_connections 1\n")
+}
+
+// get sends a GET for url with c and returns the body.
+func get(t *testing.T, c *Client, url string) string {
+	t.Helper()
+	resp, err := c.Get(context.Background(), url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func okReply(body string) string {
+	return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+// serveKeepAlive serves any number of requests on each connection, with
+// the reply reply returns for the nth request on the connection. An empty
+// reply closes the connection instead. The returned counter holds the
+// number of connections accepted.
+func serveKeepAlive(t *testing.T, reply func(n int, req *request.Request) string) (string, *atomic.Int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				var leftover []byte
+				for n := 1; ; n++ {
+					var req *request.Request
+					req, leftover, err = request.ReadRequest(io.MultiReader(bytes.NewReader(leftover), conn))
+					if err != nil {
+						return
+					}
+					r := reply(n, req)
+					if r == "" {
+						return
+					}
+					if _, err := conn.Write([]byte(r)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), &conns
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"io"
+)
+
+// Response is a response received by a Client. Its body is read from the
+// connection as Body is read, and must be closed.
+type Response struct {
+	StatusLine response.StatusLine
+	Headers    headers.Headers
+	Body       io.ReadCloser
+	// Trailers holds the trailer fields sent after a chunked body. It is
+	// filled in once Body has returned io.EOF.
+	Trailers headers.Headers
+
+	head *response.Response
+}
+
+// readResponseHead parses a status line and headers with the response
+// package's parser, returning the bytes it read past them, which start
+// the body.
+func readResponseHead(reader io.Reader) (*Response, []byte, error) {
+	head, leftover, err := response.ReadResponseHead(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Response{
+		StatusLine: head.StatusLine,
+		Headers:    head.Headers,
+		Trailers:   head.Trailers,
+		head:       head,
+	}, leftover, nil
+}
@@ -0,0 +1,389 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type Config struct {
+	// Level is passed to the gzip and zlib encoders. Zero selects the
+	// default compression level.
+	Level int
+	// MinSize is the smallest Content-Length worth compressing. Streamed
+	// bodies of unknown length are always compressed.
+	MinSize int
+	// MaxSize is the largest Content-Length compressed. Such bodies are
+	// held in memory until complete so the compressed length can be
+	// announced, so larger ones pass through unencoded as they are
+	// written. Zero means DefaultMaxSize.
+	MaxSize int
+	// SkipContentTypes lists media type prefixes whose bodies are already
+	// compressed and would only grow if encoded again.
+	SkipContentTypes []string
+}
+
+// DefaultMaxSize is the largest Content-Length body compressed when
+// Config.MaxSize is zero.
+const DefaultMaxSize = 1 << 20
+
+var DefaultConfig = Config{
+	Level:   gzip.DefaultCompression,
+	MinSize: 256,
+	MaxSize: DefaultMaxSize,
+	SkipContentTypes: []string{
+		"image/",
+		"video/",
+		"audio/",
+		"font/woff",
+		"application/zip",
+		"application/gzip",
+		"application/x-gzip",
+		"application/zstd",
+		"application/x-bzip2",
+		"application/x-7z-compressed",
+		"application/x-rar-compressed",
+		"application/pdf",
+		"application/octet-stream",
+	},
+}
+
+// Middleware compresses responses with DefaultConfig.
+func Middleware(next server.Handler) server.Handler {
+	return NewMiddleware(DefaultConfig)(next)
+}
+
+// NewMiddleware returns a middleware that gzip or deflate encodes response
+// bodies according to the request's Accept-Encoding header.
+func NewMiddleware(cfg Config) server.Middleware {
+	if cfg.Level == 0 {
+		cfg.Level = gzip.DefaultCompression
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = DefaultMaxSize
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.Method == "HEAD" {
+				next(w, req)
+				return
+			}
+
+			acceptEncoding, _ := req.Headers.Get("Accept-Encoding")
+			sink := &compressSink{
+				next:     w,
+				cfg:      cfg,
+				encoding: negotiateEncoding(acceptEncoding),
+			}
+			next(response.NewSinkWriter(sink), req)
+			sink.close()
+		}
+	}
+}
+
+type sinkMode int
+
+const (
+	// modePassthrough forwards everything untouched.
+	modePassthrough sinkMode = iota
+	// modeBuffer collects a body of known Content-Length and compresses it
+	// in one go, so the compressed length can be announced.
+	modeBuffer
+	// modeStream compresses a chunked or close-delimited body as it is
+	// written.
+	modeStream
+)
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+type compressSink struct {
+	next       *response.Writer
+	cfg        Config
+	encoding   string
+	statusCode response.StatusCode
+	mode       sinkMode
+	chunked    bool
+	done       bool
+
+	// In modeBuffer, headers and body hold the response until the whole
+	// body has been written. In modeStream, body collects encoder output
+	// until it is forwarded.
+	headers       headers.Headers
+	contentLength int
+	body          bytes.Buffer
+	encoder       encoder
+}
+
+func (s *compressSink) WriteStatusLine(statusCode response.StatusCode) error {
+	s.statusCode = statusCode
+	return s.next.WriteStatusLine(statusCode)
+}
+
+func (s *compressSink) WriteHeaders(h headers.Headers) error {
+	if s.statusCode == response.StatusCodeNotModified && !noTransform(h) {
+		// A 304 stands in for a response that may have been compressed, so
+		// it repeats the Vary that response carries (RFC 9110 section
+		// 15.4.5). Without a Content-Type it can't tell, so it always does.
+		addVary(h)
+		return s.next.WriteHeaders(h)
+	}
+	if !s.compressible(h) {
+		return s.next.WriteHeaders(h)
+	}
+
+	addVary(h)
+	if s.encoding == "" {
+		return s.next.WriteHeaders(h)
+	}
+
+	s.chunked = response.IsChunked(h)
+	if contentLength, ok := h.Get("Content-Length"); ok && !s.chunked {
+		n, err := strconv.Atoi(contentLength)
+		if err != nil || n == 0 || n < s.cfg.MinSize || n > s.cfg.MaxSize {
+			return s.next.WriteHeaders(h)
+		}
+		s.mode = modeBuffer
+		s.headers = h
+		s.contentLength = n
+		return nil
+	}
+
+	enc, err := newEncoder(s.encoding, &s.body, s.cfg.Level)
+	if err != nil {
+		return err
+	}
+	s.mode = modeStream
+	s.encoder = enc
+
+	h.Remove("Content-Length")
+	h.Override("Content-Encoding", s.encoding)
+	weakenETag(h)
+	return s.next.WriteHeaders(h)
+}
+
+func (s *compressSink) WriteBody(p []byte) (int, error) {
+	switch s.mode {
+	case modeBuffer:
+		s.body.Write(p)
+		if s.body.Len() >= s.contentLength {
+			if err := s.flushBuffered(); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	case modeStream:
+		if err := s.encode(p); err != nil {
+			return 0, err
+		}
+		if s.body.Len() > 0 {
+			if _, err := s.next.WriteBody(s.body.Bytes()); err != nil {
+				return 0, err
+			}
+			s.body.Reset()
+		}
+		return len(p), nil
+	default:
+		return s.next.WriteBody(p)
+	}
+}
+
+func (s *compressSink) WriteChunkedBody(p []byte) (int, error) {
+	if s.mode != modeStream {
+		return s.next.WriteChunkedBody(p)
+	}
+
+	if err := s.encode(p); err != nil {
+		return 0, err
+	}
+	// An empty chunk would terminate the body, so only forward output once
+	// the encoder has produced some.
+	if err := s.forwardChunk(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *compressSink) WriteChunkedBodyDone() (int, error) {
+	if s.mode == modeStream {
+		s.done = true
+		if err := s.encoder.Close(); err != nil {
+			return 0, err
+		}
+		if err := s.forwardChunk(); err != nil {
+			return 0, err
+		}
+	}
+	return s.next.WriteChunkedBodyDone()
+}
+
+func (s *compressSink) WriteTrailers(h headers.Headers) error {
+	return s.next.WriteTrailers(h)
+}
+
+// Hijack hands the connection over unchanged. Anything held back for
+// compression is dropped, as the handler now owns the connection.
+func (s *compressSink) Hijack() (net.Conn, []byte, error) {
+	conn, buffered, err := s.next.Hijack()
+	if err == nil {
+		s.mode = modePassthrough
+	}
+	return conn, buffered, err
+}
+
+// close finishes whatever the handler left incomplete once it returns.
+func (s *compressSink) close() {
+	switch s.mode {
+	case modeBuffer:
+		// The handler wrote less than it announced. Send what we have
+		// unencoded so the framing error is the handler's, not ours.
+		s.mode = modePassthrough
+		s.next.WriteHeaders(s.headers)
+		s.next.WriteBody(s.body.Bytes())
+	case modeStream:
+		if s.chunked || s.done {
+			return
+		}
+		s.done = true
+		if err := s.encoder.Close(); err != nil {
+			return
+		}
+		if s.body.Len() > 0 {
+			s.next.WriteBody(s.body.Bytes())
+			s.body.Reset()
+		}
+	}
+}
+
+func (s *compressSink) encode(p []byte) error {
+	if _, err := s.encoder.Write(p); err != nil {
+		return err
+	}
+	// Flushing after every write keeps streamed responses such as event
+	// streams flowing at the cost of a slightly worse ratio.
+	return s.encoder.Flush()
+}
+
+func (s *compressSink) forwardChunk() error {
+	if s.body.Len() == 0 {
+		return nil
+	}
+	_, err := s.next.WriteChunkedBody(s.body.Bytes())
+	s.body.Reset()
+	return err
+}
+
+func (s *compressSink) flushBuffered() error {
+	s.mode = modePassthrough
+	plain := s.body.Bytes()
+
+	var compressed bytes.Buffer
+	enc, err := newEncoder(s.encoding, &compressed, s.cfg.Level)
+	if err != nil {
+		return err
+	}
+	if _, err := enc.Write(plain); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	h := s.headers
+	body := plain
+	if compressed.Len() < len(plain) {
+		h.Override("Content-Encoding", s.encoding)
+		h.Override("Content-Length", fmt.Sprintf("%d", compressed.Len()))
+		weakenETag(h)
+		body = compressed.Bytes()
+	}
+
+	if err := s.next.WriteHeaders(h); err != nil {
+		return err
+	}
+	_, err = s.next.WriteBody(body)
+	return err
+}
+
+func (s *compressSink) compressible(h headers.Headers) bool {
+	switch {
+	case s.statusCode < 200,
+		s.statusCode == 204,
+		s.statusCode == 206,
+		s.statusCode == 304:
+		return false
+	}
+
+	if encoding, ok := h.Get("Content-Encoding"); ok && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	if _, ok := h.Get("Content-Range"); ok {
+		return false
+	}
+	if noTransform(h) {
+		return false
+	}
+
+	contentType, _ := h.Get("Content-Type")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, prefix := range s.cfg.SkipContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// noTransform reports whether Cache-Control forbids changing the content
+// coding.
+func noTransform(h headers.Headers) bool {
+	cacheControl, ok := h.Get("Cache-Control")
+	return ok && strings.Contains(strings.ToLower(cacheControl), "no-transform")
+}
+
+func newEncoder(encoding string, w io.Writer, level int) (encoder, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriterLevel(w, level)
+	case EncodingDeflate:
+		// The "deflate" content coding is the zlib format (RFC 1950), not
+		// a raw deflate stream.
+		return zlib.NewWriterLevel(w, level)
+	default:
+		return nil, fmt.Errorf("unsupported content coding: %s", encoding)
+	}
+}
+
+func addVary(h headers.Headers) {
+	vary, ok := h.Get("Vary")
+	if ok {
+		for _, field := range strings.Split(vary, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	h.Set("Vary", "Accept-Encoding")
+}
+
+// weakenETag marks a strong validator as weak, since the encoded
+// representation is no longer byte-for-byte what the handler tagged.
+func weakenETag(h headers.Headers) {
+	etag, ok := h.Get("ETag")
+	if ok && !strings.HasPrefix(etag, "W/") {
+		h.Override("ETag", "W/"+etag)
+	}
+}
@@ -0,0 +1,244 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	assert.Equal(t, "gzip", negotiateEncoding("gzip, deflate, br"))
+	assert.Equal(t, "deflate", negotiateEncoding("gzip;q=0.5, deflate"))
+	assert.Equal(t, "gzip", negotiateEncoding("br, gzip;q=0.8"))
+	assert.Equal(t, "gzip", negotiateEncoding("*"))
+	assert.Equal(t, "deflate", negotiateEncoding("gzip;q=0, *;q=0.3"))
+	assert.Equal(t, "gzip", negotiateEncoding("x-gzip"))
+	assert.Equal(t, "", negotiateEncoding("br"))
+	assert.Equal(t, "", negotiateEncoding(""))
+	assert.Equal(t, "", negotiateEncoding("identity, *;q=0"))
+}
+
+func TestMiddleware(t *testing.T) {
+	body := strings.Repeat("<p>Your request was an absolute banger.</p>\n", 50)
+	fixedHandler := func(contentType string) server.Handler {
+		return func(w *response.Writer, _ *request.Request) {
+			w.WriteStatusLine(response.StatusCodeOK)
+			h := response.GetDefaultHeaders(len(body))
+			h.Override("Content-Type", contentType)
+			w.WriteHeaders(h)
+			w.WriteBody([]byte(body[:100]))
+			w.WriteBody([]byte(body[100:]))
+		}
+	}
+
+	// Test: Content-Length body is gzipped and the length fixed up
+	h, raw := serve(t, Middleware(fixedHandler("text/html")), "GET", "gzip, deflate")
+	assert.Equal(t, "gzip", h["content-encoding"])
+	assert.Equal(t, "Accept-Encoding", h["vary"])
+	assert.Equal(t, strconv.Itoa(len(raw)), h["content-length"])
+	assert.Equal(t, body, gunzip(t, raw))
+
+	// Test: deflate uses the zlib format
+	h, raw = serve(t, Middleware(fixedHandler("text/html")), "GET", "deflate")
+	assert.Equal(t, "deflate", h["content-encoding"])
+	zr, err := zlib.NewReader(bytes.NewReader(raw))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(plain))
+
+	// Test: Client without Accept-Encoding still gets Vary
+	h, raw = serve(t, Middleware(fixedHandler("text/html")), "GET", "")
+	assert.NotContains(t, h, "content-encoding")
+	assert.Equal(t, "Accept-Encoding", h["vary"])
+	assert.Equal(t, body, string(raw))
+
+	// Test: Already compressed content types are skipped
+	h, raw = serve(t, Middleware(fixedHandler("video/mp4")), "GET", "gzip")
+	assert.NotContains(t, h, "content-encoding")
+	assert.NotContains(t, h, "vary")
+	assert.Equal(t, body, string(raw))
+
+	// Test: Bodies over MaxSize pass through unencoded
+	h, raw = serve(t, NewMiddleware(Config{MaxSize: len(body) - 1})(fixedHandler("text/html")), "GET", "gzip")
+	assert.NotContains(t, h, "content-encoding")
+	assert.Equal(t, "Accept-Encoding", h["vary"])
+	assert.Equal(t, strconv.Itoa(len(body)), h["content-length"])
+	assert.Equal(t, body, string(raw))
+
+	// Test: HEAD requests are left alone
+	h, _ = serve(t, Middleware(fixedHandler("text/html")), "HEAD", "gzip")
+	assert.NotContains(t, h, "content-encoding")
+	assert.Equal(t, strconv.Itoa(len(body)), h["content-length"])
+
+	// Test: 304 responses carry the Vary of the response they stand in for
+	notModifiedHandler := func(w *response.Writer, _ *request.Request) {
+		w.WriteStatusLine(response.StatusCodeNotModified)
+		h := headers.NewHeaders()
+		h.Set("ETag", `"v1"`)
+		w.WriteHeaders(h)
+	}
+	h, raw = serve(t, Middleware(notModifiedHandler), "GET", "gzip")
+	assert.Equal(t, "Accept-Encoding", h["vary"])
+	assert.Equal(t, `"v1"`, h["etag"])
+	assert.NotContains(t, h, "content-encoding")
+	assert.Empty(t, raw)
+
+	// Test: Chunked bodies are streamed and trailers pass through
+	chunkedHandler := func(w *response.Writer, _ *request.Request) {
+		w.WriteStatusLine(response.StatusCodeOK)
+		h := response.GetDefaultHeaders(0)
+		h.Remove("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Content-Length")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte(body[:500]))
+		w.WriteChunkedBody([]byte(body[500:]))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Content-Length", strconv.Itoa(len(body)))
+		w.WriteTrailers(trailers)
+	}
+	h, raw = serve(t, Middleware(chunkedHandler), "GET", "gzip")
+	assert.Equal(t, "gzip", h["content-encoding"])
+	assert.NotContains(t, h, "content-length")
+	decoded, trailers := dechunk(t, raw)
+	assert.Equal(t, body, gunzip(t, decoded))
+	assert.Equal(t, strconv.Itoa(len(body)), trailers["x-content-length"])
+}
+
+func serve(t *testing.T, handler server.Handler, method, acceptEncoding string) (headers.Headers, []byte) {
+	raw := method + " / HTTP/1.1\r\nHost: localhost\r\n"
+	if acceptEncoding != "" {
+		raw += "Accept-Encoding: " + acceptEncoding + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	handler(response.NewWriter(buf), req)
+
+	head, body, ok := bytes.Cut(buf.Bytes(), []byte("\r\n\r\n"))
+	require.True(t, ok)
+	h := headers.NewHeaders()
+	_, rest, _ := bytes.Cut(head, []byte("\r\n"))
+	for _, line := range strings.Split(string(rest), "\r\n") {
+		k, v, _ := strings.Cut(line, ": ")
+		h[k] = v
+	}
+	return h, body
+}
+
+func dechunk(t *testing.T, raw []byte) ([]byte, headers.Headers) {
+	r := bufio.NewReader(bytes.NewReader(raw))
+	var body []byte
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		require.NoError(t, err)
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(r, chunk)
+		require.NoError(t, err)
+		body = append(body, chunk[:size]...)
+	}
+
+	trailers := headers.NewHeaders()
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return body, trailers
+		}
+		k, v, _ := strings.Cut(line, ": ")
+		trailers[k] = v
+	}
+}
+
+func gunzip(t *testing.T, p []byte) string {
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	return string(plain)
+}
+
+func TestDecompressRequests(t *testing.T) {
+	var got *request.Request
+	echo := func(w *response.Writer, req *request.Request) {
+		got = req
+		w.WriteStatusLine(response.StatusCodeOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(req.Body)))
+		w.WriteBody(req.Body)
+	}
+	payload := `{"hello": "world"}`
+
+	post := func(mw server.Middleware, contentEncoding string, body []byte) string {
+		got = nil
+		raw := "POST /upload HTTP/1.1\r\nHost: localhost\r\n" +
+			"Content-Encoding: " + contentEncoding + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + string(body)
+		req, err := request.RequestFromReader(strings.NewReader(raw))
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		mw(echo)(response.NewWriter(buf), req)
+		return buf.String()
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(payload))
+	zw.Close()
+
+	// Test: gzip body is decoded and headers updated
+	out := post(DecompressRequests(0), "gzip", gz.Bytes())
+	require.NotNil(t, got)
+	assert.Equal(t, payload, string(got.Body))
+	assert.NotContains(t, got.Headers, "content-encoding")
+	assert.Equal(t, strconv.Itoa(len(payload)), got.Headers["content-length"])
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK"))
+
+	// Test: deflate body is decoded
+	var zl bytes.Buffer
+	zlw := zlib.NewWriter(&zl)
+	zlw.Write([]byte(payload))
+	zlw.Close()
+	post(DecompressRequests(0), "deflate", zl.Bytes())
+	require.NotNil(t, got)
+	assert.Equal(t, payload, string(got.Body))
+
+	// Test: Unsupported coding is rejected with 415
+	out = post(DecompressRequests(0), "br", []byte("whatever"))
+	assert.Nil(t, got)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 415 Unsupported Media Type"))
+	assert.Contains(t, out, "accept-encoding: gzip, deflate")
+
+	// Test: Bodies that expand past the limit are rejected with 413
+	var bomb bytes.Buffer
+	zw = gzip.NewWriter(&bomb)
+	zw.Write(bytes.Repeat([]byte{0}, 1<<20))
+	zw.Close()
+	out = post(DecompressRequests(1024), "gzip", bomb.Bytes())
+	assert.Nil(t, got)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large"))
+
+	// Test: Corrupt data is a bad request
+	out = post(DecompressRequests(0), "gzip", []byte("not gzip at all"))
+	assert.Nil(t, got)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request"))
+}
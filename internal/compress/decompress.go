@@ -0,0 +1,109 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"io"
+	"strings"
+)
+
+// DefaultMaxDecompressedSize bounds decoded request bodies when
+// DecompressRequests is given a non-positive limit.
+const DefaultMaxDecompressedSize = 10 << 20
+
+var (
+	errUnsupportedCoding = errors.New("unsupported content coding")
+	errTooLarge          = errors.New("decompressed body exceeds limit")
+)
+
+// DecompressRequests returns a middleware that decodes gzip and deflate
+// request bodies before the handler sees them. Bodies that decode to more
+// than maxSize bytes are rejected with 413 so a small upload cannot expand
+// into a zip bomb, and unknown codings are rejected with 415.
+func DecompressRequests(maxSize int64) server.Middleware {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDecompressedSize
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			contentEncoding, ok := req.Headers.Get("Content-Encoding")
+			if !ok {
+				next(w, req)
+				return
+			}
+
+			body, err := decodeBody(req.Body, contentEncoding, maxSize)
+			switch {
+			case errors.Is(err, errUnsupportedCoding):
+				writeError(w, response.StatusCodeUnsupportedMediaType, err.Error())
+				return
+			case errors.Is(err, errTooLarge):
+				writeError(w, response.StatusCodeContentTooLarge, err.Error())
+				return
+			case err != nil:
+				writeError(w, response.StatusCodeBadRequest, fmt.Sprintf("Error decoding request body: %v", err))
+				return
+			}
+
+			req.Body = body
+			req.Headers.Remove("Content-Encoding")
+			req.Headers.Override("Content-Length", fmt.Sprintf("%d", len(body)))
+			next(w, req)
+		}
+	}
+}
+
+// decodeBody undoes the codings listed in a Content-Encoding value. Codings
+// are listed in the order they were applied, so they are removed in reverse.
+func decodeBody(body []byte, contentEncoding string, maxSize int64) ([]byte, error) {
+	codings := strings.Split(contentEncoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+
+		var r io.ReadCloser
+		var err error
+		switch coding {
+		case "", "identity":
+			continue
+		case EncodingGzip, "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case EncodingDeflate:
+			r, err = zlib.NewReader(bytes.NewReader(body))
+		default:
+			return nil, fmt.Errorf("%w: %s", errUnsupportedCoding, coding)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		body, err = io.ReadAll(io.LimitReader(r, maxSize+1))
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > maxSize {
+			return nil, fmt.Errorf("%w of %d bytes", errTooLarge, maxSize)
+		}
+	}
+	return body, nil
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, message string) {
+	w.WriteStatusLine(statusCode)
+	body := []byte(message)
+	h := response.GetDefaultHeaders(len(body))
+	if statusCode == response.StatusCodeUnsupportedMediaType {
+		// Tell the client which codings it may use instead (RFC 9110
+		// section 15.5.16).
+		h.Set("Accept-Encoding", "gzip, deflate")
+	}
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
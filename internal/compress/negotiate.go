@@ -0,0 +1,70 @@
+package compress
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+// supportedEncodings is ordered by preference for when a client gives
+// several codings the same weight. Brotli is not supported, so a client
+// that prefers br falls back to one of these.
+var supportedEncodings = []string{EncodingGzip, EncodingDeflate}
+
+// negotiateEncoding picks the content coding to use for a response given
+// the value of the request's Accept-Encoding header. It returns an empty
+// string when the body should be sent unencoded.
+func negotiateEncoding(acceptEncoding string) string {
+	weights := map[string]float64{}
+	wildcard := -1.0
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				q = 0
+				break
+			}
+			q = parsed
+		}
+
+		if coding == "*" {
+			wildcard = q
+			continue
+		}
+		// x-gzip is an alias for gzip (RFC 9110 section 8.4.1.3)
+		if coding == "x-gzip" {
+			coding = EncodingGzip
+		}
+		weights[coding] = q
+	}
+
+	best := ""
+	bestWeight := 0.0
+	for _, coding := range supportedEncodings {
+		q, ok := weights[coding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestWeight {
+			best = coding
+			bestWeight = q
+		}
+	}
+	return best
+}
@@ -0,0 +1,146 @@
+package conditional
+
+import (
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"strings"
+	"time"
+)
+
+// notModifiedHeaders are the fields a 304 response must repeat from the
+// 200 response it stands in for (RFC 9110 section 15.4.5).
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+}
+
+// SetValidators adds ETag and Last-Modified headers to h. Empty or zero
+// values are left out.
+func SetValidators(h headers.Headers, etag string, lastModified time.Time) {
+	if etag != "" {
+		h.Override("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		h.Override("Last-Modified", headers.FormatDate(lastModified))
+	}
+}
+
+// Evaluate checks the request's preconditions against the validators in h,
+// the headers of the response that would otherwise be sent. It returns
+// StatusCodeOK when the request should proceed, or the status code to
+// answer with instead.
+//
+// Preconditions are evaluated in the order given by RFC 9110 section
+// 13.2.2: If-Match, then If-Unmodified-Since, then If-None-Match, then
+// If-Modified-Since.
+func Evaluate(req *request.Request, h headers.Headers) response.StatusCode {
+	etag, hasETag := h.Get("ETag")
+	lastModified := lastModifiedTime(h)
+	method := req.RequestLine.Method
+	safe := method == "GET" || method == "HEAD"
+
+	if ifMatch, ok := req.Headers.Get("If-Match"); ok {
+		if !matchesAny(ifMatch, etag, hasETag, strongMatch) {
+			return response.StatusCodePreconditionFailed
+		}
+	} else if since, ok := dateHeader(req, "If-Unmodified-Since"); ok && !lastModified.IsZero() {
+		if lastModified.After(since) {
+			return response.StatusCodePreconditionFailed
+		}
+	}
+
+	if ifNoneMatch, ok := req.Headers.Get("If-None-Match"); ok {
+		if matchesAny(ifNoneMatch, etag, hasETag, weakMatch) {
+			if safe {
+				return response.StatusCodeNotModified
+			}
+			return response.StatusCodePreconditionFailed
+		}
+	} else if since, ok := dateHeader(req, "If-Modified-Since"); ok && safe && !lastModified.IsZero() {
+		if !lastModified.After(since) {
+			return response.StatusCodeNotModified
+		}
+	}
+
+	return response.StatusCodeOK
+}
+
+// Check evaluates the request's preconditions against the validators in h.
+// When the request can be answered with 304 Not Modified, or must fail with
+// 412 Precondition Failed, Check writes that response through w and
+// returns true; the caller should then stop handling the request.
+func Check(w *response.Writer, req *request.Request, h headers.Headers) bool {
+	statusCode := Evaluate(req, h)
+	switch statusCode {
+	case response.StatusCodeNotModified:
+		w.WriteStatusLine(statusCode)
+		notModified := headers.NewHeaders()
+		for _, name := range notModifiedHeaders {
+			if value, ok := h.Get(name); ok {
+				notModified.Override(name, value)
+			}
+		}
+		notModified.Set("Connection", "close")
+		w.WriteHeaders(notModified)
+		return true
+	case response.StatusCodePreconditionFailed:
+		w.WriteStatusLine(statusCode)
+		body := []byte("Precondition failed")
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		if req.RequestLine.Method != "HEAD" {
+			w.WriteBody(body)
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// matchesAny reports whether the entity tag list in value matches the
+// current tag using compare. "*" matches any current representation.
+func matchesAny(value, etag string, hasETag bool, compare func(a, b string) bool) bool {
+	if strings.TrimSpace(value) == "*" {
+		return true
+	}
+	if !hasETag {
+		return false
+	}
+	for _, candidate := range parseETags(value) {
+		if compare(candidate, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// dateHeader returns the parsed value of a date precondition. Invalid
+// dates are ignored, as RFC 9110 requires.
+func dateHeader(req *request.Request, name string) (time.Time, bool) {
+	value, ok := req.Headers.Get(name)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := headers.ParseDate(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func lastModifiedTime(h headers.Headers) time.Time {
+	value, ok := h.Get("Last-Modified")
+	if !ok {
+		return time.Time{}
+	}
+	t, err := headers.ParseDate(value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,104 @@
+package conditional
+
+import (
+	"bytes"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseETags(t *testing.T) {
+	assert.Equal(t, []string{`"a"`, `W/"b"`, `"c,d"`}, parseETags(`"a", W/"b",  "c,d"`))
+	assert.Equal(t, []string{`"a"`}, parseETags(`bogus, "a"`))
+	assert.Empty(t, parseETags(`"unterminated`))
+	assert.Empty(t, parseETags(""))
+}
+
+func TestEvaluate(t *testing.T) {
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	validators := headers.NewHeaders()
+	SetValidators(validators, `"v1"`, lastModified)
+
+	evaluate := func(method string, headerLines ...string) response.StatusCode {
+		return Evaluate(newRequest(t, method, headerLines...), validators)
+	}
+
+	// Test: No preconditions
+	assert.Equal(t, response.StatusCodeOK, evaluate("GET"))
+
+	// Test: If-None-Match uses weak comparison
+	assert.Equal(t, response.StatusCodeNotModified, evaluate("GET", `If-None-Match: "v0", W/"v1"`))
+	assert.Equal(t, response.StatusCodeOK, evaluate("GET", `If-None-Match: "v0"`))
+	assert.Equal(t, response.StatusCodeNotModified, evaluate("HEAD", "If-None-Match: *"))
+
+	// Test: If-None-Match on an unsafe method fails the precondition
+	assert.Equal(t, response.StatusCodePreconditionFailed, evaluate("PUT", `If-None-Match: "v1"`))
+
+	// Test: If-Match uses strong comparison
+	assert.Equal(t, response.StatusCodeOK, evaluate("PUT", `If-Match: "v1"`))
+	assert.Equal(t, response.StatusCodePreconditionFailed, evaluate("PUT", `If-Match: W/"v1"`))
+	assert.Equal(t, response.StatusCodeOK, evaluate("PUT", "If-Match: *"))
+
+	// Test: If-Modified-Since
+	assert.Equal(t, response.StatusCodeNotModified, evaluate("GET", "If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT"))
+	assert.Equal(t, response.StatusCodeOK, evaluate("GET", "If-Modified-Since: Tue, 30 Apr 2024 12:00:00 GMT"))
+	assert.Equal(t, response.StatusCodeOK, evaluate("POST", "If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT"))
+	assert.Equal(t, response.StatusCodeOK, evaluate("GET", "If-Modified-Since: garbage"))
+
+	// Test: If-None-Match takes precedence over If-Modified-Since
+	assert.Equal(t, response.StatusCodeOK, evaluate("GET", `If-None-Match: "v0"`, "If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT"))
+
+	// Test: If-Unmodified-Since
+	assert.Equal(t, response.StatusCodePreconditionFailed, evaluate("PUT", "If-Unmodified-Since: Tue, 30 Apr 2024 12:00:00 GMT"))
+	assert.Equal(t, response.StatusCodeOK, evaluate("PUT", "If-Unmodified-Since: Wed, 01 May 2024 12:00:00 GMT"))
+
+	// Test: If-Match takes precedence over If-Unmodified-Since
+	assert.Equal(t, response.StatusCodeOK, evaluate("PUT", `If-Match: "v1"`, "If-Unmodified-Since: Tue, 30 Apr 2024 12:00:00 GMT"))
+
+	// Test: If-Match is checked before If-None-Match
+	assert.Equal(t, response.StatusCodePreconditionFailed, evaluate("GET", `If-Match: "v0"`, `If-None-Match: "v1"`))
+}
+
+func TestCheck(t *testing.T) {
+	h := response.GetDefaultHeaders(5)
+	SetValidators(h, StrongETag([]byte("hello")), time.Time{})
+	h.Set("Vary", "Accept-Encoding")
+
+	// Test: 304 repeats validators and has no body
+	buf := &bytes.Buffer{}
+	done := Check(response.NewWriter(buf), newRequest(t, "GET", "If-None-Match: "+StrongETag([]byte("hello"))), h)
+	assert.True(t, done)
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.Contains(t, out, "etag: "+StrongETag([]byte("hello"))+"\r\n")
+	assert.Contains(t, out, "vary: Accept-Encoding\r\n")
+	assert.NotContains(t, out, "content-length")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	// Test: 412 is written for a failed If-Match
+	buf.Reset()
+	done = Check(response.NewWriter(buf), newRequest(t, "DELETE", `If-Match: "other"`), h)
+	assert.True(t, done)
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 412 Precondition Failed\r\n"))
+
+	// Test: Nothing is written when the request should proceed
+	buf.Reset()
+	done = Check(response.NewWriter(buf), newRequest(t, "GET"), h)
+	assert.False(t, done)
+	assert.Zero(t, buf.Len())
+}
+
+func newRequest(t *testing.T, method string, headerLines ...string) *request.Request {
+	raw := method + " / HTTP/1.1\r\nHost: localhost\r\n"
+	for _, line := range headerLines {
+		raw += line + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
@@ -0,0 +1,83 @@
+package conditional
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StrongETag derives a strong entity tag from the exact bytes of a
+// representation.
+func StrongETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// WeakETag derives a weak entity tag from a representation, for content
+// that is semantically but not byte-for-byte stable.
+func WeakETag(body []byte) string {
+	return "W/" + StrongETag(body)
+}
+
+// FileETag builds an entity tag from a file's size and modification time,
+// so a file can be tagged without reading it.
+func FileETag(size int64, modTime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size)
+}
+
+func isWeak(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+func opaqueTag(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
+
+// strongMatch implements the strong comparison function of RFC 9110
+// section 8.8.3.2: both tags must be strong and identical.
+func strongMatch(a, b string) bool {
+	return !isWeak(a) && !isWeak(b) && a == b
+}
+
+// weakMatch implements the weak comparison function, which ignores the
+// weakness indicator.
+func weakMatch(a, b string) bool {
+	return opaqueTag(a) == opaqueTag(b)
+}
+
+// parseETags splits an If-Match or If-None-Match value into its entity
+// tags. Tags may contain commas, so the value is split outside of quotes
+// only. Malformed members are skipped.
+func parseETags(value string) []string {
+	var etags []string
+	for {
+		value = strings.TrimLeft(value, " \t,")
+		if value == "" {
+			return etags
+		}
+
+		start := 0
+		if strings.HasPrefix(value, "W/") {
+			start = 2
+		}
+		if len(value) <= start || value[start] != '"' {
+			// Skip to the next member.
+			_, rest, ok := strings.Cut(value, ",")
+			if !ok {
+				return etags
+			}
+			value = rest
+			continue
+		}
+
+		end := strings.IndexByte(value[start+1:], '"')
+		if end == -1 {
+			return etags
+		}
+		end += start + 2
+		etags = append(etags, value[:end])
+		value = value[end:]
+	}
+}
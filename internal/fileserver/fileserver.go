@@ -0,0 +1,348 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/conditional"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const copyBufferSize = 32 * 1024
+
+type Config struct {
+	// Root is the directory files are served from. Requests can never
+	// reach outside of it, including through symlinks.
+	Root string
+	// StripPrefix is removed from the request path before it is resolved
+	// against Root, so a handler mounted at /assets/ can serve Root/x for
+	// /assets/x.
+	StripPrefix string
+	// IndexFile is served for directory requests. Defaults to index.html.
+	IndexFile string
+	// ListDirectories renders an HTML listing for directories without an
+	// index file. When false such requests get 403.
+	ListDirectories bool
+}
+
+// New returns a handler that serves the files under cfg.Root.
+func New(cfg Config) server.Handler {
+	if cfg.IndexFile == "" {
+		cfg.IndexFile = "index.html"
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		serve(w, req, cfg)
+	}
+}
+
+// ServeFile responds with the contents of the named file. The name is used
+// as is, so it must not come from the request.
+func ServeFile(w *response.Writer, req *request.Request, name string) {
+	if !checkMethod(w, req) {
+		return
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+	if info.IsDir() {
+		writeError(w, response.StatusCodeNotFound, "Not found", nil)
+		return
+	}
+
+	serveContent(w, req, info.Name(), f, info.Size(), info.ModTime())
+}
+
+func serve(w *response.Writer, req *request.Request, cfg Config) {
+	if !checkMethod(w, req) {
+		return
+	}
+
+	rawPath, query, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	urlPath, ok := resolvePath(rawPath, cfg.StripPrefix)
+	if !ok {
+		writeError(w, response.StatusCodeNotFound, "Not found", nil)
+		return
+	}
+
+	root, err := os.OpenRoot(cfg.Root)
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+	defer root.Close()
+
+	name := strings.TrimPrefix(path.Clean(urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+
+	f, err := root.Open(name)
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+
+	if !info.IsDir() {
+		serveContent(w, req, info.Name(), f, info.Size(), info.ModTime())
+		return
+	}
+
+	// Relative links in an index page or listing only resolve correctly
+	// when the directory URL ends in a slash.
+	if !strings.HasSuffix(urlPath, "/") {
+		location := rawPath + "/"
+		if query != "" {
+			location += "?" + query
+		}
+		redirect(w, location)
+		return
+	}
+
+	index, err := root.Open(path.Join(name, cfg.IndexFile))
+	if err == nil {
+		defer index.Close()
+		indexInfo, err := index.Stat()
+		if err == nil && !indexInfo.IsDir() {
+			serveContent(w, req, indexInfo.Name(), index, indexInfo.Size(), indexInfo.ModTime())
+			return
+		}
+	}
+
+	if !cfg.ListDirectories {
+		writeError(w, response.StatusCodeForbidden, "Directory listing is disabled", nil)
+		return
+	}
+	listDirectory(w, req, f, rawPath)
+}
+
+// resolvePath decodes the path of a request target and removes prefix from
+// it. The result always starts with a slash.
+func resolvePath(rawPath, prefix string) (string, bool) {
+	urlPath, err := url.PathUnescape(rawPath)
+	if err != nil || !strings.HasPrefix(urlPath, "/") || strings.ContainsRune(urlPath, 0) {
+		return "", false
+	}
+
+	if prefix != "" {
+		// The prefix must end at a segment boundary, so "/assets" covers
+		// "/assets" and "/assets/x" but not "/assetsx".
+		rest, ok := strings.CutPrefix(urlPath, strings.TrimSuffix(prefix, "/"))
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			return "", false
+		}
+		urlPath = rest
+		if urlPath == "" {
+			urlPath = "/"
+		}
+	}
+	return urlPath, true
+}
+
+func serveContent(w *response.Writer, req *request.Request, name string, content io.ReadSeeker, size int64, modTime time.Time) {
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		head := make([]byte, sniffLen)
+		n, _ := io.ReadFull(content, head)
+		contentType = detectContentType(head[:n])
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			writeError(w, response.StatusCodeInternalServerError, "Error reading file", nil)
+			return
+		}
+	}
+
+	h := response.GetDefaultHeaders(int(size))
+	h.Override("Content-Type", contentType)
+	h.Set("Accept-Ranges", "bytes")
+	conditional.SetValidators(h, conditional.FileETag(size, modTime), modTime)
+	if conditional.Check(w, req, h) {
+		return
+	}
+
+	ranges, err := requestedRanges(req, h, size)
+	if err != nil {
+		extra := headers.NewHeaders()
+		extra.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeError(w, response.StatusCodeRangeNotSatisfiable, "Requested range not satisfiable", extra)
+		return
+	}
+
+	switch len(ranges) {
+	case 0:
+		w.WriteStatusLine(response.StatusCodeOK)
+		w.WriteHeaders(h)
+		if req.RequestLine.Method == "HEAD" {
+			return
+		}
+		io.CopyBuffer(bodyWriter{w}, content, make([]byte, copyBufferSize))
+	case 1:
+		r := ranges[0]
+		w.WriteStatusLine(response.StatusCodePartialContent)
+		h.Override("Content-Length", fmt.Sprintf("%d", r.length))
+		h.Set("Content-Range", r.contentRange(size))
+		w.WriteHeaders(h)
+		if req.RequestLine.Method == "HEAD" {
+			return
+		}
+		copyRange(w, content, r)
+	default:
+		boundary := newBoundary()
+		parts, closing := multipartHeaders(ranges, contentType, size, boundary)
+		contentLength := int64(len(closing))
+		for i, r := range ranges {
+			contentLength += int64(len(parts[i])) + r.length
+		}
+
+		w.WriteStatusLine(response.StatusCodePartialContent)
+		h.Override("Content-Length", fmt.Sprintf("%d", contentLength))
+		h.Override("Content-Type", "multipart/byteranges; boundary="+boundary)
+		w.WriteHeaders(h)
+		if req.RequestLine.Method == "HEAD" {
+			return
+		}
+		for i, r := range ranges {
+			if _, err := w.WriteBody([]byte(parts[i])); err != nil {
+				return
+			}
+			if err := copyRange(w, content, r); err != nil {
+				return
+			}
+		}
+		w.WriteBody([]byte(closing))
+	}
+}
+
+func copyRange(w *response.Writer, content io.ReadSeeker, r byteRange) error {
+	if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyBuffer(bodyWriter{w}, io.LimitReader(content, r.length), make([]byte, copyBufferSize))
+	return err
+}
+
+func listDirectory(w *response.Writer, req *request.Request, dir *os.File, rawPath string) {
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		writeError(w, response.StatusCodeInternalServerError, "Error reading directory", nil)
+		return
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	title := html.EscapeString(rawPath)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<html>
+  <head>
+    <title>Index of %s</title>
+  </head>
+  <body>
+    <h1>Index of %s</h1>
+    <ul>
+`, title, title)
+	if rawPath != "/" {
+		b.WriteString("      <li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&b, "      <li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString(`    </ul>
+  </body>
+</html>`)
+
+	body := []byte(b.String())
+	w.WriteStatusLine(response.StatusCodeOK)
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeaders(h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(body)
+	}
+}
+
+func checkMethod(w *response.Writer, req *request.Request) bool {
+	method := req.RequestLine.Method
+	if method == "GET" || method == "HEAD" {
+		return true
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Allow", "GET, HEAD")
+	writeError(w, response.StatusCodeMethodNotAllowed, "Method not allowed", h)
+	return false
+}
+
+func redirect(w *response.Writer, location string) {
+	h := headers.NewHeaders()
+	h.Set("Location", location)
+	writeError(w, response.StatusCodeMovedPermanently, "Moved permanently", h)
+}
+
+func writeOpenError(w *response.Writer, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		writeError(w, response.StatusCodeNotFound, "Not found", nil)
+	case errors.Is(err, fs.ErrPermission):
+		writeError(w, response.StatusCodeForbidden, "Forbidden", nil)
+	default:
+		// Anything else, such as a path os.Root refuses because it leads
+		// outside the root, is treated as missing.
+		writeError(w, response.StatusCodeNotFound, "Not found", nil)
+	}
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, message string, extra headers.Headers) {
+	w.WriteStatusLine(statusCode)
+	body := []byte(message)
+	h := response.GetDefaultHeaders(len(body))
+	for k, v := range extra {
+		h.Override(k, v)
+	}
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// bodyWriter adapts a response.Writer to io.Writer so file contents can be
+// streamed with io.Copy.
+type bodyWriter struct {
+	w *response.Writer
+}
+
+func (bw bodyWriter) Write(p []byte) (int, error) {
+	return bw.w.WriteBody(p)
+}
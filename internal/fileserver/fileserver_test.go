@@ -0,0 +1,238 @@
+package fileserver
+
+import (
+	"bytes"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectContentType(t *testing.T) {
+	assert.Equal(t, "image/png", detectContentType([]byte("\x89PNG\r\n\x1a\n....")))
+	assert.Equal(t, "video/mp4", detectContentType([]byte("\x00\x00\x00\x18ftypmp42")))
+	assert.Equal(t, "text/html; charset=utf-8", detectContentType([]byte("  <!DOCTYPE html><html></html>")))
+	assert.Equal(t, "text/plain; charset=utf-8", detectContentType([]byte("hello, world\n")))
+	assert.Equal(t, "text/plain; charset=utf-8", detectContentType([]byte("caf\xc3")))
+	assert.Equal(t, "application/octet-stream", detectContentType([]byte{0x00, 0x01, 0x02, 0xff}))
+}
+
+func TestFileServer(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello world"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "noext"), []byte("<html><body>hi</body></html>"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "site"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "site", "index.html"), []byte("<h1>site</h1>"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "files"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "files", "a <b>.txt"), []byte("a"), 0o644))
+
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "link")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling")))
+	require.NoError(t, os.Symlink("../"+filepath.Base(outside), filepath.Join(root, "up")))
+
+	handler := New(Config{Root: root, StripPrefix: "/static", ListDirectories: true})
+
+	// Test: Regular file with MIME type from its extension
+	out := doRequest(t, handler, "GET", "/static/hello.txt")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, out, "content-length: 11\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello world"))
+
+	// Test: MIME type sniffed when there is no extension
+	out = doRequest(t, handler, "GET", "/static/noext")
+	assert.Contains(t, out, "content-type: text/html; charset=utf-8\r\n")
+
+	// Test: HEAD sends headers only
+	out = doRequest(t, handler, "HEAD", "/static/hello.txt")
+	assert.Contains(t, out, "content-length: 11\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	// Test: Index file served for a directory
+	out = doRequest(t, handler, "GET", "/static/site/")
+	assert.True(t, strings.HasSuffix(out, "<h1>site</h1>"))
+
+	// Test: Directory without trailing slash is redirected
+	out = doRequest(t, handler, "GET", "/static/site?x=1")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 301 Moved Permanently\r\n"))
+	assert.Contains(t, out, "location: /static/site/?x=1\r\n")
+
+	// Test: Directory listing escapes names
+	out = doRequest(t, handler, "GET", "/static/files/")
+	assert.Contains(t, out, `<a href="a%20%3Cb%3E.txt">a &lt;b&gt;.txt</a>`)
+	assert.Contains(t, out, `<a href="../">../</a>`)
+
+	// Test: Listing disabled
+	out = doRequest(t, New(Config{Root: root}), "GET", "/files/")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+
+	// Test: Path traversal stays inside the root
+	out = doRequest(t, handler, "GET", "/static/../../../../etc/passwd")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	out = doRequest(t, handler, "GET", "/static/%2e%2e/%2e%2e/etc/passwd")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Symlinks cannot escape the root
+	out = doRequest(t, handler, "GET", "/static/link")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	assert.NotContains(t, out, "secret")
+	out = doRequest(t, handler, "GET", "/static/dangling")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	out = doRequest(t, handler, "GET", "/static/up/secret")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Request outside the prefix
+	out = doRequest(t, handler, "GET", "/other/hello.txt")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	out = doRequest(t, handler, "GET", "/statichello.txt")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	out = doRequest(t, handler, "GET", "/staticsite/index.html")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Unsupported method
+	out = doRequest(t, handler, "POST", "/static/hello.txt")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "allow: GET, HEAD\r\n")
+}
+
+func doRequest(t *testing.T, handler server.Handler, method, target string, headerLines ...string) string {
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n"
+	for _, line := range headerLines {
+		raw += line + "\r\n"
+	}
+	raw += "\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	handler(response.NewWriter(buf), req)
+	return buf.String()
+}
+
+func TestParseRange(t *testing.T) {
+	// Test: Single closed range
+	ranges, err := parseRange("bytes=0-4", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 0, length: 5}}, ranges)
+
+	// Test: Open-ended and suffix ranges
+	ranges, err = parseRange("bytes=7-, -2", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 7, length: 3}, {start: 8, length: 2}}, ranges)
+
+	// Test: End past the representation is clamped
+	ranges, err = parseRange("bytes=5-100", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 5, length: 5}}, ranges)
+
+	// Test: Unsatisfiable ranges are dropped
+	ranges, err = parseRange("bytes=20-30, 2-3", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 2, length: 2}}, ranges)
+
+	// Test: Nothing satisfiable
+	_, err = parseRange("bytes=10-", 10)
+	require.ErrorIs(t, err, errUnsatisfiable)
+
+	// Test: Invalid syntax is ignored
+	for _, value := range []string{"items=0-1", "bytes=", "bytes=a-b", "bytes=5-2", "bytes=+1-2", "bytes=1"} {
+		ranges, err = parseRange(value, 10)
+		require.NoError(t, err, value)
+		assert.Nil(t, ranges, value)
+	}
+
+	// Test: Overlapping ranges adding up to more than the file
+	ranges, err = parseRange("bytes=0-8, 1-9", 10)
+	require.NoError(t, err)
+	assert.Nil(t, ranges)
+}
+
+func TestRangeRequests(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "digits.txt")
+	require.NoError(t, os.WriteFile(name, []byte("0123456789"), 0o644))
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(name, modTime, modTime))
+	handler := New(Config{Root: root})
+
+	// Test: Full response advertises range support
+	out := doRequest(t, handler, "GET", "/digits.txt")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "accept-ranges: bytes\r\n")
+	assert.Contains(t, out, "last-modified: Wed, 01 May 2024 12:00:00 GMT\r\n")
+
+	// Test: Single range
+	out = doRequest(t, handler, "GET", "/digits.txt", "Range: bytes=2-5")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, out, "content-range: bytes 2-5/10\r\n")
+	assert.Contains(t, out, "content-length: 4\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n2345"))
+
+	// Test: Multiple ranges
+	out = doRequest(t, handler, "GET", "/digits.txt", "Range: bytes=0-1,-2")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+	head, body, _ := strings.Cut(out, "\r\n\r\n")
+	_, boundary, ok := strings.Cut(head, "content-type: multipart/byteranges; boundary=")
+	require.True(t, ok)
+	boundary, _, _ = strings.Cut(boundary, "\r\n")
+	expected := "\r\n--" + boundary + "\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 0-1/10\r\n\r\n01" +
+		"\r\n--" + boundary + "\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 8-9/10\r\n\r\n89" +
+		"\r\n--" + boundary + "--\r\n"
+	assert.Equal(t, expected, body)
+	assert.Contains(t, head, "content-length: "+strconv.Itoa(len(expected)))
+
+	// Test: Unsatisfiable range
+	out = doRequest(t, handler, "GET", "/digits.txt", "Range: bytes=50-")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 416 Range Not Satisfiable\r\n"))
+	assert.Contains(t, out, "content-range: bytes */10\r\n")
+
+	// Test: If-Range with the current date applies the range
+	out = doRequest(t, handler, "GET", "/digits.txt", "Range: bytes=0-0", "If-Range: Wed, 01 May 2024 12:00:00 GMT")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+
+	// Test: If-Range with a stale date sends the whole file
+	out = doRequest(t, handler, "GET", "/digits.txt", "Range: bytes=0-0", "If-Range: Tue, 30 Apr 2024 12:00:00 GMT")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "0123456789"))
+
+	// Test: If-Range with an entity tag that does not match
+	out = doRequest(t, handler, "GET", "/digits.txt", "Range: bytes=0-0", `If-Range: "nope"`)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+}
+
+func TestConditionalRequests(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "page.txt")
+	require.NoError(t, os.WriteFile(name, []byte("page"), 0o644))
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(name, modTime, modTime))
+	handler := New(Config{Root: root})
+
+	out := doRequest(t, handler, "GET", "/page.txt")
+	_, etag, ok := strings.Cut(out, "etag: ")
+	require.True(t, ok)
+	etag, _, _ = strings.Cut(etag, "\r\n")
+
+	// Test: Matching entity tag
+	out = doRequest(t, handler, "GET", "/page.txt", "If-None-Match: "+etag)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	// Test: Not modified since
+	out = doRequest(t, handler, "GET", "/page.txt", "If-Modified-Since: Thu, 02 May 2024 00:00:00 GMT")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+
+	// Test: If-Range with the current entity tag applies the range
+	out = doRequest(t, handler, "GET", "/page.txt", "Range: bytes=0-1", "If-Range: "+etag)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\npa"))
+}
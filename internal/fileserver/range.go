@@ -0,0 +1,178 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"strconv"
+	"strings"
+)
+
+// maxRanges caps how many ranges a single Range header may ask for.
+// Requests for more are answered with the full representation.
+const maxRanges = 64
+
+var errUnsatisfiable = errors.New("requested range not satisfiable")
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// requestedRanges returns the ranges the client asked for, or nil when the
+// full representation should be sent. h holds the validators of the
+// response so If-Range can be evaluated against them.
+func requestedRanges(req *request.Request, h headers.Headers, size int64) ([]byteRange, error) {
+	value, ok := req.Headers.Get("Range")
+	if !ok {
+		return nil, nil
+	}
+
+	if ifRange, ok := req.Headers.Get("If-Range"); ok && !ifRangeMatches(ifRange, h) {
+		return nil, nil
+	}
+
+	return parseRange(value, size)
+}
+
+// ifRangeMatches reports whether the validator in an If-Range header still
+// describes the representation, in which case the Range header applies.
+func ifRangeMatches(value string, h headers.Headers) bool {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		// If-Range requires the strong comparison function, so a weak
+		// tag on either side never matches (RFC 9110 section 13.1.5).
+		etag, ok := h.Get("ETag")
+		return ok && !strings.HasPrefix(value, "W/") && !strings.HasPrefix(etag, "W/") && value == etag
+	}
+
+	lastModified, ok := h.Get("Last-Modified")
+	if !ok {
+		return false
+	}
+	since, err := headers.ParseDate(value)
+	if err != nil {
+		return false
+	}
+	modified, err := headers.ParseDate(lastModified)
+	return err == nil && since.Equal(modified)
+}
+
+// parseRange parses a Range header value against a representation of size
+// bytes. Syntactically invalid headers are ignored, as RFC 9110 section
+// 14.2 allows, by returning nil ranges and no error. A header whose ranges
+// all fall outside the representation yields errUnsatisfiable.
+func parseRange(value string, size int64) ([]byteRange, error) {
+	unit, specs, ok := strings.Cut(value, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, nil
+	}
+
+	parts := strings.Split(specs, ",")
+	if len(parts) > maxRanges {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	sawSpec := false
+	for _, spec := range parts {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		sawSpec = true
+
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		first = strings.TrimSpace(first)
+		last = strings.TrimSpace(last)
+
+		if first == "" {
+			// A suffix range asks for the final n bytes.
+			n, ok := parseDigits(last)
+			if !ok {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+			continue
+		}
+
+		start, ok := parseDigits(first)
+		if !ok {
+			return nil, nil
+		}
+		end := size - 1
+		if last != "" {
+			lastPos, ok := parseDigits(last)
+			if !ok || lastPos < start {
+				return nil, nil
+			}
+			end = min(end, lastPos)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if !sawSpec {
+		return nil, nil
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+
+	// Asking for more bytes than the whole representation, for example
+	// through many overlapping ranges, gets the representation once.
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	if total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+func parseDigits(s string) (int64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// multipartHeaders returns the delimiter and header block written before
+// each range of a multipart/byteranges body, along with the closing
+// delimiter, so the total length can be announced up front.
+func multipartHeaders(ranges []byteRange, contentType string, size int64, boundary string) ([]string, string) {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = fmt.Sprintf("\r\n--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, contentType, r.contentRange(size))
+	}
+	return parts, fmt.Sprintf("\r\n--%s--\r\n", boundary)
+}
+
+func newBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,31 @@
+package headers
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate layout used for HTTP dates (RFC 9110
+// section 5.6.7).
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// obsolete date formats that recipients must still accept
+var dateFormats = []string{
+	TimeFormat,
+	"Monday, 02-Jan-06 15:04:05 GMT", // RFC 850
+	"Mon Jan _2 15:04:05 2006",       // ANSI C asctime()
+}
+
+func FormatDate(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+func ParseDate(value string) (time.Time, error) {
+	for _, layout := range dateFormats {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid HTTP date: %s", value)
+}
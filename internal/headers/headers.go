@@ -96,3 +96,23 @@ func isTChar(r rune) bool {
 		return false
 	}
 }
+
+// IsToken reports whether s is a token (RFC 9110 section 5.6.2), the
+// syntax of methods and header names.
+func IsToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 || !isTChar(rune(s[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidValue reports whether value can be sent as a header value without
+// ending the field early: it must not contain CR, LF or NUL.
+func ValidValue(value string) bool {
+	return !strings.ContainsAny(value, "\r\n\x00")
+}
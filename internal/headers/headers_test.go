@@ -4,6 +4,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestHeaders_Parse(t *testing.T) {
@@ -74,3 +75,45 @@ func TestHeaders_Parse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestParseDate(t *testing.T) {
+	expected := time.Date(1994, 11, 6, 8, 49, 37, 0, time.UTC)
+
+	// Test: IMF-fixdate
+	d, err := ParseDate("Sun, 06 Nov 1994 08:49:37 GMT")
+	require.NoError(t, err)
+	assert.True(t, expected.Equal(d))
+
+	// Test: Obsolete RFC 850 format
+	d, err = ParseDate("Sunday, 06-Nov-94 08:49:37 GMT")
+	require.NoError(t, err)
+	assert.True(t, expected.Equal(d))
+
+	// Test: Obsolete asctime format
+	d, err = ParseDate("Sun Nov  6 08:49:37 1994")
+	require.NoError(t, err)
+	assert.True(t, expected.Equal(d))
+
+	// Test: Invalid date
+	_, err = ParseDate("yesterday")
+	require.Error(t, err)
+
+	// Test: Formatting always uses GMT
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", FormatDate(expected.In(time.FixedZone("CET", 3600))))
+}
+
+func TestFieldSyntax(t *testing.T) {
+	// Test: Tokens
+	assert.True(t, IsToken("GET"))
+	assert.True(t, IsToken("x-custom_header.1"))
+	assert.False(t, IsToken(""))
+	assert.False(t, IsToken("x a"))
+	assert.False(t, IsToken("x:a"))
+	assert.False(t, IsToken("café"))
+
+	// Test: Values that would end the field early
+	assert.True(t, ValidValue("text/html; charset=utf-8"))
+	assert.False(t, ValidValue("v\r\nx: y"))
+	assert.False(t, ValidValue("v\nx"))
+	assert.False(t, ValidValue("v\x00"))
+}
@@ -0,0 +1,742 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/http2/hpack"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errConnClosed  = errors.New("http2: connection closed")
+	errStreamReset = errors.New("http2: stream reset")
+)
+
+// serverConn is one HTTP/2 connection. A single goroutine reads frames in
+// serve; each request's handler runs in its own goroutine and writes its
+// response through a stream.
+type serverConn struct {
+	srv     *Server
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *hpack.Decoder
+	baseCtx context.Context
+
+	// Read loop state, only touched by serve's goroutine. recvWindow is
+	// the DATA the peer may still send on the connection.
+	sawSettings  bool
+	continuation *headerBlock
+	recvWindow   int64
+
+	// writeMu serialises frames on the wire, and keeps a header block's
+	// HEADERS and CONTINUATION frames together.
+	writeMu  sync.Mutex
+	writeBuf []byte
+
+	// mu guards the fields below. cond is signalled whenever flow control
+	// windows grow or a stream or the connection is shut.
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	goingAway         bool
+	closed            bool
+
+	handlers sync.WaitGroup
+	done     chan struct{}
+}
+
+// headerBlock is a header block whose CONTINUATION frames are still
+// arriving.
+type headerBlock struct {
+	streamID  uint32
+	endStream bool
+	fragment  []byte
+}
+
+func newServerConn(s *Server, conn net.Conn, buffered []byte) *serverConn {
+	baseCtx := s.BaseContext
+	if baseCtx == nil {
+		baseCtx = context.Background()
+	}
+	sc := &serverConn{
+		srv:               s,
+		conn:              conn,
+		reader:            bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn)),
+		decoder:           hpack.NewDecoder(headerTableSize, maxHeaderListSize),
+		baseCtx:           baseCtx,
+		streams:           make(map[uint32]*stream),
+		recvWindow:        defaultWindowSize,
+		sendWindow:        defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+		done:              make(chan struct{}),
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+func (sc *serverConn) maxStreams() uint32 {
+	if sc.srv.MaxConcurrentStreams > 0 {
+		return sc.srv.MaxConcurrentStreams
+	}
+	return DefaultMaxConcurrentStreams
+}
+
+func (sc *serverConn) maxBodySize() int64 {
+	if sc.srv.MaxRequestBodySize > 0 {
+		return sc.srv.MaxRequestBodySize
+	}
+	return DefaultMaxRequestBodySize
+}
+
+func (sc *serverConn) writeServerPreface() error {
+	return sc.writeFrame(frameSettings, 0, 0, appendSettings(nil,
+		setting{settingMaxConcurrentStreams, sc.maxStreams()},
+		setting{settingMaxHeaderListSize, maxHeaderListSize},
+	))
+}
+
+func (sc *serverConn) readClientPreface() error {
+	buf := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.reader, buf); err != nil {
+		return err
+	}
+	if string(buf) != ClientPreface {
+		return errors.New("http2: invalid client preface")
+	}
+	return nil
+}
+
+// serve reads frames until the connection fails or is closed, then waits
+// for the handlers of its streams to return.
+func (sc *serverConn) serve() error {
+	defer sc.shut()
+	go sc.watchShutdown()
+
+	for {
+		f, err := readFrame(sc.reader, defaultMaxFrameSize)
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+		if err == nil {
+			continue
+		}
+
+		var se streamError
+		if errors.As(err, &se) {
+			sc.resetStream(se)
+			continue
+		}
+		var ce connError
+		if errors.As(err, &ce) {
+			sc.goAway(ce.code, ce.reason)
+			return ce
+		}
+		if sc.isClosed() || errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+}
+
+// shut closes the connection, interrupts every stream still being handled
+// and waits for their handlers to return.
+func (sc *serverConn) shut() {
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.cancel()
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	sc.conn.Close()
+	close(sc.done)
+	sc.handlers.Wait()
+}
+
+func (sc *serverConn) isClosed() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.closed
+}
+
+// watchShutdown starts a graceful close when the server shuts down, and
+// an immediate one when its base context is cancelled.
+func (sc *serverConn) watchShutdown() {
+	select {
+	case <-sc.srv.Shutdown:
+	case <-sc.baseCtx.Done():
+		sc.conn.Close()
+		return
+	case <-sc.done:
+		return
+	}
+
+	sc.mu.Lock()
+	sc.goingAway = true
+	lastStreamID := sc.lastStreamID
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	sc.writeGoAway(lastStreamID, errCodeNo, "")
+	if idle {
+		sc.conn.Close()
+	}
+
+	select {
+	case <-sc.baseCtx.Done():
+		sc.conn.Close()
+	case <-sc.done:
+	}
+}
+
+func (sc *serverConn) processFrame(f frame) error {
+	if !sc.sawSettings {
+		if f.typ != frameSettings || f.has(flagAck) {
+			return connError{errCodeProtocol, "first frame must be SETTINGS"}
+		}
+		sc.sawSettings = true
+	}
+	if sc.continuation != nil && (f.typ != frameContinuation || f.streamID != sc.continuation.streamID) {
+		return connError{errCodeProtocol, "expected CONTINUATION frame"}
+	}
+
+	switch f.typ {
+	case frameData:
+		return sc.processData(f)
+	case frameHeaders:
+		return sc.processHeaders(f)
+	case framePriority:
+		if f.streamID == 0 {
+			return connError{errCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.payload) != 5 {
+			return streamError{f.streamID, errCodeFrameSize, "PRIORITY payload must be 5 bytes"}
+		}
+		return nil
+	case frameRSTStream:
+		return sc.processRSTStream(f)
+	case frameSettings:
+		return sc.processSettings(f)
+	case framePushPromise:
+		return connError{errCodeProtocol, "clients cannot push"}
+	case framePing:
+		if f.streamID != 0 {
+			return connError{errCodeProtocol, "PING on a stream"}
+		}
+		if len(f.payload) != 8 {
+			return connError{errCodeFrameSize, "PING payload must be 8 bytes"}
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return sc.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameGoAway:
+		if f.streamID != 0 {
+			return connError{errCodeProtocol, "GOAWAY on a stream"}
+		}
+		return nil
+	case frameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case frameContinuation:
+		if sc.continuation == nil {
+			return connError{errCodeProtocol, "unexpected CONTINUATION frame"}
+		}
+		block := sc.continuation
+		block.fragment = append(block.fragment, f.payload...)
+		if len(block.fragment) > maxHeaderListSize {
+			return connError{errCodeEnhanceYourCalm, "header block too large"}
+		}
+		if !f.has(flagEndHeaders) {
+			return nil
+		}
+		sc.continuation = nil
+		return sc.processHeaderBlock(block)
+	}
+	// Unknown frame types are ignored (RFC 9113 section 4.1).
+	return nil
+}
+
+func (sc *serverConn) processSettings(f frame) error {
+	if f.streamID != 0 {
+		return connError{errCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return connError{errCodeFrameSize, "SETTINGS ACK with a payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case settingEnablePush:
+			if s.value > 1 {
+				return connError{errCodeProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case settingInitialWindowSize:
+			if s.value > maxWindowSize {
+				return connError{errCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE too large"}
+			}
+			// The change applies to the windows of open streams too
+			// (RFC 9113 section 6.9.2).
+			delta := int64(s.value) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return connError{errCodeFlowControl, "stream window overflow"}
+				}
+			}
+			sc.peerInitialWindow = int64(s.value)
+		case settingMaxFrameSize:
+			if s.value < defaultMaxFrameSize || s.value > maxFrameSizeLimit {
+				return connError{errCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			sc.peerMaxFrameSize = s.value
+		}
+		// The encoder never uses the dynamic table, so the peer's
+		// SETTINGS_HEADER_TABLE_SIZE needs no action.
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f frame) error {
+	if len(f.payload) != 4 {
+		return connError{errCodeFrameSize, "WINDOW_UPDATE payload must be 4 bytes"}
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID == 0 {
+		if increment == 0 {
+			return connError{errCodeProtocol, "zero WINDOW_UPDATE increment"}
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError{errCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	if f.streamID > sc.lastStreamID {
+		return connError{errCodeProtocol, "WINDOW_UPDATE on an idle stream"}
+	}
+	st := sc.streams[f.streamID]
+	if st == nil {
+		return nil
+	}
+	if increment == 0 {
+		return streamError{f.streamID, errCodeProtocol, "zero WINDOW_UPDATE increment"}
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError{f.streamID, errCodeFlowControl, "stream window overflow"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f frame) error {
+	if f.streamID == 0 {
+		return connError{errCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.payload) != 4 {
+		return connError{errCodeFrameSize, "RST_STREAM payload must be 4 bytes"}
+	}
+
+	sc.mu.Lock()
+	if f.streamID > sc.lastStreamID {
+		sc.mu.Unlock()
+		return connError{errCodeProtocol, "RST_STREAM on an idle stream"}
+	}
+	sc.mu.Unlock()
+	sc.cancelStream(f.streamID)
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f frame) error {
+	if f.streamID == 0 {
+		return connError{errCodeProtocol, "HEADERS on stream 0"}
+	}
+	fragment, err := removePadding(f)
+	if err != nil {
+		return err
+	}
+	if f.has(flagPriority) {
+		if len(fragment) < 5 {
+			return connError{errCodeFrameSize, "HEADERS priority fields truncated"}
+		}
+		if binary.BigEndian.Uint32(fragment)&(1<<31-1) == f.streamID {
+			return streamError{f.streamID, errCodeProtocol, "stream depends on itself"}
+		}
+		fragment = fragment[5:]
+	}
+
+	block := &headerBlock{
+		streamID:  f.streamID,
+		endStream: f.has(flagEndStream),
+		fragment:  append([]byte(nil), fragment...),
+	}
+	if !f.has(flagEndHeaders) {
+		sc.continuation = block
+		return nil
+	}
+	return sc.processHeaderBlock(block)
+}
+
+// processHeaderBlock handles a complete header block, which either opens
+// a stream or carries the trailers of a request body.
+func (sc *serverConn) processHeaderBlock(block *headerBlock) error {
+	// Every block is decoded, even for streams that are refused, to keep
+	// the decoder's table in step with the peer's encoder.
+	fields, err := sc.decoder.Decode(block.fragment)
+	if err != nil {
+		return connError{errCodeCompression, err.Error()}
+	}
+
+	sc.mu.Lock()
+	if block.streamID <= sc.lastStreamID {
+		st := sc.streams[block.streamID]
+		sc.mu.Unlock()
+		if st == nil || st.remoteClosed {
+			return streamError{block.streamID, errCodeStreamClosed, "HEADERS on a closed stream"}
+		}
+		if !block.endStream {
+			return streamError{block.streamID, errCodeProtocol, "trailers must end the stream"}
+		}
+		for _, f := range fields {
+			if strings.HasPrefix(f.Name, ":") {
+				return streamError{block.streamID, errCodeProtocol, "pseudo-header in trailers"}
+			}
+			if err := checkField(f); err != nil {
+				return streamError{block.streamID, errCodeProtocol, err.Error()}
+			}
+		}
+		return sc.endRequest(st)
+	}
+	if block.streamID%2 == 0 {
+		sc.mu.Unlock()
+		return connError{errCodeProtocol, "client opened an even-numbered stream"}
+	}
+	sc.lastStreamID = block.streamID
+	if sc.goingAway || sc.closed {
+		// Streams opened after GOAWAY are ignored.
+		sc.mu.Unlock()
+		return nil
+	}
+	if uint32(len(sc.streams)) >= sc.maxStreams() {
+		sc.mu.Unlock()
+		return streamError{block.streamID, errCodeRefusedStream, "too many concurrent streams"}
+	}
+	sc.mu.Unlock()
+
+	req, err := requestFromFields(fields)
+	if err != nil {
+		return streamError{block.streamID, errCodeProtocol, err.Error()}
+	}
+	st := sc.openStream(block.streamID, req)
+	if block.endStream {
+		return sc.endRequest(st)
+	}
+	if st.contentLength > sc.maxBodySize() {
+		return sc.rejectBody(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processData(f frame) error {
+	if f.streamID == 0 {
+		return connError{errCodeProtocol, "DATA on stream 0"}
+	}
+
+	sc.mu.Lock()
+	idle := f.streamID > sc.lastStreamID
+	st := sc.streams[f.streamID]
+	sc.mu.Unlock()
+	if idle {
+		return connError{errCodeProtocol, "DATA on an idle stream"}
+	}
+
+	// The whole payload, padding included, counts against the windows.
+	size := int64(len(f.payload))
+	if size > sc.recvWindow {
+		return connError{errCodeFlowControl, "DATA exceeds the connection window"}
+	}
+	sc.recvWindow -= size
+	// The connection's credit is returned even when the stream is gone, as
+	// the peer has already counted it. Each stream's body is limited on
+	// its own.
+	if sc.recvWindow < defaultWindowSize/2 {
+		if err := sc.writeWindowUpdate(0, int(defaultWindowSize-sc.recvWindow)); err != nil {
+			return err
+		}
+		sc.recvWindow = defaultWindowSize
+	}
+	if st == nil || st.remoteClosed {
+		return streamError{f.streamID, errCodeStreamClosed, "DATA on a closed stream"}
+	}
+	if size > st.recvWindow {
+		return streamError{f.streamID, errCodeFlowControl, "DATA exceeds the stream window"}
+	}
+	st.recvWindow -= size
+
+	data, err := removePadding(f)
+	if err != nil {
+		return err
+	}
+	if st.contentLength >= 0 && int64(len(st.body)+len(data)) > st.contentLength {
+		return streamError{f.streamID, errCodeProtocol, "body exceeds Content-Length"}
+	}
+	if int64(len(st.body)+len(data)) > sc.maxBodySize() {
+		return sc.rejectBody(st)
+	}
+	st.body = append(st.body, data...)
+	if f.has(flagEndStream) {
+		return sc.endRequest(st)
+	}
+
+	// Bodies are buffered in full, so the stream is only given credit for
+	// one byte past the largest body accepted: enough for a request that
+	// is too large to be told so, but no more.
+	if st.recvWindow < defaultWindowSize/2 {
+		allowed := sc.maxBodySize() + 1 - int64(len(st.body)) - st.recvWindow
+		increment := min(defaultWindowSize-st.recvWindow, allowed)
+		if increment > 0 {
+			if err := sc.writeWindowUpdate(f.streamID, int(increment)); err != nil {
+				return err
+			}
+			st.recvWindow += increment
+		}
+	}
+	return nil
+}
+
+// rejectBody answers a request whose body is larger than the server
+// accepts with 413, without waiting for the rest of it, and then resets
+// the stream (RFC 9113 section 8.1).
+func (sc *serverConn) rejectBody(st *stream) error {
+	fields := []hpack.HeaderField{
+		{Name: ":status", Value: strconv.Itoa(int(response.StatusCodeContentTooLarge))},
+		{Name: "content-length", Value: "0"},
+	}
+	if err := sc.writeHeaders(st.id, fields, true); err != nil {
+		return err
+	}
+	return streamError{st.id, errCodeNo, "request body too large"}
+}
+
+// endRequest is called once a request has been received in full, and
+// starts its handler.
+func (sc *serverConn) endRequest(st *stream) error {
+	if cl, ok := st.req.Headers.Get("content-length"); ok && cl != strconv.Itoa(len(st.body)) {
+		return streamError{st.id, errCodeProtocol, "body does not match Content-Length"}
+	}
+	st.remoteClosed = true
+	st.req.Body = st.body
+
+	sc.handlers.Add(1)
+	go st.run()
+	return nil
+}
+
+func (sc *serverConn) openStream(id uint32, req *request.Request) *stream {
+	req.RemoteAddr = sc.conn.RemoteAddr()
+	req.LocalAddr = sc.conn.LocalAddr()
+
+	ctx, cancel := context.WithCancel(sc.baseCtx)
+	st := &stream{
+		id:            id,
+		sc:            sc,
+		req:           req.WithContext(ctx),
+		cancel:        cancel,
+		recvWindow:    defaultWindowSize,
+		contentLength: -1,
+	}
+	if cl, ok := req.Headers.Get("content-length"); ok {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			st.contentLength = n
+		}
+	}
+
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[id] = st
+	if len(sc.streams) == 1 {
+		sc.setActiveLocked(true)
+	}
+	sc.mu.Unlock()
+	return st
+}
+
+// startUpgradeStream serves the request that asked for an h2c upgrade as
+// stream 1, whose request side is already complete.
+func (sc *serverConn) startUpgradeStream(req *request.Request) {
+	sc.mu.Lock()
+	sc.lastStreamID = 1
+	sc.mu.Unlock()
+
+	upgraded := &request.Request{
+		RequestLine: req.RequestLine,
+		Headers:     headers.NewHeaders(),
+		TLS:         req.TLS,
+	}
+	upgraded.RequestLine.HttpVersion = "2"
+	for name, value := range req.Headers {
+		if !isConnectionHeader(name) && name != "http2-settings" {
+			upgraded.Headers.Set(name, value)
+		}
+	}
+
+	st := sc.openStream(1, upgraded)
+	st.body = req.Body
+	st.remoteClosed = true
+	st.req.Body = st.body
+	sc.handlers.Add(1)
+	go st.run()
+}
+
+// closeStream forgets a stream whose handler has returned.
+func (sc *serverConn) closeStream(st *stream) {
+	sc.mu.Lock()
+	st.cancel()
+	delete(sc.streams, st.id)
+	idle := len(sc.streams) == 0
+	if idle {
+		sc.setActiveLocked(false)
+	}
+	goingAway := sc.goingAway
+	sc.mu.Unlock()
+
+	if idle && goingAway {
+		sc.conn.Close()
+	}
+}
+
+// setActiveLocked reports a change between having open streams and having
+// none. It is called with mu held so that reports arrive in order.
+func (sc *serverConn) setActiveLocked(active bool) {
+	if sc.srv.ConnState != nil {
+		sc.srv.ConnState(sc.conn, active)
+	}
+}
+
+// cancelStream stops a stream that was reset, by either side.
+func (sc *serverConn) cancelStream(id uint32) {
+	sc.mu.Lock()
+	st := sc.streams[id]
+	if st == nil {
+		sc.mu.Unlock()
+		return
+	}
+	st.reset = true
+	st.cancel()
+	sc.cond.Broadcast()
+	started := st.remoteClosed
+	sc.mu.Unlock()
+
+	// A stream whose handler was started is forgotten when the handler
+	// returns; otherwise nothing else will.
+	if !started {
+		st.remoteClosed = true
+		sc.closeStream(st)
+	}
+}
+
+func (sc *serverConn) resetStream(se streamError) {
+	sc.cancelStream(se.streamID)
+	sc.writeRSTStream(se.streamID, se.code)
+}
+
+func (sc *serverConn) goAway(code errCode, reason string) {
+	sc.mu.Lock()
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+	sc.writeGoAway(lastStreamID, code, reason)
+}
+
+func (sc *serverConn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	sc.writeBuf = appendFrame(sc.writeBuf[:0], typ, flags, streamID, payload)
+	_, err := sc.conn.Write(sc.writeBuf)
+	return err
+}
+
+// writeHeaders encodes fields and sends them as one header block, split
+// into CONTINUATION frames when it exceeds the peer's frame size.
+func (sc *serverConn) writeHeaders(streamID uint32, fields []hpack.HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	maxSize := int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	block := hpack.Encoder{}.Encode(nil, fields)
+
+	buf := sc.writeBuf[:0]
+	typ := frameHeaders
+	var flags uint8
+	if endStream {
+		flags = flagEndStream
+	}
+	for {
+		n := min(len(block), maxSize)
+		if n == len(block) {
+			flags |= flagEndHeaders
+		}
+		buf = appendFrame(buf, typ, flags, streamID, block[:n])
+		block = block[n:]
+		if len(block) == 0 {
+			break
+		}
+		typ, flags = frameContinuation, 0
+	}
+	sc.writeBuf = buf
+	_, err := sc.conn.Write(buf)
+	return err
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, increment int) error {
+	return sc.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(increment)))
+}
+
+func (sc *serverConn) writeRSTStream(streamID uint32, code errCode) error {
+	return sc.writeFrame(frameRSTStream, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+func (sc *serverConn) writeGoAway(lastStreamID uint32, code errCode, reason string) error {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, reason...)
+	return sc.writeFrame(frameGoAway, 0, 0, payload)
+}
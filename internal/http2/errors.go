@@ -0,0 +1,69 @@
+package http2
+
+import "fmt"
+
+// errCode is an HTTP/2 error code (RFC 9113 section 7).
+type errCode uint32
+
+const (
+	errCodeNo                 errCode = 0x0
+	errCodeProtocol           errCode = 0x1
+	errCodeInternal           errCode = 0x2
+	errCodeFlowControl        errCode = 0x3
+	errCodeSettingsTimeout    errCode = 0x4
+	errCodeStreamClosed       errCode = 0x5
+	errCodeFrameSize          errCode = 0x6
+	errCodeRefusedStream      errCode = 0x7
+	errCodeCancel             errCode = 0x8
+	errCodeCompression        errCode = 0x9
+	errCodeConnect            errCode = 0xa
+	errCodeEnhanceYourCalm    errCode = 0xb
+	errCodeInadequateSecurity errCode = 0xc
+	errCodeHTTP11Required     errCode = 0xd
+)
+
+var errCodeNames = map[errCode]string{
+	errCodeNo:                 "NO_ERROR",
+	errCodeProtocol:           "PROTOCOL_ERROR",
+	errCodeInternal:           "INTERNAL_ERROR",
+	errCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	errCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	errCodeStreamClosed:       "STREAM_CLOSED",
+	errCodeFrameSize:          "FRAME_SIZE_ERROR",
+	errCodeRefusedStream:      "REFUSED_STREAM",
+	errCodeCancel:             "CANCEL",
+	errCodeCompression:        "COMPRESSION_ERROR",
+	errCodeConnect:            "CONNECT_ERROR",
+	errCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	errCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	errCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c errCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code %#x", uint32(c))
+}
+
+// connError is a connection error: the connection is closed with a
+// GOAWAY carrying code.
+type connError struct {
+	code   errCode
+	reason string
+}
+
+func (e connError) Error() string {
+	return fmt.Sprintf("http2: connection error: %v: %s", e.code, e.reason)
+}
+
+// streamError is a stream error: only the stream is reset with code.
+type streamError struct {
+	streamID uint32
+	code     errCode
+	reason   string
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error: %v: %s", e.streamID, e.code, e.reason)
+}
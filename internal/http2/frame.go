@@ -0,0 +1,143 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+const (
+	frameHeaderLen = 9
+
+	// defaultMaxFrameSize is the initial SETTINGS_MAX_FRAME_SIZE, and the
+	// largest frame this server accepts.
+	defaultMaxFrameSize = 16384
+	maxFrameSizeLimit   = 1<<24 - 1
+
+	// defaultWindowSize is the initial flow control window of streams and
+	// of the connection (RFC 9113 section 6.9.2).
+	defaultWindowSize = 65535
+	maxWindowSize     = 1<<31 - 1
+)
+
+type settingID uint16
+
+const (
+	settingHeaderTableSize      settingID = 0x1
+	settingEnablePush           settingID = 0x2
+	settingMaxConcurrentStreams settingID = 0x3
+	settingInitialWindowSize    settingID = 0x4
+	settingMaxFrameSize         settingID = 0x5
+	settingMaxHeaderListSize    settingID = 0x6
+)
+
+type setting struct {
+	id    settingID
+	value uint32
+}
+
+type frame struct {
+	typ      frameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// readFrame reads one frame. Frames longer than maxSize are a connection
+// error (RFC 9113 section 4.2).
+func readFrame(r io.Reader, maxSize uint32) (frame, error) {
+	var h [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return frame{}, err
+	}
+	length := uint32(h[0])<<16 | uint32(h[1])<<8 | uint32(h[2])
+	f := frame{
+		typ:      frameType(h[3]),
+		flags:    h[4],
+		streamID: binary.BigEndian.Uint32(h[5:]) & (1<<31 - 1),
+	}
+	if length > maxSize {
+		return f, connError{errCodeFrameSize, fmt.Sprintf("frame of %d bytes exceeds %d", length, maxSize)}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return f, err
+	}
+	return f, nil
+}
+
+// appendFrame appends a frame's header and payload to dst.
+func appendFrame(dst []byte, typ frameType, flags uint8, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(typ), flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID)
+	return append(dst, payload...)
+}
+
+// removePadding strips the padding of a PADDED DATA or HEADERS frame.
+func removePadding(f frame) ([]byte, error) {
+	p := f.payload
+	if !f.has(flagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 {
+		return nil, connError{errCodeFrameSize, "padded frame without pad length"}
+	}
+	padLen := int(p[0])
+	if padLen >= len(p) {
+		return nil, connError{errCodeProtocol, "padding exceeds frame payload"}
+	}
+	return p[1 : len(p)-padLen], nil
+}
+
+func parseSettings(p []byte) ([]setting, error) {
+	if len(p)%6 != 0 {
+		return nil, connError{errCodeFrameSize, "SETTINGS payload is not a multiple of 6 bytes"}
+	}
+	settings := make([]setting, 0, len(p)/6)
+	for ; len(p) > 0; p = p[6:] {
+		settings = append(settings, setting{
+			id:    settingID(binary.BigEndian.Uint16(p)),
+			value: binary.BigEndian.Uint32(p[2:]),
+		})
+	}
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings ...setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.id))
+		dst = binary.BigEndian.AppendUint32(dst, s.value)
+	}
+	return dst
+}
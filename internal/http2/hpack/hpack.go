@@ -0,0 +1,291 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HeaderField is a single header name and value. Names are lowercase.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// size is the entry size used for dynamic table accounting (RFC 7541
+// section 4.1).
+func (f HeaderField) size() int {
+	return len(f.Name) + len(f.Value) + 32
+}
+
+var (
+	// ErrInvalidIndex is returned for a reference to a table entry that
+	// does not exist.
+	ErrInvalidIndex = errors.New("hpack: invalid table index")
+	// ErrHeaderListTooLarge is returned when a header block decodes to
+	// more than the decoder's limit.
+	ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+	errTruncated          = errors.New("hpack: truncated header block")
+	errIntegerOverflow    = errors.New("hpack: integer overflow")
+)
+
+// dynamicTable is the FIFO table of RFC 7541 section 2.3.2. Newest entries
+// are at the end of entries.
+type dynamicTable struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	n := 0
+	for t.size > t.maxSize && n < len(t.entries) {
+		t.size -= t.entries[n].size()
+		n++
+	}
+	t.entries = append(t.entries[:0], t.entries[n:]...)
+}
+
+// Decoder decodes header blocks. A connection has one Decoder for the
+// blocks it receives, used in the order the blocks arrive.
+type Decoder struct {
+	table dynamicTable
+	// maxTableSize is the limit advertised to the peer with
+	// SETTINGS_HEADER_TABLE_SIZE; size updates may not exceed it.
+	maxTableSize      int
+	maxHeaderListSize int
+}
+
+// NewDecoder returns a Decoder whose dynamic table may grow to
+// maxTableSize bytes and which refuses header lists larger than
+// maxHeaderListSize, counted as in SETTINGS_MAX_HEADER_LIST_SIZE.
+func NewDecoder(maxTableSize, maxHeaderListSize int) *Decoder {
+	return &Decoder{
+		table:             dynamicTable{maxSize: maxTableSize},
+		maxTableSize:      maxTableSize,
+		maxHeaderListSize: maxHeaderListSize,
+	}
+}
+
+// Decode decodes a complete header block. Any error is a compression
+// error, after which the decoder's state is unusable.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var (
+		fields   []HeaderField
+		listSize int
+	)
+	for len(block) > 0 {
+		b := block[0]
+		var (
+			f   HeaderField
+			err error
+		)
+		switch {
+		case b&0x80 != 0: // Indexed header field
+			var index uint64
+			index, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err = d.at(index)
+		case b&0xC0 == 0x40: // Literal with incremental indexing
+			f, block, err = d.readLiteral(block, 6)
+			if err == nil {
+				d.table.add(f)
+			}
+		case b&0xE0 == 0x20: // Dynamic table size update
+			if len(fields) > 0 {
+				return nil, errors.New("hpack: table size update after header fields")
+			}
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxTableSize) {
+				return nil, fmt.Errorf("hpack: table size %d over limit %d", size, d.maxTableSize)
+			}
+			d.table.setMaxSize(int(size))
+			continue
+		default: // Literal without indexing or never indexed
+			f, block, err = d.readLiteral(block, 4)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		listSize += f.size()
+		if d.maxHeaderListSize > 0 && listSize > d.maxHeaderListSize {
+			return nil, ErrHeaderListTooLarge
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// at returns the entry at a 1-based index across the static and dynamic
+// tables.
+func (d *Decoder) at(index uint64) (HeaderField, error) {
+	switch {
+	case index == 0:
+		return HeaderField{}, ErrInvalidIndex
+	case index <= uint64(len(staticTable)):
+		return staticTable[index-1], nil
+	}
+	i := index - uint64(len(staticTable)) - 1
+	if i >= uint64(len(d.table.entries)) {
+		return HeaderField{}, ErrInvalidIndex
+	}
+	return d.table.entries[len(d.table.entries)-1-int(i)], nil
+}
+
+// readLiteral reads a literal field whose name index uses an n-bit prefix.
+func (d *Decoder) readLiteral(block []byte, n uint8) (HeaderField, []byte, error) {
+	index, rest, err := readInt(block, n)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	var f HeaderField
+	if index > 0 {
+		named, err := d.at(index)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		f.Name = named.Name
+	} else {
+		f.Name, rest, err = d.readString(rest)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	}
+	f.Value, rest, err = d.readString(rest)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	return f, rest, nil
+}
+
+func (d *Decoder) readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, errTruncated
+	}
+	huffman := block[0]&0x80 != 0
+	length, rest, err := readInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(rest)) < length {
+		return "", nil, errTruncated
+	}
+	if d.maxHeaderListSize > 0 && length > uint64(d.maxHeaderListSize) {
+		return "", nil, ErrHeaderListTooLarge
+	}
+	raw := rest[:length]
+	rest = rest[length:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	s, err := huffmanDecode(raw)
+	return s, rest, err
+}
+
+// readInt decodes an integer with an n-bit prefix (RFC 7541 section 5.1).
+func readInt(block []byte, n uint8) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, errTruncated
+	}
+	max := uint64(1)<<n - 1
+	value := uint64(block[0]) & max
+	block = block[1:]
+	if value < max {
+		return value, block, nil
+	}
+
+	var shift uint
+	for len(block) > 0 {
+		b := block[0]
+		block = block[1:]
+		if shift >= 63 {
+			return 0, nil, errIntegerOverflow
+		}
+		value += uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return value, block, nil
+		}
+		shift += 7
+	}
+	return 0, nil, errTruncated
+}
+
+// appendInt encodes value with an n-bit prefix, or-ing flags into the
+// first byte.
+func appendInt(dst []byte, flags byte, n uint8, value uint64) []byte {
+	max := uint64(1)<<n - 1
+	if value < max {
+		return append(dst, flags|byte(value))
+	}
+	dst = append(dst, flags|byte(max))
+	value -= max
+	for value >= 0x80 {
+		dst = append(dst, byte(value&0x7F)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+// Encoder encodes header blocks. It only refers to the static table and
+// never adds entries to the dynamic one, so it needs no state shared with
+// the peer's decoder beyond the default table size.
+type Encoder struct{}
+
+// Encode appends the header block for fields to dst.
+func (Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	for _, f := range fields {
+		nameIndex := 0
+		for i, s := range staticTable {
+			if s.Name != f.Name {
+				continue
+			}
+			if s.Value == f.Value {
+				nameIndex = -(i + 1)
+				break
+			}
+			if nameIndex == 0 {
+				nameIndex = i + 1
+			}
+		}
+		if nameIndex < 0 {
+			dst = appendInt(dst, 0x80, 7, uint64(-nameIndex))
+			continue
+		}
+
+		// Literal without indexing.
+		dst = appendInt(dst, 0x00, 4, uint64(nameIndex))
+		if nameIndex == 0 {
+			dst = appendString(dst, f.Name)
+		}
+		dst = appendString(dst, f.Value)
+	}
+	return dst
+}
+
+// appendString writes a string literal, Huffman coded when that is
+// shorter.
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
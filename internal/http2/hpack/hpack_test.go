@@ -0,0 +1,103 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestIntegers(t *testing.T) {
+	// Test: Examples from RFC 7541 Appendix C.1
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 0, 5, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 0, 5, 1337))
+	assert.Equal(t, []byte{0x2a}, appendInt(nil, 0, 8, 42))
+
+	v, rest, err := readInt([]byte{0x1f, 0x9a, 0x0a, 0xff}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), v)
+	assert.Equal(t, []byte{0xff}, rest)
+
+	_, _, err = readInt([]byte{0x1f, 0x9a}, 5)
+	assert.Error(t, err)
+}
+
+func TestDecodeRFCExamples(t *testing.T) {
+	// Test: Requests with Huffman coding from RFC 7541 Appendix C.4,
+	// sharing one dynamic table
+	d := NewDecoder(4096, 0)
+	for _, tc := range []struct {
+		block string
+		want  []HeaderField
+	}{
+		{"828684418cf1e3c2e5f23a6ba0ab90f4ff", []HeaderField{
+			{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+		}},
+		{"828684be5886a8eb10649cbf", []HeaderField{
+			{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+			{"cache-control", "no-cache"},
+		}},
+		{"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf", []HeaderField{
+			{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"},
+			{"custom-key", "custom-value"},
+		}},
+	} {
+		block, err := hex.DecodeString(tc.block)
+		require.NoError(t, err)
+		fields, err := d.Decode(block)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, fields)
+	}
+	assert.Equal(t, 164, d.table.size)
+
+	// Test: References past the dynamic table fail
+	_, err := d.Decode([]byte{0x80 | 70})
+	assert.ErrorIs(t, err, ErrInvalidIndex)
+
+	// Test: Table size updates above the advertised limit fail
+	_, err = NewDecoder(4096, 0).Decode(appendInt(nil, 0x20, 5, 8192))
+	assert.Error(t, err)
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{":status", "200"},
+		{":status", "418"},
+		{"content-type", "text/html"},
+		{"x-custom", strings.Repeat("value ", 30)},
+		{"x-binary", "\x00\xff"},
+	}
+	block := Encoder{}.Encode(nil, fields)
+
+	// Test: :status 200 is a single static table reference
+	assert.Equal(t, byte(0x88), block[0])
+
+	decoded, err := NewDecoder(4096, 0).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+
+	// Test: Header list size limit
+	_, err = NewDecoder(4096, 100).Decode(block)
+	assert.ErrorIs(t, err, ErrHeaderListTooLarge)
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: Encoding from RFC 7541 Appendix C.4.1
+	assert.Equal(t, "f1e3c2e5f23a6ba0ab90f4ff", hex.EncodeToString(huffmanEncode(nil, "www.example.com")))
+
+	// Test: Every byte value survives a round trip
+	var all strings.Builder
+	for i := 0; i < 256; i++ {
+		all.WriteByte(byte(i))
+	}
+	decoded, err := huffmanDecode(huffmanEncode(nil, all.String()))
+	require.NoError(t, err)
+	assert.Equal(t, all.String(), decoded)
+
+	// Test: Padding longer than 7 bits or not all ones is invalid
+	_, err = huffmanDecode([]byte{0xf1, 0xe3, 0xff})
+	assert.Error(t, err)
+	_, err = huffmanDecode([]byte{0x00})
+	assert.Error(t, err)
+}
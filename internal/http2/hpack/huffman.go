@@ -0,0 +1,104 @@
+package hpack
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var errInvalidHuffman = errors.New("hpack: invalid Huffman-encoded data")
+
+// huffmanNode is a node of the decoding tree. Leaves have no children and
+// hold the decoded byte.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+	leaf     bool
+}
+
+var (
+	huffmanRoot     *huffmanNode
+	huffmanTreeOnce sync.Once
+)
+
+func buildHuffmanTree() {
+	huffmanRoot = &huffmanNode{}
+	for sym, c := range huffmanCodes {
+		n := huffmanRoot
+		for i := int(c.bits) - 1; i >= 0; i-- {
+			bit := (c.code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym = byte(sym)
+		n.leaf = true
+	}
+}
+
+// huffmanDecode decodes a Huffman-coded string. Padding must be a prefix
+// of the EOS code no longer than 7 bits (RFC 7541 section 5.2).
+func huffmanDecode(p []byte) (string, error) {
+	huffmanTreeOnce.Do(buildHuffmanTree)
+
+	var (
+		b       strings.Builder
+		n       = huffmanRoot
+		depth   int
+		allOnes = true
+	)
+	for _, c := range p {
+		for i := 7; i >= 0; i-- {
+			bit := (c >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				// Only EOS has a code longer than any byte's, and it
+				// must never appear.
+				return "", errInvalidHuffman
+			}
+			depth++
+			allOnes = allOnes && bit == 1
+			if n.leaf {
+				b.WriteByte(n.sym)
+				n = huffmanRoot
+				depth = 0
+				allOnes = true
+			}
+		}
+	}
+	if depth > 7 || !allOnes {
+		return "", errInvalidHuffman
+	}
+	return b.String(), nil
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodes[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+// huffmanEncode appends the Huffman coding of s, padded with ones.
+func huffmanEncode(dst []byte, s string) []byte {
+	var (
+		acc  uint64
+		bits uint
+	)
+	for i := 0; i < len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		bits += uint(c.bits)
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+	if bits > 0 {
+		acc = acc<<(8-bits) | (1<<(8-bits) - 1)
+		dst = append(dst, byte(acc))
+	}
+	return dst
+}
@@ -0,0 +1,574 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/http2/hpack"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchPreface(t *testing.T) {
+	// Test: The preface matches, even across reads
+	read, matched, err := MatchPreface(io.MultiReader(strings.NewReader("PRI * HTTP/2"), strings.NewReader(".0\r\n\r\nSM\r\n\r\nrest")))
+	require.NoError(t, err)
+	assert.True(t, matched)
+	assert.Equal(t, ClientPreface, string(read))
+
+	// Test: An HTTP/1 request is told apart after one read
+	read, matched, err = MatchPreface(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, matched)
+	assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", string(read))
+
+	// Test: A short connection returns what was read
+	read, matched, err = MatchPreface(strings.NewReader("PRI"))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.False(t, matched)
+	assert.Equal(t, "PRI", string(read))
+}
+
+func TestServeConn(t *testing.T) {
+	requests := make(chan *request.Request, 1)
+	c := dialTest(t, &Server{Handler: func(w *response.Writer, req *request.Request) {
+		requests <- req
+		switch req.RequestLine.RequestTarget {
+		case "/trailers":
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "X-Checksum")
+			w.WriteStatusLine(response.StatusCodeOK)
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("chunk"))
+			w.WriteChunkedBodyDone()
+			trailers := headers.NewHeaders()
+			trailers.Set("X-Checksum", "abc")
+			w.WriteTrailers(trailers)
+		case "/silent":
+		default:
+			body := append([]byte("echo:"), req.Body...)
+			w.WriteStatusLine(response.StatusCodeOK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody(body)
+		}
+	}})
+
+	// Test: A request becomes a request.Request
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/a?b=c", ":authority", "example.com",
+		"cookie", "a=1", "accept", "*/*", "cookie", "b=2")
+	resp := c.readResponse(1)
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.Equal(t, "5", resp.headers["content-length"])
+	assert.Equal(t, "echo:", resp.body)
+	got := <-requests
+	assert.Equal(t, "GET", got.RequestLine.Method)
+	assert.Equal(t, "/a?b=c", got.RequestLine.RequestTarget)
+	assert.Equal(t, "2", got.RequestLine.HttpVersion)
+	assert.Equal(t, "example.com", got.Headers["host"])
+	assert.Equal(t, "a=1; b=2", got.Headers["cookie"])
+	assert.NotNil(t, got.RemoteAddr)
+
+	// Test: The request body arrives in DATA frames
+	c.writeHeaders(3, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "5")
+	c.writeFrame(frameData, 0, 3, []byte("he"))
+	c.writeFrame(frameData, flagEndStream, 3, []byte("llo"))
+	resp = c.readResponse(3)
+	assert.Equal(t, "echo:hello", resp.body)
+	assert.Equal(t, []byte("hello"), (<-requests).Body)
+
+	// Test: Trailers end the stream in a HEADERS frame
+	c.writeHeaders(5, true, ":method", "GET", ":scheme", "http", ":path", "/trailers")
+	resp = c.readResponse(5)
+	assert.Equal(t, "chunk", resp.body)
+	assert.NotContains(t, resp.headers, "transfer-encoding")
+	assert.Equal(t, "abc", resp.trailers["x-checksum"])
+	<-requests
+
+	// Test: HEAD responses end with their headers
+	c.writeHeaders(7, true, ":method", "HEAD", ":scheme", "http", ":path", "/")
+	resp = c.readResponse(7)
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.Empty(t, resp.body)
+	<-requests
+
+	// Test: A handler that writes nothing resets its stream
+	c.writeHeaders(9, true, ":method", "GET", ":scheme", "http", ":path", "/silent")
+	f := c.readFrame()
+	assert.Equal(t, frameRSTStream, f.typ)
+	assert.Equal(t, errCodeInternal, errCode(binary.BigEndian.Uint32(f.payload)))
+
+	// Test: PING is acknowledged
+	c.writeFrame(framePing, 0, 0, []byte("12345678"))
+	f = c.readFrame()
+	assert.Equal(t, framePing, f.typ)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+}
+
+func TestFlowControl(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	c := dialTestSettings(t, &Server{Handler: func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}}, setting{settingInitialWindowSize, 30})
+
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/")
+	f := c.readFrame()
+	require.Equal(t, frameHeaders, f.typ)
+
+	// Test: No more is sent than the stream's window allows
+	f = c.readFrame()
+	require.Equal(t, frameData, f.typ)
+	assert.Len(t, f.payload, 30)
+	c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := c.reader.Peek(1)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	c.reader.Reset(c.conn)
+
+	// Test: WINDOW_UPDATE lets the rest through
+	c.writeFrame(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 70))
+	var rest []byte
+	for f = c.readFrame(); f.typ == frameData; f = c.readFrame() {
+		rest = append(rest, f.payload...)
+		if f.has(flagEndStream) {
+			break
+		}
+	}
+	assert.Len(t, rest, 70)
+}
+
+func TestRequestBodyLimits(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(req.Body)))
+		w.WriteBody(req.Body)
+	}
+	// nextFrame skips flow control updates.
+	nextFrame := func(c *testConn) frame {
+		f := c.readFrame()
+		for f.typ == frameWindowUpdate {
+			f = c.readFrame()
+		}
+		return f
+	}
+	expect413 := func(c *testConn, streamID uint32) {
+		f := nextFrame(c)
+		require.Equal(t, frameHeaders, f.typ)
+		assert.True(t, f.has(flagEndStream))
+		fields, err := c.decoder.Decode(f.payload)
+		require.NoError(t, err)
+		assert.Equal(t, hpack.HeaderField{Name: ":status", Value: "413"}, fields[0])
+		f = nextFrame(c)
+		require.Equal(t, frameRSTStream, f.typ)
+		assert.Equal(t, streamID, f.streamID)
+		assert.Equal(t, errCodeNo, errCode(binary.BigEndian.Uint32(f.payload)))
+	}
+
+	c := dialTest(t, &Server{Handler: handler, MaxRequestBodySize: 10})
+
+	// Test: A body growing past the limit gets 413 before it ends
+	c.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	c.writeFrame(frameData, 0, 1, []byte("hello"))
+	c.writeFrame(frameData, 0, 1, []byte("world!"))
+	expect413(c, 1)
+
+	// Test: So does a declared length over the limit, before any DATA
+	c.writeHeaders(3, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "100")
+	expect413(c, 3)
+
+	// Test: Bodies within the limit are still served
+	c.writeHeaders(5, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	c.writeFrame(frameData, flagEndStream, 5, []byte("0123456789"))
+	assert.Equal(t, "0123456789", c.readResponse(5).body)
+
+	// Test: A peer sending past the credit it was given gets
+	// FLOW_CONTROL_ERROR. Credit stops one byte past the body limit, so
+	// the fifth full frame overruns it.
+	c = dialTest(t, &Server{Handler: handler, MaxRequestBodySize: 70_000})
+	c.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	for range 5 {
+		c.writeFrame(frameData, 0, 1, make([]byte, defaultMaxFrameSize))
+	}
+	f := nextFrame(c)
+	require.Equal(t, frameRSTStream, f.typ)
+	assert.Equal(t, errCodeFlowControl, errCode(binary.BigEndian.Uint32(f.payload)))
+}
+
+func TestProtocolErrors(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+	}
+
+	for name, tc := range map[string]struct {
+		frames    func(c *testConn)
+		streamErr bool
+		code      errCode
+	}{
+		"DATA on stream 0": {
+			frames: func(c *testConn) { c.writeFrame(frameData, 0, 0, nil) },
+			code:   errCodeProtocol,
+		},
+		"even stream ID": {
+			frames: func(c *testConn) { c.writeHeaders(2, true, ":method", "GET", ":scheme", "http", ":path", "/") },
+			code:   errCodeProtocol,
+		},
+		"interrupted header block": {
+			frames: func(c *testConn) {
+				c.writeFrame(frameHeaders, flagEndStream, 1, hpack.Encoder{}.Encode(nil, []hpack.HeaderField{{Name: ":method", Value: "GET"}}))
+				c.writeFrame(framePing, 0, 0, make([]byte, 8))
+			},
+			code: errCodeProtocol,
+		},
+		"bad HPACK": {
+			frames: func(c *testConn) { c.writeFrame(frameHeaders, flagEndHeaders|flagEndStream, 1, []byte{0x80}) },
+			code:   errCodeCompression,
+		},
+		"oversized frame": {
+			frames: func(c *testConn) { c.writeFrame(frameData, 0, 1, make([]byte, defaultMaxFrameSize+1)) },
+			code:   errCodeFrameSize,
+		},
+		"missing :path": {
+			frames:    func(c *testConn) { c.writeHeaders(1, true, ":method", "GET", ":scheme", "http") },
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"connection header": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/", "connection", "close")
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"CR LF in header value": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/", "x-a", "v\r\nTransfer-Encoding: chunked")
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"LF in header value": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/", "x-a", "v\nx-b: w")
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"NUL in header value": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/", "x-a", "v\x00")
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"whitespace around header value": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/", "x-a", " v ")
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"CR LF in header name": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/", "x-a\r\nx-b", "v")
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"NUL in header name": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/", "x\x00a", "v")
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"CR LF in :path": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/\r\nx-a: v")
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"space in :path": {
+			frames:    func(c *testConn) { c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/a b") },
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"control character in :path": {
+			frames:    func(c *testConn) { c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/a\x7f") },
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		":path without leading slash": {
+			frames:    func(c *testConn) { c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "a") },
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"asterisk :path for GET": {
+			frames:    func(c *testConn) { c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "*") },
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"CR LF in :authority": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/", ":authority", "a\r\nx-a: v")
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"CR LF in trailer value": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/")
+				c.writeHeaders(1, true, "x-a", "v\r\nx-b: w")
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"body over Content-Length": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "3")
+				c.writeFrame(frameData, 0, 1, []byte("toolong"))
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"Content-Length mismatch": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "10")
+				c.writeFrame(frameData, flagEndStream, 1, []byte("short"))
+			},
+			streamErr: true,
+			code:      errCodeProtocol,
+		},
+		"too many streams": {
+			frames: func(c *testConn) {
+				c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/")
+				c.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":path", "/")
+			},
+			streamErr: true,
+			code:      errCodeRefusedStream,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := dialTest(t, &Server{Handler: handler, MaxConcurrentStreams: 1})
+			tc.frames(c)
+
+			// Test: The error is reported with the right frame and code
+			f := c.readFrame()
+			for f.typ == frameWindowUpdate {
+				f = c.readFrame()
+			}
+			if tc.streamErr {
+				require.Equal(t, frameRSTStream, f.typ)
+				assert.Equal(t, tc.code, errCode(binary.BigEndian.Uint32(f.payload)))
+				return
+			}
+			require.Equal(t, frameGoAway, f.typ)
+			assert.Equal(t, tc.code, errCode(binary.BigEndian.Uint32(f.payload[4:])))
+			_, err := c.reader.ReadByte()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestServeUpgrade(t *testing.T) {
+	client, server := tcpPair(t)
+	req, err := request.RequestFromReader(strings.NewReader("POST /up HTTP/1.1\r\nHost: example.com\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n" +
+		"HTTP2-Settings: " + base64.RawURLEncoding.EncodeToString(appendSettings(nil, setting{settingInitialWindowSize, 1000})) + "\r\n" +
+		"Content-Length: 4\r\n\r\nbody"))
+	require.NoError(t, err)
+	assert.True(t, IsUpgradeRequest(req))
+
+	requests := make(chan *request.Request, 1)
+	go (&Server{Handler: func(w *response.Writer, req *request.Request) {
+		requests <- req
+		body := []byte("upgraded")
+		w.WriteStatusLine(response.StatusCodeOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}}).ServeUpgrade(server, nil, req)
+
+	reader := bufio.NewReader(client)
+	status, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for line := ""; line != "\r\n"; {
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+	}
+	_, err = io.WriteString(client, ClientPreface)
+	require.NoError(t, err)
+	c := newTestConn(t, client, reader)
+	c.handshake()
+
+	// Test: The upgrade request is answered on stream 1
+	resp := c.readResponse(1)
+	assert.Equal(t, "upgraded", resp.body)
+	got := <-requests
+	assert.Equal(t, "2", got.RequestLine.HttpVersion)
+	assert.Equal(t, []byte("body"), got.Body)
+	assert.NotContains(t, got.Headers, "upgrade")
+	assert.NotContains(t, got.Headers, "http2-settings")
+	assert.Equal(t, "example.com", got.Headers["host"])
+}
+
+func TestShutdown(t *testing.T) {
+	shutdown := make(chan struct{})
+	release := make(chan struct{})
+	c := dialTest(t, &Server{Shutdown: shutdown, Handler: func(w *response.Writer, req *request.Request) {
+		<-release
+		w.WriteStatusLine(response.StatusCodeOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}})
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/")
+	time.Sleep(50 * time.Millisecond)
+	close(shutdown)
+
+	// Test: GOAWAY names the last stream, which is still answered
+	f := c.readFrame()
+	require.Equal(t, frameGoAway, f.typ)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.payload))
+	assert.Equal(t, errCodeNo, errCode(binary.BigEndian.Uint32(f.payload[4:])))
+	close(release)
+	resp := c.readResponse(1)
+	assert.Equal(t, "200", resp.headers[":status"])
+
+	// Test: The connection closes once its streams are done
+	_, err := c.reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+type testConn struct {
+	t       *testing.T
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *hpack.Decoder
+}
+
+type testResponse struct {
+	headers  map[string]string
+	body     string
+	trailers map[string]string
+}
+
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err = net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	server, err = listener.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, server
+}
+
+func dialTest(t *testing.T, s *Server) *testConn {
+	return dialTestSettings(t, s)
+}
+
+// dialTestSettings connects to s with prior knowledge and completes the
+// SETTINGS exchange.
+func dialTestSettings(t *testing.T, s *Server, settings ...setting) *testConn {
+	client, server := tcpPair(t)
+	go func() {
+		if _, matched, err := MatchPreface(server); err == nil && matched {
+			s.ServeConn(server, nil)
+		}
+	}()
+	_, err := io.WriteString(client, ClientPreface)
+	require.NoError(t, err)
+	c := newTestConn(t, client, bufio.NewReader(client))
+	c.handshake(settings...)
+	return c
+}
+
+func newTestConn(t *testing.T, conn net.Conn, reader *bufio.Reader) *testConn {
+	return &testConn{t: t, conn: conn, reader: reader, decoder: hpack.NewDecoder(4096, 0)}
+}
+
+func (c *testConn) handshake(settings ...setting) {
+	c.writeFrame(frameSettings, 0, 0, appendSettings(nil, settings...))
+	f := c.readFrame()
+	require.Equal(c.t, frameSettings, f.typ)
+	require.False(c.t, f.has(flagAck))
+	f = c.readFrame()
+	require.Equal(c.t, frameSettings, f.typ)
+	require.True(c.t, f.has(flagAck))
+}
+
+func (c *testConn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) {
+	_, err := c.conn.Write(appendFrame(nil, typ, flags, streamID, payload))
+	require.NoError(c.t, err)
+}
+
+func (c *testConn) writeHeaders(streamID uint32, endStream bool, nameValues ...string) {
+	var fields []hpack.HeaderField
+	for i := 0; i < len(nameValues); i += 2 {
+		fields = append(fields, hpack.HeaderField{Name: nameValues[i], Value: nameValues[i+1]})
+	}
+	flags := uint8(flagEndHeaders)
+	if endStream {
+		flags |= flagEndStream
+	}
+	c.writeFrame(frameHeaders, flags, streamID, hpack.Encoder{}.Encode(nil, fields))
+}
+
+func (c *testConn) readFrame() frame {
+	f, err := readFrame(c.reader, maxFrameSizeLimit)
+	require.NoError(c.t, err)
+	return f
+}
+
+// readResponse reads the frames of one stream's response, skipping flow
+// control updates.
+func (c *testConn) readResponse(streamID uint32) testResponse {
+	var resp testResponse
+	var body strings.Builder
+	for {
+		f := c.readFrame()
+		if f.typ == frameWindowUpdate {
+			continue
+		}
+		require.Equal(c.t, streamID, f.streamID, "frame %v", f.typ)
+		switch f.typ {
+		case frameHeaders:
+			fields, err := c.decoder.Decode(f.payload)
+			require.NoError(c.t, err)
+			m := map[string]string{}
+			for _, field := range fields {
+				m[field.Name] = field.Value
+			}
+			if resp.headers == nil {
+				resp.headers = m
+			} else {
+				resp.trailers = m
+			}
+		case frameData:
+			body.Write(f.payload)
+		default:
+			require.Fail(c.t, fmt.Sprintf("unexpected frame type %d", f.typ))
+		}
+		if f.has(flagEndStream) {
+			resp.body = body.String()
+			return resp
+		}
+	}
+}
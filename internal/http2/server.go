@@ -0,0 +1,158 @@
+package http2
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+)
+
+// ClientPreface is what a client sends first on an HTTP/2 connection
+// (RFC 9113 section 3.4).
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// DefaultMaxConcurrentStreams is the stream limit advertised when
+// Server.MaxConcurrentStreams is zero.
+const DefaultMaxConcurrentStreams = 100
+
+// DefaultMaxRequestBodySize is the largest request body accepted when
+// Server.MaxRequestBodySize is zero.
+const DefaultMaxRequestBodySize = 10 << 20
+
+const (
+	// headerTableSize is the HPACK dynamic table size this server allows
+	// peers to use, which is the protocol default.
+	headerTableSize = 4096
+	// maxHeaderListSize bounds the decoded size of a request's headers.
+	maxHeaderListSize = 1 << 20
+)
+
+// Handler serves one stream. It has the same shape as server.Handler, so
+// server handlers convert directly.
+type Handler func(w *response.Writer, req *request.Request)
+
+// Server holds the configuration shared by the HTTP/2 connections of one
+// server.
+type Server struct {
+	Handler Handler
+	// BaseContext is the parent of every stream's context. Defaults to
+	// context.Background.
+	BaseContext context.Context
+	// Shutdown, when closed, makes connections send GOAWAY, finish the
+	// streams already started and close.
+	Shutdown <-chan struct{}
+	// MaxConcurrentStreams limits the streams a client may have open at
+	// once. Zero selects DefaultMaxConcurrentStreams.
+	MaxConcurrentStreams uint32
+	// MaxRequestBodySize limits the size of a request body, which is held
+	// in memory until the request is complete. Larger requests get 413.
+	// Zero selects DefaultMaxRequestBodySize.
+	MaxRequestBodySize int64
+	// ConnState, if set, is called with active true when a connection
+	// goes from no open streams to one, and false when it goes back. It
+	// is called with the connection's lock held and must return quickly.
+	ConnState func(conn net.Conn, active bool)
+}
+
+// MatchPreface reads from r until it can tell whether the client sent the
+// HTTP/2 connection preface. It returns what it read, which the caller
+// must replay to an HTTP/1 parser when the preface did not match. Only
+// one read is needed unless the client's first bytes look like the
+// preface.
+func MatchPreface(r io.Reader) (read []byte, matched bool, err error) {
+	buf := make([]byte, len(ClientPreface))
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if string(buf[:n]) != ClientPreface[:n] {
+			return buf[:n], false, nil
+		}
+		if err != nil {
+			return buf[:n], false, err
+		}
+	}
+	return buf, true, nil
+}
+
+// ServeConn serves HTTP/2 on a connection whose client preface has
+// already been read. buffered holds bytes read from conn after the
+// preface. It returns when the connection is closed.
+func (s *Server) ServeConn(conn net.Conn, buffered []byte) error {
+	sc := newServerConn(s, conn, buffered)
+	if err := sc.writeServerPreface(); err != nil {
+		conn.Close()
+		return err
+	}
+	return sc.serve()
+}
+
+// IsUpgradeRequest reports whether req asks to switch to h2c with
+// "Upgrade: h2c" and an HTTP2-Settings header (RFC 7540 section 3.2).
+func IsUpgradeRequest(req *request.Request) bool {
+	_, hasSettings := req.Headers.Get("HTTP2-Settings")
+	return hasSettings &&
+		hasToken(req, "Upgrade", "h2c") &&
+		hasToken(req, "Connection", "upgrade") &&
+		hasToken(req, "Connection", "http2-settings")
+}
+
+// ServeUpgrade switches a connection to HTTP/2 in response to an h2c
+// upgrade request, which becomes stream 1. buffered holds bytes read from
+// conn after the request.
+func (s *Server) ServeUpgrade(conn net.Conn, buffered []byte, req *request.Request) error {
+	encoded, _ := req.Headers.Get("HTTP2-Settings")
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(encoded), "="))
+	if err != nil {
+		return s.rejectUpgrade(conn, "invalid HTTP2-Settings header")
+	}
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return s.rejectUpgrade(conn, "invalid HTTP2-Settings header")
+	}
+
+	sc := newServerConn(s, conn, buffered)
+	if err := sc.applySettings(settings); err != nil {
+		return s.rejectUpgrade(conn, err.Error())
+	}
+
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err := sc.writeServerPreface(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// The client's preface follows the 101 response.
+	if err := sc.readClientPreface(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	sc.startUpgradeStream(req)
+	return sc.serve()
+}
+
+func (s *Server) rejectUpgrade(conn net.Conn, reason string) error {
+	body := reason
+	fmt.Fprintf(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: %d\r\nConnection: close\r\nContent-Type: text/plain\r\n\r\n%s", len(body), body)
+	conn.Close()
+	return fmt.Errorf("http2: upgrade failed: %s", reason)
+}
+
+func hasToken(req *request.Request, name, token string) bool {
+	value, _ := req.Headers.Get(name)
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
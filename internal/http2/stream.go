@@ -0,0 +1,339 @@
+package http2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/http2/hpack"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// stream is one request and its response. It is the response.Sink its
+// handler writes through, turning the response into HEADERS and DATA
+// frames.
+type stream struct {
+	id     uint32
+	sc     *serverConn
+	req    *request.Request
+	body   []byte
+	cancel context.CancelFunc
+
+	// Only touched by the connection's read loop. remoteClosed is set once
+	// the whole request has arrived. recvWindow is the DATA the peer may
+	// still send, and contentLength the declared body length, or -1.
+	remoteClosed  bool
+	recvWindow    int64
+	contentLength int64
+
+	// Guarded by sc.mu.
+	sendWindow int64
+	reset      bool
+
+	// Only touched by the handler's goroutine.
+	status          response.StatusCode
+	headersSent     bool
+	endSent         bool
+	trailerDeclared bool
+}
+
+func (st *stream) run() {
+	defer st.sc.handlers.Done()
+	defer st.finish()
+
+	w := response.NewSinkWriter(st)
+	st.sc.srv.Handler(w, st.req)
+}
+
+// finish ends the response once the handler has returned, and forgets the
+// stream.
+func (st *stream) finish() {
+	defer st.sc.closeStream(st)
+
+	if st.isReset() {
+		return
+	}
+	if !st.headersSent {
+		st.sc.writeRSTStream(st.id, errCodeInternal)
+		return
+	}
+	if !st.endSent {
+		st.writeData(nil, true)
+	}
+}
+
+func (st *stream) isReset() bool {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+	return st.reset
+}
+
+func (st *stream) WriteStatusLine(statusCode response.StatusCode) error {
+	st.status = statusCode
+	return nil
+}
+
+func (st *stream) WriteHeaders(h headers.Headers) error {
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(st.status))}}
+	fields = appendFields(fields, h)
+	_, st.trailerDeclared = h.Get("trailer")
+
+	// Responses that cannot have a body end with their headers.
+	contentLength, _ := h.Get("content-length")
+	endStream := st.req.RequestLine.Method == "HEAD" ||
+		st.status == response.StatusCodeNotModified ||
+		contentLength == "0"
+
+	if st.isReset() {
+		return errStreamReset
+	}
+	if err := st.sc.writeHeaders(st.id, fields, endStream); err != nil {
+		return err
+	}
+	st.headersSent = true
+	st.endSent = endStream
+	return nil
+}
+
+func (st *stream) WriteBody(p []byte) (int, error) {
+	return st.writeData(p, false)
+}
+
+func (st *stream) WriteChunkedBody(p []byte) (int, error) {
+	return st.writeData(p, false)
+}
+
+// WriteChunkedBodyDone ends the stream, unless trailers were declared and
+// will end it instead. HTTP/2 frames the body itself, so there is no last
+// chunk to send.
+func (st *stream) WriteChunkedBodyDone() (int, error) {
+	if st.trailerDeclared {
+		return 0, nil
+	}
+	_, err := st.writeData(nil, true)
+	return 0, err
+}
+
+func (st *stream) WriteTrailers(h headers.Headers) error {
+	if st.endSent {
+		return nil
+	}
+	if len(h) == 0 {
+		_, err := st.writeData(nil, true)
+		return err
+	}
+	if st.isReset() {
+		return errStreamReset
+	}
+	if err := st.sc.writeHeaders(st.id, appendFields(nil, h), true); err != nil {
+		return err
+	}
+	st.endSent = true
+	return nil
+}
+
+// writeData sends p in DATA frames as flow control allows, ending the
+// stream after it when end is set. A body written after the stream has
+// ended, such as one for a HEAD request, is discarded.
+func (st *stream) writeData(p []byte, end bool) (int, error) {
+	if st.endSent {
+		return len(p), nil
+	}
+
+	sc := st.sc
+	written := 0
+	for {
+		sc.mu.Lock()
+		for len(p) > 0 && !sc.closed && !st.reset && (st.sendWindow <= 0 || sc.sendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if sc.closed {
+			sc.mu.Unlock()
+			return written, errConnClosed
+		}
+		if st.reset {
+			sc.mu.Unlock()
+			return written, errStreamReset
+		}
+		n := int(min(int64(len(p)), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameSize)))
+		st.sendWindow -= int64(n)
+		sc.sendWindow -= int64(n)
+		sc.mu.Unlock()
+
+		chunk := p[:n]
+		p = p[n:]
+		var flags uint8
+		if end && len(p) == 0 {
+			flags = flagEndStream
+		}
+		if err := sc.writeFrame(frameData, flags, st.id, chunk); err != nil {
+			return written, err
+		}
+		written += n
+		if flags != 0 {
+			st.endSent = true
+		}
+		if len(p) == 0 {
+			return written, nil
+		}
+	}
+}
+
+// appendFields converts headers to HTTP/2 fields in a stable order,
+// dropping those that only apply to HTTP/1 connections.
+func appendFields(fields []hpack.HeaderField, h headers.Headers) []hpack.HeaderField {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if isConnectionHeader(lower) {
+			continue
+		}
+		fields = append(fields, hpack.HeaderField{Name: lower, Value: h[name]})
+	}
+	return fields
+}
+
+// isConnectionHeader reports whether name is a header that HTTP/2 forbids
+// (RFC 9113 section 8.2.2).
+func isConnectionHeader(name string) bool {
+	switch name {
+	case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+		return true
+	}
+	return false
+}
+
+var errMalformedRequest = errors.New("malformed request")
+
+// requestFromFields builds a request from a decoded header block, checking
+// the rules of RFC 9113 section 8.3.
+func requestFromFields(fields []hpack.HeaderField) (*request.Request, error) {
+	req := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "2"},
+		Headers:     headers.NewHeaders(),
+	}
+
+	var (
+		scheme, authority string
+		cookies           []string
+		regular           bool
+		seen              = map[string]bool{}
+	)
+	for _, f := range fields {
+		if err := checkField(f); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, fmt.Errorf("%w: pseudo-header %s after regular headers", errMalformedRequest, f.Name)
+			}
+			if seen[f.Name] {
+				return nil, fmt.Errorf("%w: duplicate %s", errMalformedRequest, f.Name)
+			}
+			seen[f.Name] = true
+			switch f.Name {
+			case ":method":
+				req.RequestLine.Method = f.Value
+			case ":path":
+				req.RequestLine.RequestTarget = f.Value
+			case ":scheme":
+				scheme = f.Value
+			case ":authority":
+				authority = f.Value
+			default:
+				return nil, fmt.Errorf("%w: unknown pseudo-header %s", errMalformedRequest, f.Name)
+			}
+			continue
+		}
+
+		regular = true
+		if f.Name != strings.ToLower(f.Name) {
+			return nil, fmt.Errorf("%w: uppercase header name %s", errMalformedRequest, f.Name)
+		}
+		if isConnectionHeader(f.Name) || (f.Name == "te" && f.Value != "trailers") {
+			return nil, fmt.Errorf("%w: connection-specific header %s", errMalformedRequest, f.Name)
+		}
+		if f.Name == "cookie" {
+			// Cookies may be split into several fields to compress
+			// better (RFC 9113 section 8.2.3).
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		req.Headers.Set(f.Name, f.Value)
+	}
+
+	method := req.RequestLine.Method
+	if method == "" {
+		return nil, fmt.Errorf("%w: missing :method", errMalformedRequest)
+	}
+	for _, c := range method {
+		if c < 'A' || c > 'Z' {
+			return nil, fmt.Errorf("%w: invalid method %s", errMalformedRequest, method)
+		}
+	}
+	if method == "CONNECT" {
+		if authority == "" || scheme != "" || req.RequestLine.RequestTarget != "" {
+			return nil, fmt.Errorf("%w: CONNECT needs only :authority", errMalformedRequest)
+		}
+		req.RequestLine.RequestTarget = authority
+	} else if scheme == "" || req.RequestLine.RequestTarget == "" {
+		return nil, fmt.Errorf("%w: missing :scheme or :path", errMalformedRequest)
+	} else if !validPath(req.RequestLine.RequestTarget, method) {
+		return nil, fmt.Errorf("%w: invalid :path %q", errMalformedRequest, req.RequestLine.RequestTarget)
+	}
+
+	if len(cookies) > 0 {
+		req.Headers.Override("cookie", strings.Join(cookies, "; "))
+	}
+	if _, ok := req.Headers.Get("host"); !ok && authority != "" {
+		req.Headers.Set("host", authority)
+	}
+	return req, nil
+}
+
+// checkField rejects the characters RFC 9113 section 8.2.1 forbids in a
+// field. Requests are turned back into HTTP/1.1 when proxied, where a CR
+// or LF would let a client add headers or requests of its own.
+func checkField(f hpack.HeaderField) error {
+	name := strings.TrimPrefix(f.Name, ":")
+	if name == "" {
+		return fmt.Errorf("%w: empty header name", errMalformedRequest)
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c <= ' ' || c == ':' || c >= 0x7f {
+			return fmt.Errorf("%w: invalid header name %q", errMalformedRequest, f.Name)
+		}
+	}
+	if strings.ContainsAny(f.Value, "\r\n\x00") {
+		return fmt.Errorf("%w: invalid value for %s", errMalformedRequest, f.Name)
+	}
+	if strings.Trim(f.Value, " \t") != f.Value {
+		return fmt.Errorf("%w: whitespace around the value of %s", errMalformedRequest, f.Name)
+	}
+	return nil
+}
+
+// validPath reports whether path can be a request target: "*" for OPTIONS,
+// otherwise an origin-form path without spaces or control characters.
+func validPath(path, method string) bool {
+	if path == "*" {
+		return method == "OPTIONS"
+	}
+	if !strings.HasPrefix(path, "/") {
+		return false
+	}
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,338 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the Prometheus text exposition format
+// written by Registry.WriteText.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// DurationBuckets are histogram bounds, in seconds, suited to request
+	// latencies.
+	DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	// SizeBuckets are histogram bounds, in bytes, suited to message sizes.
+	SizeBuckets = []float64{100, 1000, 10_000, 100_000, 1_000_000, 10_000_000, 100_000_000}
+)
+
+// labelSep joins label values into map keys. It cannot appear in valid
+// UTF-8, so distinct value lists never collide.
+const labelSep = "\xff"
+
+// metric is one metric family: a name, help text and its series.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics and writes them in the text exposition format.
+// Metrics are written in the order they were registered.
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes every registered metric to w.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// family holds what every metric type shares: its name, help text, label
+// names and the series for each combination of label values seen so far.
+type family[S any] struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*S
+	newS   func() *S
+}
+
+func (f *family[S]) get(values []string) *S {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, labelSep)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = f.newS()
+		f.series[key] = s
+	}
+	return s
+}
+
+// each calls fn for every series in label order while holding the lock.
+func (f *family[S]) each(fn func(values []string, s *S)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		var values []string
+		if len(f.labels) > 0 {
+			values = strings.Split(k, labelSep)
+		}
+		fn(values, f.series[k])
+	}
+}
+
+func (f *family[S]) writeHeader(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, typ)
+}
+
+func newFamily[S any](name, help string, labels []string, newS func() *S) family[S] {
+	return family[S]{name: name, help: help, labels: labels, series: make(map[string]*S), newS: newS}
+}
+
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+// Counter is a value that only goes up, partitioned by label values.
+type Counter struct {
+	family[value]
+}
+
+// Counter registers a counter with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{newFamily(name, help, labels, func() *value { return new(value) })}
+	r.register(name, c)
+	return c
+}
+
+// Inc adds one to the series for the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series for the given
+// label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.name + " cannot decrease")
+	}
+	s := c.get(labelValues)
+	s.mu.Lock()
+	s.v += v
+	s.mu.Unlock()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+	c.each(func(values []string, s *value) {
+		s.mu.Lock()
+		writeSample(w, c.name, c.labels, values, "", "", s.v)
+		s.mu.Unlock()
+	})
+}
+
+// Gauge is a value that can go up and down, partitioned by label values.
+type Gauge struct {
+	family[value]
+}
+
+// Gauge registers a gauge with the given label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newFamily(name, help, labels, func() *value { return new(value) })}
+	r.register(name, g)
+	return g
+}
+
+// Set sets the series for the given label values to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	s := g.get(labelValues)
+	s.mu.Lock()
+	s.v = v
+	s.mu.Unlock()
+}
+
+// Add adds v, which may be negative, to the series for the given label
+// values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	s := g.get(labelValues)
+	s.mu.Lock()
+	s.v += v
+	s.mu.Unlock()
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.writeHeader(w, "gauge")
+	g.each(func(values []string, s *value) {
+		s.mu.Lock()
+		writeSample(w, g.name, g.labels, values, "", "", s.v)
+		s.mu.Unlock()
+	})
+}
+
+// funcMetric is an unlabelled counter or gauge whose value is read when
+// the registry is written, for values already tracked elsewhere.
+type funcMetric struct {
+	name, help, typ string
+	fn              func() float64
+}
+
+// CounterFunc registers a counter whose value is fn's result at the time
+// the metrics are written.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.register(name, &funcMetric{name: name, help: help, typ: "counter", fn: fn})
+}
+
+// GaugeFunc registers a gauge whose value is fn's result at the time the
+// metrics are written.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &funcMetric{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, escapeHelp(m.help), m.name, m.typ)
+	writeSample(w, m.name, nil, nil, "", "", m.fn())
+}
+
+type histogramSeries struct {
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations into buckets, partitioned by label values.
+type Histogram struct {
+	family[histogramSeries]
+	buckets []float64
+}
+
+// Histogram registers a histogram with the given upper bucket bounds,
+// which must be sorted, and label names. The +Inf bucket is implicit.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !slices.IsSorted(buckets) {
+		panic("metrics: buckets of " + name + " are not sorted")
+	}
+	buckets = slices.Clone(buckets)
+	h := &Histogram{
+		family: newFamily(name, help, labels, func() *histogramSeries {
+			return &histogramSeries{counts: make([]uint64, len(buckets))}
+		}),
+		buckets: buckets,
+	}
+	r.register(name, h)
+	return h
+}
+
+// Observe records v in the series for the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	s := h.get(labelValues)
+	i, _ := slices.BinarySearch(h.buckets, v)
+	s.mu.Lock()
+	if i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+	s.mu.Unlock()
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w, "histogram")
+	h.each(func(values []string, s *histogramSeries) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, h.name+"_bucket", h.labels, values, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, values, "le", "+Inf", float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, values, "", "", s.sum)
+		writeSample(w, h.name+"_count", h.labels, values, "", "", float64(s.count))
+	})
+}
+
+// writeSample writes one sample line. extraName and extraValue add a
+// trailing label, which histograms use for "le".
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, label, values[i])
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func writeLabel(w *bufio.Writer, name, value string) {
+	w.WriteString(name)
+	w.WriteString(`="`)
+	w.WriteString(labelEscaper.Replace(value))
+	w.WriteByte('"')
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
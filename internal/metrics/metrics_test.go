@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests handled.", "method", "path")
+	inFlight := r.Gauge("in_flight", "Requests in flight.")
+	latency := r.Histogram("latency_seconds", "Request latency.\nIn seconds.", []float64{0.1, 1}, "method")
+	r.GaugeFunc("up", "Whether the server is up.", func() float64 { return 1 })
+
+	requests.Inc("GET", "/b")
+	requests.Add(2, "GET", "/a")
+	requests.Inc("POST", `/"quoted"\path`+"\n")
+	inFlight.Add(3)
+	inFlight.Add(-1)
+	latency.Observe(0.05, "GET")
+	latency.Observe(0.1, "GET")
+	latency.Observe(0.5, "GET")
+	latency.Observe(7, "GET")
+
+	out := &strings.Builder{}
+	require.NoError(t, r.WriteText(out))
+
+	// Test: Families in registration order, series sorted, labels escaped
+	assert.Equal(t, `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{method="GET",path="/a"} 2
+requests_total{method="GET",path="/b"} 1
+requests_total{method="POST",path="/\"quoted\"\\path\n"} 1
+# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 2
+# HELP latency_seconds Request latency.\nIn seconds.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="GET",le="0.1"} 2
+latency_seconds_bucket{method="GET",le="1"} 3
+latency_seconds_bucket{method="GET",le="+Inf"} 4
+latency_seconds_sum{method="GET"} 7.65
+latency_seconds_count{method="GET"} 4
+# HELP up Whether the server is up.
+# TYPE up gauge
+up 1
+`, out.String())
+
+	// Test: Misuse panics
+	assert.Panics(t, func() { requests.Inc("GET") })
+	assert.Panics(t, func() { requests.Add(-1, "GET", "/a") })
+	assert.Panics(t, func() { r.Gauge("up", "Duplicate.") })
+	assert.Panics(t, func() { r.Histogram("unsorted", "Unsorted.", []float64{1, 0.5}) })
+}
@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/client"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy decides which backend a Balancer sends a request to.
+type Strategy int
+
+const (
+	// RoundRobin sends requests to each backend in turn.
+	RoundRobin Strategy = iota
+	// LeastConnections sends a request to the backend with the fewest
+	// requests in flight.
+	LeastConnections
+	// ConsistentHash sends requests with the same key, the value of
+	// BalancerConfig.HashHeader or else the client IP, to the same
+	// backend for as long as it is available.
+	ConsistentHash
+)
+
+// ParseStrategy returns the Strategy named by s: "round-robin",
+// "least-conn" or "hash".
+func ParseStrategy(s string) (Strategy, error) {
+	switch strings.ToLower(s) {
+	case "round-robin", "roundrobin", "rr":
+		return RoundRobin, nil
+	case "least-conn", "least-connections":
+		return LeastConnections, nil
+	case "hash", "consistent-hash":
+		return ConsistentHash, nil
+	}
+	return 0, fmt.Errorf("unknown balancing strategy: %q", s)
+}
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultMaxFailures         = 3
+	DefaultEjectionTime        = 30 * time.Second
+)
+
+// hashReplicas is the number of points each backend has on the hash ring.
+// More points spread keys more evenly.
+const hashReplicas = 100
+
+// ringHash places key on the hash ring. Keys such as "user-1" and
+// "user-2" differ in few bits, which a checksum like CRC-32 maps close
+// together, so a cryptographic hash is used to spread them.
+func ringHash(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+type BalancerConfig struct {
+	// Targets are the backends. Each is used like ReverseConfig.Target.
+	Targets  []*url.URL
+	Strategy Strategy
+	// HashHeader names the header whose value is the ConsistentHash key.
+	// Requests without it, or all requests when it is empty, are keyed
+	// by client IP.
+	HashHeader string
+
+	// HealthCheckPath, if set, is requested from every backend each
+	// HealthCheckInterval. A backend answering with anything but a 2xx or
+	// 3xx status, or not within HealthCheckTimeout, gets no requests
+	// until a later check passes.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	// MaxFailures consecutive failed requests eject a backend for
+	// EjectionTime. Failing to get a response counts as a failure, as do
+	// 502, 503 and 504 responses.
+	MaxFailures  int
+	EjectionTime time.Duration
+
+	// Client sends the health checks. When nil, a client without a
+	// connection pool is used.
+	Client *client.Client
+}
+
+// Balancer spreads requests over a set of backends for a reverse proxy,
+// skipping those that fail health checks or keep failing requests.
+type Balancer struct {
+	cfg      BalancerConfig
+	backends []*backend
+	ring     []ringPoint
+	next     atomic.Uint64
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+type backend struct {
+	url    *url.URL
+	active atomic.Int64
+
+	mu           sync.Mutex
+	healthy      bool
+	failures     int
+	ejectedUntil time.Time
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// BackendStatus describes the state of one of a Balancer's backends.
+type BackendStatus struct {
+	URL string
+	// Healthy is false while the backend fails active health checks.
+	Healthy bool
+	// Ejected is true while the backend is ejected for failing requests.
+	Ejected bool
+	// Active is the number of requests in flight to the backend.
+	Active int64
+}
+
+// NewBalancer returns a balancer over cfg.Targets and starts its health
+// checks. Close stops them.
+func NewBalancer(cfg BalancerConfig) (*Balancer, error) {
+	if len(cfg.Targets) == 0 {
+		return nil, errors.New("proxy: balancer has no targets")
+	}
+	if cfg.HealthCheckInterval <= 0 {
+		cfg.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if cfg.HealthCheckTimeout <= 0 {
+		cfg.HealthCheckTimeout = DefaultHealthCheckTimeout
+	}
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = DefaultMaxFailures
+	}
+	if cfg.EjectionTime <= 0 {
+		cfg.EjectionTime = DefaultEjectionTime
+	}
+	if cfg.Client == nil {
+		cfg.Client = &client.Client{}
+	}
+
+	b := &Balancer{
+		cfg:  cfg,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for _, target := range cfg.Targets {
+		if target.Host == "" {
+			return nil, fmt.Errorf("proxy: target %q has no host", target)
+		}
+		be := &backend{url: target, healthy: true}
+		b.backends = append(b.backends, be)
+		for i := range hashReplicas {
+			key := target.String() + "#" + strconv.Itoa(i)
+			b.ring = append(b.ring, ringPoint{hash: ringHash(key), backend: be})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+
+	if cfg.HealthCheckPath != "" {
+		go b.checkHealth()
+	} else {
+		close(b.done)
+	}
+	return b, nil
+}
+
+// Close stops the health checks.
+func (b *Balancer) Close() {
+	b.stopOnce.Do(func() { close(b.stop) })
+	<-b.done
+}
+
+// Status returns the state of each backend, in the order of cfg.Targets.
+func (b *Balancer) Status() []BackendStatus {
+	now := time.Now()
+	status := make([]BackendStatus, len(b.backends))
+	for i, be := range b.backends {
+		be.mu.Lock()
+		status[i] = BackendStatus{
+			URL:     be.url.String(),
+			Healthy: be.healthy,
+			Ejected: now.Before(be.ejectedUntil),
+			Active:  be.active.Load(),
+		}
+		be.mu.Unlock()
+	}
+	return status
+}
+
+// pick chooses an available backend for req other than those in tried,
+// or returns nil when there is none.
+func (b *Balancer) pick(req *request.Request, tried []*backend) *backend {
+	now := time.Now()
+	usable := func(be *backend) bool {
+		return be.available(now) && !slices.Contains(tried, be)
+	}
+
+	switch b.cfg.Strategy {
+	case ConsistentHash:
+		key := clientIP(req)
+		if b.cfg.HashHeader != "" {
+			if value, ok := req.Headers.Get(b.cfg.HashHeader); ok {
+				key = value
+			}
+		}
+		h := ringHash(key)
+		start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+		for i := range b.ring {
+			be := b.ring[(start+i)%len(b.ring)].backend
+			if usable(be) {
+				return be
+			}
+		}
+		return nil
+	case LeastConnections:
+		// Ties go round-robin, so idle backends share the load.
+		offset := int(b.next.Add(1) - 1)
+		var best *backend
+		for i := range b.backends {
+			be := b.backends[(offset+i)%len(b.backends)]
+			if usable(be) && (best == nil || be.active.Load() < best.active.Load()) {
+				best = be
+			}
+		}
+		return best
+	default:
+		offset := int(b.next.Add(1) - 1)
+		for i := range b.backends {
+			be := b.backends[(offset+i)%len(b.backends)]
+			if usable(be) {
+				return be
+			}
+		}
+		return nil
+	}
+}
+
+// observe records the outcome of a request to be: a failure when there is
+// no response or statusCode is 502, 503 or 504.
+func (b *Balancer) observe(be *backend, statusCode response.StatusCode, err error) {
+	failed := err != nil || statusCode == response.StatusCodeBadGateway ||
+		statusCode == response.StatusCodeServiceUnavailable || statusCode == response.StatusCodeGatewayTimeout
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if !failed {
+		be.failures = 0
+		return
+	}
+	be.failures++
+	if be.failures >= b.cfg.MaxFailures {
+		be.failures = 0
+		be.ejectedUntil = time.Now().Add(b.cfg.EjectionTime)
+	}
+}
+
+func (b *Balancer) checkHealth() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, be := range b.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				healthy := b.probe(be)
+				be.mu.Lock()
+				be.healthy = healthy
+				be.mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe requests the health check path from be.
+func (b *Balancer) probe(be *backend) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), b.cfg.HealthCheckTimeout)
+	defer cancel()
+	target, ok := upstreamURL(be.url, "", b.cfg.HealthCheckPath)
+	if !ok {
+		return false
+	}
+	resp, err := b.cfg.Client.Get(ctx, target)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	code := resp.StatusLine.StatusCode
+	return code >= 200 && code < 400
+}
+
+func (be *backend) available(now time.Time) bool {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	return be.healthy && !now.Before(be.ejectedUntil)
+}
+
+// clientIP returns the IP address req came from, or "" when unknown.
+func clientIP(req *request.Request) string {
+	if req.RemoteAddr == nil {
+		return ""
+	}
+	ip := req.RemoteAddr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/client"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoundRobin(t *testing.T) {
+	front, _ := balanced(t, BalancerConfig{}, 0, named("a"), named("b"), named("c"))
+
+	// Test: Backends take requests in turn
+	var got []string
+	for range 6 {
+		_, body := fetch(t, "GET", front+"/", nil)
+		got = append(got, body)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, got)
+}
+
+func TestLeastConnections(t *testing.T) {
+	release := make(chan struct{})
+	slowOrNamed := func(name string) func(*response.Writer, *request.Request) {
+		return func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.RequestTarget == "/slow" {
+				<-release
+			}
+			writeText(w, response.StatusCodeOK, name)
+		}
+	}
+	front, balancer := balanced(t, BalancerConfig{Strategy: LeastConnections}, 0, slowOrNamed("a"), slowOrNamed("b"))
+
+	slowDone := make(chan string)
+	go func() {
+		_, body := fetch(t, "GET", front+"/slow", nil)
+		slowDone <- body
+	}()
+	require.Eventually(t, func() bool {
+		status := balancer.Status()
+		return status[0].Active+status[1].Active == 1
+	}, time.Second, 5*time.Millisecond)
+	busy := "a"
+	if balancer.Status()[1].Active == 1 {
+		busy = "b"
+	}
+
+	// Test: Requests avoid the backend with one in flight
+	for range 4 {
+		_, body := fetch(t, "GET", front+"/", nil)
+		assert.NotEqual(t, busy, body)
+	}
+	close(release)
+	assert.Equal(t, busy, <-slowDone)
+}
+
+func TestConsistentHash(t *testing.T) {
+	front, _ := balanced(t, BalancerConfig{Strategy: ConsistentHash, HashHeader: "X-User"}, 0,
+		named("a"), named("b"), named("c"))
+
+	// Test: A key always reaches the same backend, and keys spread out
+	mapping := map[string]string{}
+	seen := map[string]bool{}
+	for i := range 30 {
+		user := fmt.Sprint("user-", i)
+		_, body := fetch(t, "GET", front+"/", map[string]string{"X-User": user})
+		mapping[user] = body
+		seen[body] = true
+	}
+	for user, backend := range mapping {
+		_, body := fetch(t, "GET", front+"/", map[string]string{"X-User": user})
+		assert.Equal(t, backend, body)
+	}
+	assert.Len(t, seen, 3)
+
+	// Test: Without the header, the client IP is the key
+	_, first := fetch(t, "GET", front+"/", nil)
+	for range 5 {
+		_, body := fetch(t, "GET", front+"/", nil)
+		assert.Equal(t, first, body)
+	}
+}
+
+func TestConsistentHashFailover(t *testing.T) {
+	addrs := []string{serve(t, named("a")), serve(t, named("b")), downAddr(t)}
+	front, _ := balancedAddrs(t, BalancerConfig{Strategy: ConsistentHash, HashHeader: "X-User"}, 2, addrs)
+
+	// Test: Keys of a backend that is down move elsewhere and other keys
+	// stay where they are
+	for i := range 30 {
+		user := fmt.Sprint("user-", i)
+		code, body := fetch(t, "GET", front+"/", map[string]string{"X-User": user})
+		assert.Equal(t, response.StatusCodeOK, code)
+		_, again := fetch(t, "GET", front+"/", map[string]string{"X-User": user})
+		assert.Equal(t, body, again)
+	}
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	var sick atomic.Bool
+	flaky := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/health" && sick.Load() {
+			writeText(w, response.StatusCodeServiceUnavailable, "sick")
+			return
+		}
+		writeText(w, response.StatusCodeOK, "flaky")
+	}
+	front, balancer := balanced(t, BalancerConfig{
+		HealthCheckPath:     "/health",
+		HealthCheckInterval: 10 * time.Millisecond,
+	}, 0, named("steady"), flaky)
+
+	// Test: A backend failing its health check gets no requests
+	sick.Store(true)
+	require.Eventually(t, func() bool { return !balancer.Status()[1].Healthy }, time.Second, 5*time.Millisecond)
+	for range 4 {
+		_, body := fetch(t, "GET", front+"/", nil)
+		assert.Equal(t, "steady", body)
+	}
+
+	// Test: It is used again once it passes
+	sick.Store(false)
+	require.Eventually(t, func() bool { return balancer.Status()[1].Healthy }, time.Second, 5*time.Millisecond)
+	seen := map[string]bool{}
+	for range 4 {
+		_, body := fetch(t, "GET", front+"/", nil)
+		seen[body] = true
+	}
+	assert.True(t, seen["flaky"])
+}
+
+func TestPassiveEjection(t *testing.T) {
+	addrs := []string{serve(t, named("up")), downAddr(t)}
+	front, balancer := balancedAddrs(t, BalancerConfig{MaxFailures: 2, EjectionTime: time.Minute}, 0, addrs)
+
+	// Test: A backend is ejected after consecutive failures
+	var codes []response.StatusCode
+	for range 4 {
+		code, _ := fetch(t, "GET", front+"/", nil)
+		codes = append(codes, code)
+	}
+	assert.Equal(t, []response.StatusCode{200, 502, 200, 502}, codes)
+	assert.True(t, balancer.Status()[1].Ejected)
+	for range 4 {
+		code, body := fetch(t, "GET", front+"/", nil)
+		assert.Equal(t, response.StatusCodeOK, code)
+		assert.Equal(t, "up", body)
+	}
+
+	// Test: 5xx responses from the gateway range count as failures
+	front, balancer = balanced(t, BalancerConfig{MaxFailures: 1}, 0, func(w *response.Writer, req *request.Request) {
+		writeText(w, response.StatusCodeServiceUnavailable, "busy")
+	}, named("ok"))
+	code, _ := fetch(t, "GET", front+"/", nil)
+	assert.Equal(t, response.StatusCodeServiceUnavailable, code)
+	assert.True(t, balancer.Status()[0].Ejected)
+
+	// Test: With every backend ejected there is nothing to answer
+	front, _ = balancedAddrs(t, BalancerConfig{MaxFailures: 1}, 0, []string{downAddr(t)})
+	code, _ = fetch(t, "GET", front+"/", nil)
+	assert.Equal(t, response.StatusCodeBadGateway, code)
+	code, _ = fetch(t, "GET", front+"/", nil)
+	assert.Equal(t, response.StatusCodeServiceUnavailable, code)
+}
+
+func TestRetries(t *testing.T) {
+	addrs := []string{downAddr(t), serve(t, named("up"))}
+	front, _ := balancedAddrs(t, BalancerConfig{MaxFailures: 100}, 1, addrs)
+
+	// Test: Idempotent requests are retried on another backend
+	for range 4 {
+		code, body := fetch(t, "GET", front+"/", nil)
+		assert.Equal(t, response.StatusCodeOK, code)
+		assert.Equal(t, "up", body)
+	}
+
+	// Test: Other requests are not
+	var codes []response.StatusCode
+	for range 2 {
+		code, _ := fetch(t, "POST", front+"/", nil)
+		codes = append(codes, code)
+	}
+	assert.Contains(t, codes, response.StatusCodeBadGateway)
+	assert.Contains(t, codes, response.StatusCodeOK)
+}
+
+func TestNewBalancer(t *testing.T) {
+	// Test: Targets are required and must have a host
+	_, err := NewBalancer(BalancerConfig{})
+	assert.Error(t, err)
+	_, err = NewBalancer(BalancerConfig{Targets: []*url.URL{{Path: "/x"}}})
+	assert.Error(t, err)
+}
+
+func TestParseStrategy(t *testing.T) {
+	for s, want := range map[string]Strategy{"round-robin": RoundRobin, "least-conn": LeastConnections, "HASH": ConsistentHash} {
+		got, err := ParseStrategy(s)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := ParseStrategy("random")
+	assert.Error(t, err)
+}
+
+// named returns a handler answering with name.
+func named(name string) func(*response.Writer, *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		writeText(w, response.StatusCodeOK, name)
+	}
+}
+
+// balanced starts a backend for each handler and a proxy balancing over
+// them, and returns the proxy's URL.
+func balanced(t *testing.T, cfg BalancerConfig, retries int, handlers ...func(*response.Writer, *request.Request)) (string, *Balancer) {
+	var addrs []string
+	for _, h := range handlers {
+		addrs = append(addrs, serve(t, h))
+	}
+	return balancedAddrs(t, cfg, retries, addrs)
+}
+
+func balancedAddrs(t *testing.T, cfg BalancerConfig, retries int, addrs []string) (string, *Balancer) {
+	for _, addr := range addrs {
+		cfg.Targets = append(cfg.Targets, mustParse(t, "http://"+addr))
+	}
+	balancer, err := NewBalancer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(balancer.Close)
+	front := serve(t, NewReverse(ReverseConfig{Balancer: balancer, Retries: retries}))
+	return "http://" + front, balancer
+}
+
+// downAddr returns an address nothing listens on.
+func downAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func fetch(t *testing.T, method, rawURL string, h map[string]string) (response.StatusCode, string) {
+	req, err := client.NewRequest(context.Background(), method, rawURL, nil)
+	require.NoError(t, err)
+	for k, v := range h {
+		req.Headers.Set(k, v)
+	}
+	resp, err := client.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusLine.StatusCode, strings.TrimSpace(string(body))
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/peeta98/httpfromtcp/internal/client"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTunnelDialTimeout bounds connecting to the destination of a
+	// CONNECT request when ForwardConfig.DialTimeout is zero.
+	DefaultTunnelDialTimeout = 30 * time.Second
+	// DefaultTunnelIdleTimeout closes a tunnel nothing has been sent
+	// through when ForwardConfig.IdleTimeout is zero.
+	DefaultTunnelIdleTimeout = 5 * time.Minute
+)
+
+type ForwardConfig struct {
+	// Allow lists the destinations requests may go to, each "host" for
+	// any port or "host:port". A host of "*.example.com" matches any
+	// subdomain of example.com and "*" any host. When empty, every
+	// destination is allowed.
+	Allow []string
+	// Authenticate, if set, checks the credentials of the Basic scheme
+	// sent in Proxy-Authorization. Requests without valid credentials get
+	// 407.
+	Authenticate func(username, password string) bool
+	// Realm is sent in the Proxy-Authenticate challenge. Defaults to
+	// "proxy".
+	Realm string
+	// Client sends forwarded requests. When nil, a client with its own
+	// connection pool is used.
+	Client *client.Client
+	// DialTimeout bounds connecting to the destination of a CONNECT
+	// request. Zero means DefaultTunnelDialTimeout.
+	DialTimeout time.Duration
+	// IdleTimeout closes a tunnel once nothing has been sent through it
+	// either way for that long. Zero means DefaultTunnelIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxTunnels limits how many tunnels may be open at once; more CONNECT
+	// requests get 503. A tunnel's connection is hijacked, so it no longer
+	// counts towards the server's connection limit. Zero means no limit.
+	MaxTunnels int
+	// Via is the name added to the Via header of forwarded requests and
+	// responses. Defaults to DefaultVia.
+	Via string
+}
+
+// NewForward returns a handler for a forward proxy. Requests in absolute
+// form, such as "GET http://example.com/ HTTP/1.1", are sent on to their
+// destination and the responses relayed. A CONNECT request opens a tunnel
+// to the host and port it names and splices bytes between it and the
+// client until either side closes. Requests in origin form get 400.
+func NewForward(cfg ForwardConfig) server.Handler {
+	if cfg.Client == nil {
+		cfg.Client = &client.Client{Pool: &client.Pool{}}
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = DefaultTunnelDialTimeout
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = DefaultTunnelIdleTimeout
+	}
+	var tunnels chan struct{}
+	if cfg.MaxTunnels > 0 {
+		tunnels = make(chan struct{}, cfg.MaxTunnels)
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = "proxy"
+	}
+	if cfg.Via == "" {
+		cfg.Via = DefaultVia
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		if !authorized(w, req, cfg) {
+			return
+		}
+		if req.RequestLine.Method == "CONNECT" {
+			serveConnect(w, req, cfg, tunnels)
+			return
+		}
+		serveForward(w, req, cfg)
+	}
+}
+
+// IsForwardRequest reports whether req is meant for a forward proxy: a
+// CONNECT request or one with an absolute-form target.
+func IsForwardRequest(req *request.Request) bool {
+	target := req.RequestLine.RequestTarget
+	return req.RequestLine.Method == "CONNECT" ||
+		strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+func serveForward(w *response.Writer, req *request.Request, cfg ForwardConfig) {
+	u, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, response.StatusCodeBadRequest, "Proxy requests need an absolute http or https URL")
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if !allowed(cfg.Allow, u.Hostname(), port) {
+		writeError(w, response.StatusCodeForbidden, "Destination not allowed")
+		return
+	}
+
+	out, err := newUpstreamRequest(req, u.String(), cfg.Via)
+	if err != nil {
+		writeError(w, response.StatusCodeBadRequest, "Bad request target")
+		return
+	}
+	// The client sets Host from the URL, which takes precedence over the
+	// Host header (RFC 9112 section 3.2.2).
+	out.Headers.Remove("Host")
+
+	resp, err := cfg.Client.Do(out)
+	if err != nil {
+		writeUpstreamError(w, req, err)
+		return
+	}
+	defer resp.Body.Close()
+	copyResponse(w, req, resp, cfg.Via)
+}
+
+func serveConnect(w *response.Writer, req *request.Request, cfg ForwardConfig, tunnels chan struct{}) {
+	host, port, err := net.SplitHostPort(req.RequestLine.RequestTarget)
+	if err != nil || host == "" || port == "" {
+		writeError(w, response.StatusCodeBadRequest, "CONNECT needs a host:port target")
+		return
+	}
+	if !allowed(cfg.Allow, host, port) {
+		writeError(w, response.StatusCodeForbidden, "Destination not allowed")
+		return
+	}
+	if tunnels != nil {
+		select {
+		case tunnels <- struct{}{}:
+			defer func() { <-tunnels }()
+		default:
+			writeError(w, response.StatusCodeServiceUnavailable, "Too many tunnels")
+			return
+		}
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		// Tunnels need the connection to themselves, which HTTP/2 streams
+		// don't have.
+		writeError(w, response.StatusCodeNotImplemented, "CONNECT is not supported on this connection")
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	ctx, cancel := context.WithTimeout(req.Context(), cfg.DialTimeout)
+	dialer := &net.Dialer{}
+	upstream, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	cancel()
+	if err != nil {
+		writeUpstreamError(response.NewWriter(conn), req, err)
+		return
+	}
+	defer upstream.Close()
+
+	// Hijacked connections don't hold up shutdown, so the tunnel is closed
+	// when the server stops.
+	stop := context.AfterFunc(req.Context(), func() {
+		conn.Close()
+		upstream.Close()
+	})
+	defer stop()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			return
+		}
+	}
+	t := &tunnel{client: conn, upstream: upstream, idle: cfg.IdleTimeout}
+	t.splice()
+}
+
+// tunnel is a CONNECT tunnel whose connections are closed once nothing has
+// been read from either for idle.
+type tunnel struct {
+	client, upstream net.Conn
+	idle             time.Duration
+}
+
+// splice copies bytes both ways until both directions are done. When one
+// side finishes sending, the other is told so with a half-close where the
+// connection supports it, so replies can still flow.
+func (t *tunnel) splice() {
+	t.extend()
+	done := make(chan struct{})
+	go func() {
+		t.copy(t.client, t.upstream)
+		close(done)
+	}()
+	t.copy(t.upstream, t.client)
+	<-done
+}
+
+// extend pushes the idle deadline of both connections back.
+func (t *tunnel) extend() {
+	deadline := time.Now().Add(t.idle)
+	t.client.SetDeadline(deadline)
+	t.upstream.SetDeadline(deadline)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func (t *tunnel) copy(dst, src net.Conn) {
+	_, err := io.Copy(dst, activityReader{src, t})
+	if err == nil {
+		if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+			return
+		}
+	}
+	// After an error, such as the idle deadline passing, or without a
+	// half-close, closing both ends stops the other direction too.
+	dst.Close()
+	src.Close()
+}
+
+// activityReader extends the tunnel's idle deadline whenever it reads
+// something.
+type activityReader struct {
+	net.Conn
+	t *tunnel
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		r.t.extend()
+	}
+	return n, err
+}
+
+// authorized checks the request's Proxy-Authorization, answering 407 when
+// it is missing or wrong.
+func authorized(w *response.Writer, req *request.Request, cfg ForwardConfig) bool {
+	if cfg.Authenticate == nil {
+		return true
+	}
+	if value, ok := req.Headers.Get("Proxy-Authorization"); ok {
+		if username, password, ok := parseBasicAuth(value); ok && cfg.Authenticate(username, password) {
+			return true
+		}
+	}
+
+	body := []byte("Proxy authentication required")
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Proxy-Authenticate", `Basic realm="`+cfg.Realm+`"`)
+	w.WriteStatusLine(response.StatusCodeProxyAuthRequired)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+	return false
+}
+
+// parseBasicAuth decodes the credentials of a Basic authorization value
+// (RFC 7617).
+func parseBasicAuth(value string) (string, string, bool) {
+	scheme, encoded, ok := strings.Cut(value, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// allowed reports whether host and port match an entry of allow, or allow
+// is empty.
+func allowed(allow []string, host, port string) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range allow {
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		entryHost = strings.ToLower(entryHost)
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		switch {
+		case entryHost == "*" || entryHost == host:
+			return true
+		case strings.HasPrefix(entryHost, "*.") && strings.HasSuffix(host, entryHost[1:]):
+			return true
+		}
+	}
+	return false
+}
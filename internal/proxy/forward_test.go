@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForwardAbsoluteForm(t *testing.T) {
+	requests := make(chan *request.Request, 1)
+	backend := serve(t, func(w *response.Writer, req *request.Request) {
+		requests <- req
+		writeText(w, response.StatusCodeOK, "from backend")
+	})
+	front := serve(t, NewForward(ForwardConfig{}))
+
+	resp := roundTrip(t, front, "GET http://"+backend+"/items?x=1 HTTP/1.1\r\n"+
+		"Host: "+backend+"\r\n"+
+		"Proxy-Connection: keep-alive\r\n"+
+		"X-Custom: kept\r\n\r\n")
+
+	// Test: The response is relayed
+	assert.Equal(t, response.StatusCodeOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "from backend", string(resp.Body))
+	assert.Equal(t, "1.1 httpfromtcp", resp.Headers["via"])
+
+	// Test: The destination gets an origin-form request without the
+	// proxy's headers
+	got := <-requests
+	assert.Equal(t, "/items?x=1", got.RequestLine.RequestTarget)
+	assert.Equal(t, backend, got.Headers["host"])
+	assert.Equal(t, "kept", got.Headers["x-custom"])
+	assert.Equal(t, "1.1 httpfromtcp", got.Headers["via"])
+	assert.NotContains(t, got.Headers, "proxy-connection")
+	assert.NotContains(t, got.Headers, "x-forwarded-for")
+
+	// Test: Origin-form requests are not proxied
+	resp = roundTrip(t, front, "GET /items HTTP/1.1\r\nHost: "+front+"\r\n\r\n")
+	assert.Equal(t, response.StatusCodeBadRequest, resp.StatusLine.StatusCode)
+}
+
+func TestForwardConnect(t *testing.T) {
+	echo := echoServer(t)
+	front := serve(t, NewForward(ForwardConfig{}))
+
+	conn, err := net.Dial("tcp", front)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Bytes sent right after the request must reach the destination too.
+	_, err = io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\nearly ")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+
+	// Test: The proxy answers 200 and then splices the connections
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+
+	_, err = io.WriteString(conn, "late")
+	require.NoError(t, err)
+	buf := make([]byte, len("early late"))
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "early late", string(buf))
+
+	// Test: Closing our side for writing ends the tunnel once the
+	// destination is done
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+}
+
+func TestForwardTunnelLifetime(t *testing.T) {
+	echo := echoServer(t)
+
+	// Test: A tunnel nothing is sent through is closed
+	front := serve(t, NewForward(ForwardConfig{IdleTimeout: 100 * time.Millisecond}))
+	conn, reader := openTunnel(t, front, echo)
+	_, err := io.WriteString(conn, "ping")
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Test: Closing the server closes its tunnels
+	srv, err := server.ServeAddr("127.0.0.1:0", NewForward(ForwardConfig{}))
+	require.NoError(t, err)
+	conn, reader = openTunnel(t, srv.Addr().String(), echo)
+	require.NoError(t, srv.Close())
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	conn.Close()
+
+	// Test: Tunnels beyond MaxTunnels get 503
+	front = serve(t, NewForward(ForwardConfig{MaxTunnels: 1}))
+	openTunnel(t, front, echo)
+	resp := roundTrip(t, front, "CONNECT "+echo+" HTTP/1.1\r\n\r\n")
+	assert.Equal(t, response.StatusCodeServiceUnavailable, resp.StatusLine.StatusCode)
+}
+
+func TestForwardConnectNotHijackable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	var dialed atomic.Bool
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			dialed.Store(true)
+			conn.Close()
+		}
+	}()
+
+	// Test: Without a connection to take over, as on HTTP/2, the answer is
+	// 501 and the destination is never dialled
+	req, err := request.RequestFromReader(strings.NewReader("CONNECT " + listener.Addr().String() + " HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	var out strings.Builder
+	NewForward(ForwardConfig{})(response.NewWriter(&out), req)
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 501 Not Implemented\r\n"), out.String())
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, dialed.Load())
+}
+
+func TestForwardConnectErrors(t *testing.T) {
+	front := serve(t, NewForward(ForwardConfig{}))
+
+	// Test: An unreachable destination gives 502
+	resp := roundTrip(t, front, "CONNECT "+downAddr(t)+" HTTP/1.1\r\n\r\n")
+	assert.Equal(t, response.StatusCodeBadGateway, resp.StatusLine.StatusCode)
+
+	// Test: A target without a port gives 400
+	resp = roundTrip(t, front, "CONNECT example.com HTTP/1.1\r\n\r\n")
+	assert.Equal(t, response.StatusCodeBadRequest, resp.StatusLine.StatusCode)
+}
+
+func TestForwardAllow(t *testing.T) {
+	echo := echoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+	backend := serve(t, named("ok"))
+	front := serve(t, NewForward(ForwardConfig{Allow: []string{"127.0.0.1:" + echoPort, "*.example.com"}}))
+
+	// Test: Destinations off the list get 403
+	resp := roundTrip(t, front, "GET http://"+backend+"/ HTTP/1.1\r\nHost: "+backend+"\r\n\r\n")
+	assert.Equal(t, response.StatusCodeForbidden, resp.StatusLine.StatusCode)
+	resp = roundTrip(t, front, "CONNECT "+backend+" HTTP/1.1\r\n\r\n")
+	assert.Equal(t, response.StatusCodeForbidden, resp.StatusLine.StatusCode)
+
+	// Test: Listed ones are reached
+	conn, err := net.Dial("tcp", front)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", line)
+}
+
+func TestAllowed(t *testing.T) {
+	allow := []string{"example.com", "*.internal:8080", "*:443"}
+	for _, tc := range []struct {
+		host, port string
+		want       bool
+	}{
+		{"example.com", "80", true},
+		{"EXAMPLE.com", "443", true},
+		{"api.internal", "8080", true},
+		{"api.internal", "80", false},
+		{"internal", "8080", false},
+		{"other.org", "443", true},
+		{"other.org", "80", false},
+	} {
+		assert.Equal(t, tc.want, allowed(allow, tc.host, tc.port), "%s:%s", tc.host, tc.port)
+	}
+
+	// Test: An empty list allows everything
+	assert.True(t, allowed(nil, "anything", "1"))
+}
+
+func TestForwardAuth(t *testing.T) {
+	requests := make(chan *request.Request, 1)
+	backend := serve(t, func(w *response.Writer, req *request.Request) {
+		requests <- req
+		writeText(w, response.StatusCodeOK, "ok")
+	})
+	front := serve(t, NewForward(ForwardConfig{
+		Realm: "test",
+		Authenticate: func(username, password string) bool {
+			return username == "alice" && password == "secret"
+		},
+	}))
+	request := "GET http://" + backend + "/ HTTP/1.1\r\nHost: " + backend + "\r\n"
+	basic := func(credentials string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+	}
+
+	// Test: Missing or wrong credentials are challenged
+	resp := roundTrip(t, front, request+"\r\n")
+	assert.Equal(t, response.StatusCodeProxyAuthRequired, resp.StatusLine.StatusCode)
+	assert.Equal(t, `Basic realm="test"`, resp.Headers["proxy-authenticate"])
+	resp = roundTrip(t, front, request+basic("alice:wrong")+"\r\n")
+	assert.Equal(t, response.StatusCodeProxyAuthRequired, resp.StatusLine.StatusCode)
+	resp = roundTrip(t, front, "CONNECT "+backend+" HTTP/1.1\r\n\r\n")
+	assert.Equal(t, response.StatusCodeProxyAuthRequired, resp.StatusLine.StatusCode)
+
+	// Test: Valid credentials are accepted and not passed on
+	resp = roundTrip(t, front, request+basic("alice:secret")+"\r\n")
+	assert.Equal(t, response.StatusCodeOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "ok", string(resp.Body))
+	assert.NotContains(t, (<-requests).Headers, "proxy-authorization")
+}
+
+// openTunnel opens a tunnel through the proxy at addr to target.
+func openTunnel(t *testing.T, addr, target string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "HTTP/1.1 200 Connection Established\r\n", line)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	return conn, reader
+}
+
+// echoServer starts a TCP server writing back whatever it reads and
+// returns its address.
+func echoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
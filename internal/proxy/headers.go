@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"strings"
+)
+
+// hopByHopHeaders apply to a single connection and are never forwarded
+// (RFC 9110 section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop deletes the hop-by-hop headers from h, along with any
+// header the Connection header names.
+func removeHopByHop(h headers.Headers) {
+	if value, ok := h.Get("Connection"); ok {
+		for _, name := range splitTokens(value) {
+			h.Remove(name)
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Remove(name)
+	}
+}
+
+// cloneHeaders returns a copy of h.
+func cloneHeaders(h headers.Headers) headers.Headers {
+	c := headers.NewHeaders()
+	for k, v := range h {
+		c.Override(k, v)
+	}
+	return c
+}
+
+// splitTokens splits a comma-separated header value, dropping empty
+// elements.
+func splitTokens(value string) []string {
+	var tokens []string
+	for _, token := range strings.Split(value, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// hasToken reports whether the comma-separated header value contains
+// token, compared case-insensitively.
+func hasToken(value, token string) bool {
+	for _, t := range splitTokens(value) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
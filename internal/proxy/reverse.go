@@ -0,0 +1,330 @@
+// Package proxy forwards requests to other servers: a reverse proxy in
+// front of upstream servers, which a Balancer can spread over several
+// backends, and a forward proxy that clients send requests for any server
+// through, tunnelling CONNECT requests.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/peeta98/httpfromtcp/internal/client"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const copyBufferSize = 32 * 1024
+
+// DefaultVia is the name a proxy gives itself in Via headers when
+// ReverseConfig.Via is empty.
+const DefaultVia = "httpfromtcp"
+
+type ReverseConfig struct {
+	// Target is the upstream server. The request path is appended to its
+	// path and the request query to its query.
+	Target *url.URL
+	// Balancer, if set, chooses a target for each request in place of
+	// Target.
+	Balancer *Balancer
+	// Retries is how many other backends of Balancer an idempotent
+	// request is sent to when a backend gives no response.
+	Retries int
+	// StripPrefix is removed from the request path before it is appended
+	// to Target's, so a proxy mounted at /api/ can forward /api/x as /x.
+	StripPrefix string
+	// PreserveHost forwards the request's Host header instead of
+	// replacing it with Target's host.
+	PreserveHost bool
+	// Client sends the upstream requests. When nil, a client with its own
+	// connection pool is used.
+	Client *client.Client
+	// Via is the name added to the Via header of requests and responses.
+	// Defaults to DefaultVia.
+	Via string
+}
+
+// NewReverse returns a handler that forwards requests to cfg.Target, or a
+// backend of cfg.Balancer, and relays the responses, whatever their
+// status. Request bodies arrive whole from the server, chunked ones
+// already decoded, and are sent on with their length; response bodies and
+// their trailers are streamed back as they are read.
+func NewReverse(cfg ReverseConfig) server.Handler {
+	if cfg.Client == nil {
+		cfg.Client = &client.Client{Pool: &client.Pool{}}
+	}
+	if cfg.Via == "" {
+		cfg.Via = DefaultVia
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		serveReverse(w, req, cfg)
+	}
+}
+
+func serveReverse(w *response.Writer, req *request.Request, cfg ReverseConfig) {
+	attempts := 1
+	if cfg.Balancer != nil && isIdempotent(req.RequestLine.Method) {
+		attempts += cfg.Retries
+	}
+
+	var (
+		tried   []*backend
+		lastErr error
+	)
+	for range attempts {
+		target := cfg.Target
+		var be *backend
+		if cfg.Balancer != nil {
+			be = cfg.Balancer.pick(req, tried)
+			if be == nil {
+				break
+			}
+			tried = append(tried, be)
+			target = be.url
+		}
+
+		done, err := forward(w, req, cfg, target, be)
+		if done {
+			return
+		}
+		lastErr = err
+		if req.Context().Err() != nil {
+			break
+		}
+	}
+
+	if lastErr == nil {
+		writeError(w, response.StatusCodeServiceUnavailable, "No backend available")
+		return
+	}
+	writeUpstreamError(w, req, lastErr)
+}
+
+// forward sends req to target, the URL of be when balancing, and relays
+// the response. It returns false with the error when there was no
+// response, leaving w untouched.
+func forward(w *response.Writer, req *request.Request, cfg ReverseConfig, target *url.URL, be *backend) (bool, error) {
+	u, ok := upstreamURL(target, cfg.StripPrefix, req.RequestLine.RequestTarget)
+	if !ok {
+		writeError(w, response.StatusCodeBadRequest, "Bad request target")
+		return true, nil
+	}
+	out, err := newUpstreamRequest(req, u, cfg.Via)
+	if err != nil {
+		writeError(w, response.StatusCodeBadRequest, "Bad request target")
+		return true, nil
+	}
+	setForwardedHeaders(out.Headers, req)
+	if !cfg.PreserveHost {
+		out.Headers.Remove("Host")
+	}
+
+	if be != nil {
+		be.active.Add(1)
+		defer be.active.Add(-1)
+	}
+	resp, err := cfg.Client.Do(out)
+	// A client hanging up says nothing about the backend.
+	if be != nil && req.Context().Err() == nil {
+		var statusCode response.StatusCode
+		if err == nil {
+			statusCode = resp.StatusLine.StatusCode
+		}
+		cfg.Balancer.observe(be, statusCode, err)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	copyResponse(w, req, resp, cfg.Via)
+	return true, nil
+}
+
+// upstreamURL joins the request target's path and query to target's,
+// after removing prefix from the path.
+func upstreamURL(target *url.URL, prefix, requestTarget string) (string, bool) {
+	path, query, _ := strings.Cut(requestTarget, "?")
+	if !strings.HasPrefix(path, "/") {
+		return "", false
+	}
+	if prefix != "" {
+		// The prefix must end at a segment boundary, so "/api" covers
+		// "/api" and "/api/x" but not "/apix".
+		rest, ok := strings.CutPrefix(path, strings.TrimSuffix(prefix, "/"))
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			return "", false
+		}
+		path = rest
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	u := target.Scheme + "://" + target.Host + strings.TrimSuffix(target.EscapedPath(), "/") + path
+	switch {
+	case target.RawQuery != "" && query != "":
+		u += "?" + target.RawQuery + "&" + query
+	case target.RawQuery != "":
+		u += "?" + target.RawQuery
+	case query != "":
+		u += "?" + query
+	}
+	return u, true
+}
+
+// newUpstreamRequest builds the request forwarded for req: its method,
+// headers without the hop-by-hop ones plus Via, and its body.
+func newUpstreamRequest(req *request.Request, target, via string) (*client.Request, error) {
+	var body io.Reader
+	if _, ok := req.Headers.Get("Content-Length"); ok || len(req.Body) > 0 {
+		body = bytes.NewReader(req.Body)
+	}
+	out, err := client.NewRequest(req.Context(), req.RequestLine.Method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	h := cloneHeaders(req.Headers)
+	te, _ := h.Get("TE")
+	removeHopByHop(h)
+	// Asking for trailers is end to end, unlike the rest of TE.
+	if hasToken(te, "trailers") {
+		h.Set("TE", "trailers")
+	}
+	h.Set("Via", req.RequestLine.HttpVersion+" "+via)
+
+	out.Headers = h
+	return out, nil
+}
+
+// setForwardedHeaders tells the upstream server who the client is and
+// how it reached the proxy.
+func setForwardedHeaders(h headers.Headers, req *request.Request) {
+	if ip := clientIP(req); ip != "" {
+		h.Set("X-Forwarded-For", ip)
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	h.Override("X-Forwarded-Proto", proto)
+	if host, ok := req.Headers.Get("Host"); ok {
+		h.Override("X-Forwarded-Host", host)
+	}
+}
+
+// copyResponse relays resp to w. A body of known length keeps its
+// Content-Length; any other body is sent chunked, followed by the
+// upstream trailers it declared.
+func copyResponse(w *response.Writer, req *request.Request, resp *client.Response, via string) {
+	head := &response.Response{StatusLine: resp.StatusLine, Headers: resp.Headers}
+	framing, _, err := head.Framing(req.RequestLine.Method)
+	if err != nil {
+		writeError(w, response.StatusCodeBadGateway, "Bad gateway")
+		return
+	}
+
+	h := cloneHeaders(resp.Headers)
+	trailer, _ := h.Get("Trailer")
+	removeHopByHop(h)
+	h.Set("Via", resp.StatusLine.HttpVersion+" "+via)
+	h.Override("Connection", "close")
+
+	chunked := framing == response.FramingChunked || framing == response.FramingUntilClose
+	var declared []string
+	if chunked {
+		h.Remove("Content-Length")
+		h.Override("Transfer-Encoding", "chunked")
+		for _, name := range splitTokens(trailer) {
+			if !response.IsProhibitedTrailer(name) {
+				declared = append(declared, strings.ToLower(name))
+			}
+		}
+		if len(declared) > 0 {
+			h.Override("Trailer", strings.Join(declared, ", "))
+		}
+	}
+
+	if err := w.WriteStatusLine(resp.StatusLine.StatusCode); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if framing == response.FramingNone {
+		return
+	}
+
+	write := w.WriteBody
+	if chunked {
+		write = w.WriteChunkedBody
+	}
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// The response is already under way, so the client can only
+			// learn of the failure from it being cut short.
+			return
+		}
+	}
+	if !chunked {
+		return
+	}
+
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		return
+	}
+	trailers := headers.NewHeaders()
+	for _, name := range declared {
+		if value, ok := resp.Trailers.Get(name); ok {
+			trailers.Override(name, value)
+		}
+	}
+	w.WriteTrailers(trailers)
+}
+
+// writeUpstreamError answers a request the upstream server could not
+// answer: 504 when it timed out and 502 otherwise. Nothing is written
+// when the client is gone.
+func writeUpstreamError(w *response.Writer, req *request.Request, err error) {
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		writeError(w, response.StatusCodeGatewayTimeout, "Gateway timeout")
+		return
+	}
+	writeError(w, response.StatusCodeBadGateway, "Bad gateway")
+}
+
+// isIdempotent reports whether a request with method can be sent twice
+// with the same effect as once.
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, message string) {
+	w.WriteStatusLine(statusCode)
+	body := []byte(message)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
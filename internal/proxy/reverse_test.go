@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"context"
+	"github.com/peeta98/httpfromtcp/internal/client"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReverseForwardsRequest(t *testing.T) {
+	requests := make(chan *request.Request, 1)
+	backend := serve(t, func(w *response.Writer, req *request.Request) {
+		requests <- req
+		writeText(w, response.StatusCodeOK, "ok")
+	})
+	front := serve(t, NewReverse(ReverseConfig{
+		Target:      mustParse(t, "http://"+backend+"/base?k=v"),
+		StripPrefix: "/api",
+	}))
+
+	// The client always sends its own Connection header, so the request
+	// is written by hand.
+	resp := roundTrip(t, front, "POST /api/items?x=1 HTTP/1.1\r\n"+
+		"Host: "+front+"\r\n"+
+		"Connection: X-Hop\r\n"+
+		"X-Hop: 1\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"X-Custom: kept\r\n"+
+		"X-Forwarded-For: 10.0.0.1\r\n"+
+		"Content-Length: 7\r\n\r\npayload")
+	assert.Equal(t, response.StatusCodeOK, resp.StatusLine.StatusCode)
+
+	// Test: Method, path, query and body are forwarded
+	got := <-requests
+	assert.Equal(t, "POST", got.RequestLine.Method)
+	assert.Equal(t, "/base/items?k=v&x=1", got.RequestLine.RequestTarget)
+	assert.Equal(t, "payload", string(got.Body))
+
+	// Test: End-to-end headers are kept and hop-by-hop ones dropped
+	assert.Equal(t, "kept", got.Headers["x-custom"])
+	assert.NotContains(t, got.Headers, "x-hop")
+	assert.NotContains(t, got.Headers, "keep-alive")
+
+	// Test: The proxy identifies the client and itself
+	assert.Equal(t, backend, got.Headers["host"])
+	assert.Equal(t, "10.0.0.1, 127.0.0.1", got.Headers["x-forwarded-for"])
+	assert.Equal(t, "http", got.Headers["x-forwarded-proto"])
+	assert.Equal(t, front, got.Headers["x-forwarded-host"])
+	assert.Equal(t, "1.1 httpfromtcp", got.Headers["via"])
+
+	// Test: A chunked body is decoded and sent on with its length
+	resp = roundTrip(t, front, "POST /api/upload HTTP/1.1\r\n"+
+		"Host: "+front+"\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n"+
+		"4\r\npay-\r\n4\r\nload\r\n0\r\n\r\n")
+	assert.Equal(t, response.StatusCodeOK, resp.StatusLine.StatusCode)
+	got = <-requests
+	assert.Equal(t, "pay-load", string(got.Body))
+	assert.Equal(t, "8", got.Headers["content-length"])
+	assert.NotContains(t, got.Headers, "transfer-encoding")
+}
+
+func TestReversePreserveHost(t *testing.T) {
+	requests := make(chan *request.Request, 1)
+	backend := serve(t, func(w *response.Writer, req *request.Request) {
+		requests <- req
+		writeText(w, response.StatusCodeOK, "ok")
+	})
+	front := serve(t, NewReverse(ReverseConfig{
+		Target:       mustParse(t, "http://"+backend),
+		PreserveHost: true,
+		Via:          "edge",
+	}))
+
+	// Test: The client's Host header reaches the backend
+	resp, err := client.Get(context.Background(), "http://"+front+"/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	got := <-requests
+	assert.Equal(t, front, got.Headers["host"])
+	assert.Equal(t, "1.1 edge", got.Headers["via"])
+}
+
+func TestReverseRelaysResponse(t *testing.T) {
+	backend := serve(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCode(418))
+		h := response.GetDefaultHeaders(len("teapot"))
+		h.Set("X-Upstream", "yes")
+		h.Set("Connection", "X-Upstream-Hop")
+		h.Set("X-Upstream-Hop", "1")
+		w.WriteHeaders(h)
+		if req.RequestLine.Method != "HEAD" {
+			w.WriteBody([]byte("teapot"))
+		}
+	})
+	front := serve(t, NewReverse(ReverseConfig{Target: mustParse(t, "http://"+backend)}))
+
+	// Test: Any status passes through with the upstream headers
+	resp, err := client.Get(context.Background(), "http://"+front+"/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, response.StatusCode(418), resp.StatusLine.StatusCode)
+	assert.Equal(t, "teapot", string(body))
+	assert.Equal(t, "yes", resp.Headers["x-upstream"])
+	assert.Equal(t, "6", resp.Headers["content-length"])
+	assert.Equal(t, "1.1 httpfromtcp", resp.Headers["via"])
+	assert.NotContains(t, resp.Headers, "x-upstream-hop")
+
+	// Test: A HEAD response keeps its Content-Length and has no body
+	req, err := client.NewRequest(context.Background(), "HEAD", "http://"+front+"/", nil)
+	require.NoError(t, err)
+	resp, err = client.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "6", resp.Headers["content-length"])
+	assert.Empty(t, body)
+}
+
+func TestReverseStreamsBodyAndTrailers(t *testing.T) {
+	release := make(chan struct{})
+	backend := serve(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeOK)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Sum")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("first "))
+		<-release
+		w.WriteChunkedBody([]byte("second"))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Sum", "abc")
+		w.WriteTrailers(trailers)
+	})
+	front := serve(t, NewReverse(ReverseConfig{Target: mustParse(t, "http://"+backend)}))
+
+	resp, err := client.Get(context.Background(), "http://"+front+"/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// Test: The first chunk arrives before the upstream has finished
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "first ", string(buf))
+	close(release)
+
+	// Test: The rest of the body is followed by the upstream trailers
+	rest, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(rest))
+	assert.Equal(t, "chunked", resp.Headers["transfer-encoding"])
+	assert.Equal(t, "abc", resp.Trailers["x-sum"])
+}
+
+func TestReverseUpstreamErrors(t *testing.T) {
+	// An address nothing listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down := listener.Addr().String()
+	listener.Close()
+
+	// Test: An unreachable upstream gives 502
+	front := serve(t, NewReverse(ReverseConfig{Target: mustParse(t, "http://"+down)}))
+	resp, err := client.Get(context.Background(), "http://"+front+"/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, response.StatusCodeBadGateway, resp.StatusLine.StatusCode)
+
+	// Test: An upstream that times out gives 504
+	slow := serve(t, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+	})
+	front = serve(t, NewReverse(ReverseConfig{Target: mustParse(t, "http://"+slow)}),
+		server.WithRequestTimeout(100*time.Millisecond))
+	resp, err = client.Get(context.Background(), "http://"+front+"/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, response.StatusCodeGatewayTimeout, resp.StatusLine.StatusCode)
+}
+
+func TestUpstreamURL(t *testing.T) {
+	target := &url.URL{Scheme: "http", Host: "backend", Path: "/base/", RawQuery: "k=v"}
+	for _, tc := range []struct {
+		prefix, requestTarget, want string
+	}{
+		{"", "/a?x=1", "http://backend/base/a?k=v&x=1"},
+		{"/api", "/api/items", "http://backend/base/items?k=v"},
+		{"/api", "/api", "http://backend/base/?k=v"},
+		{"/api/", "/api/items", "http://backend/base/items?k=v"},
+		{"/api", "/api?x=1", "http://backend/base/?k=v&x=1"},
+		{"/api", "/apix/items", ""},
+		{"/api", "/other", ""},
+		{"", "example.com:443", ""},
+	} {
+		got, ok := upstreamURL(target, tc.prefix, tc.requestTarget)
+		assert.Equal(t, tc.want != "", ok, tc.requestTarget)
+		assert.Equal(t, tc.want, got, tc.requestTarget)
+	}
+}
+
+// serve starts a server for handler and returns its address.
+func serve(t *testing.T, handler server.Handler, opts ...server.Option) string {
+	srv, err := server.ServeAddr("127.0.0.1:0", handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr().String()
+}
+
+// roundTrip sends raw to addr and parses the response.
+func roundTrip(t *testing.T, addr, raw string) *response.Response {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	resp, err := response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	return resp
+}
+
+func writeText(w *response.Writer, statusCode response.StatusCode, body string) {
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+	return u
+}
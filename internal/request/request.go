@@ -2,19 +2,33 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/peeta98/httpfromtcp/internal/headers"
 	"io"
+	"net"
 	"strconv"
 	"strings"
 )
 
 type Request struct {
-	RequestLine    RequestLine
-	Headers        headers.Headers
-	Body           []byte
+	RequestLine RequestLine
+	Headers     headers.Headers
+	Body        []byte
+	// TLS holds the state of the connection the request arrived on, or
+	// nil when it was not made over TLS. It is set by the server.
+	TLS *tls.ConnectionState
+	// RemoteAddr is the address of the client that sent the request and
+	// LocalAddr the address it was received on. They are set by the server
+	// and nil for requests built elsewhere.
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+
+	ctx            context.Context
 	bodyLengthRead int
+	chunkRemaining int64
 	state          requestState
 }
 
@@ -30,6 +44,10 @@ const (
 	Initialized requestState = iota
 	ParsingHeaders
 	ParsingBody
+	ParsingChunkSize
+	ParsingChunkData
+	ParsingChunkDataEnd
+	ParsingTrailers
 	Done
 )
 
@@ -38,7 +56,53 @@ const (
 	bufferSize = 8
 )
 
+// Errors returned by RequestFromReader, wrapped with details about the
+// offending input. They let callers tell kinds of malformed requests apart.
+var (
+	ErrIncompleteRequest    = errors.New("incomplete request")
+	ErrMalformedRequestLine = errors.New("poorly formatted request-line")
+	ErrInvalidMethod        = errors.New("invalid method")
+	ErrUnsupportedVersion   = errors.New("unrecognized HTTP-version")
+	ErrMalformedHeader      = errors.New("malformed header")
+	ErrInvalidContentLength = errors.New("malformed Content-Length")
+	ErrMalformedChunk       = errors.New("malformed chunked encoding")
+	// ErrUnsupportedTransferCoding is returned for a Transfer-Encoding
+	// other than chunked, which servers answer with 501 (RFC 9112
+	// section 6.1).
+	ErrUnsupportedTransferCoding = errors.New("unsupported Transfer-Encoding")
+)
+
+// Context returns the request's context. The server cancels it when the
+// client disconnects, the server is closed or the request times out.
+// Requests that did not come through the server use context.Background.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx,
+// which is how middleware attaches values such as request IDs.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	request, _, err := ReadRequest(reader)
+	return request, err
+}
+
+// ReadRequest parses a request like RequestFromReader and also returns the
+// bytes it read past the end of the request, such as the start of a
+// pipelined request or of the protocol the connection switches to.
+func ReadRequest(reader io.Reader) (*Request, []byte, error) {
 	buf := make([]byte, bufferSize)
 	readToIndex := 0
 	request := &Request{
@@ -61,25 +125,25 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				if request.state != Done {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", request.state, bytesRead)
+					return nil, nil, fmt.Errorf("%w, in state: %d, read n bytes on EOF: %d", ErrIncompleteRequest, request.state, bytesRead)
 				}
 				break
 			}
-			return nil, err
+			return nil, nil, err
 		}
 		readToIndex += bytesRead
 
 		// Parse the current buffer data
 		bytesParsed, err := request.parse(buf[:readToIndex])
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		copy(buf, buf[bytesParsed:readToIndex])
 		readToIndex -= bytesParsed
 	}
 
-	return request, nil
+	return request, buf[:readToIndex], nil
 }
 
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
@@ -104,13 +168,13 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 func requestLineFromString(str string) (*RequestLine, error) {
 	parts := strings.Split(str, " ")
 	if len(parts) != 3 {
-		return nil, fmt.Errorf("poorly formated request-line: %s", str)
+		return nil, fmt.Errorf("%w: %s", ErrMalformedRequestLine, str)
 	}
 
 	method := parts[0]
 	for _, c := range method {
 		if c < 'A' || c > 'Z' {
-			return nil, fmt.Errorf("invalid method: %s", method)
+			return nil, fmt.Errorf("%w: %s", ErrInvalidMethod, method)
 		}
 	}
 
@@ -118,17 +182,17 @@ func requestLineFromString(str string) (*RequestLine, error) {
 
 	versionParts := strings.Split(parts[2], "/")
 	if len(versionParts) != 2 {
-		return nil, fmt.Errorf("malformed HTTP version: %s", parts[2])
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, parts[2])
 	}
 
 	httpPart := versionParts[0]
 	if httpPart != "HTTP" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", httpPart)
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, httpPart)
 	}
 
 	version := versionParts[1]
 	if version != "1.1" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", version)
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, version)
 	}
 
 	return &RequestLine{
@@ -172,10 +236,12 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	case ParsingHeaders:
 		n, done, err := r.Headers.Parse(data)
 		if err != nil {
-			return 0, err
+			return 0, fmt.Errorf("%w: %w", ErrMalformedHeader, err)
 		}
 		if done {
-			r.state = ParsingBody
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
 		}
 		return n, nil
 	case ParsingBody:
@@ -187,24 +253,108 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 
 		contentLength, err := strconv.Atoi(contentLengthStr)
 		if err != nil {
-			return 0, fmt.Errorf("malformed Content-Length: %s", err)
+			return 0, fmt.Errorf("%w: %s", ErrInvalidContentLength, err)
 		}
-
-		r.Body = append(r.Body, data...)
-		r.bodyLengthRead += len(data)
-
-		if r.bodyLengthRead > contentLength {
-			return 0, errors.New("error: length of body greater than content-length")
+		if contentLength < 0 {
+			return 0, fmt.Errorf("%w: %d", ErrInvalidContentLength, contentLength)
 		}
 
+		// Anything past Content-Length is not part of this request.
+		n := min(len(data), contentLength-r.bodyLengthRead)
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyLengthRead += n
+
 		if r.bodyLengthRead == contentLength {
 			r.state = Done
 		}
 
-		return len(data), nil
+		return n, nil
+	case ParsingChunkSize:
+		idx := bytes.Index(data, []byte(crlf))
+		if idx == -1 {
+			return 0, nil
+		}
+		size, err := parseChunkSize(string(data[:idx]))
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			r.state = ParsingTrailers
+		} else {
+			r.chunkRemaining = size
+			r.state = ParsingChunkData
+		}
+		return idx + len(crlf), nil
+	case ParsingChunkData:
+		n := int(min(int64(len(data)), r.chunkRemaining))
+		r.Body = append(r.Body, data[:n]...)
+		r.chunkRemaining -= int64(n)
+		if r.chunkRemaining == 0 {
+			r.state = ParsingChunkDataEnd
+		}
+		return n, nil
+	case ParsingChunkDataEnd:
+		if len(data) < len(crlf) {
+			return 0, nil
+		}
+		if string(data[:len(crlf)]) != crlf {
+			return 0, fmt.Errorf("%w: missing CRLF after chunk data", ErrMalformedChunk)
+		}
+		r.state = ParsingChunkSize
+		return len(crlf), nil
+	case ParsingTrailers:
+		// Trailers are checked but not kept, as Body is handed over whole.
+		n, done, err := headers.NewHeaders().Parse(data)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrMalformedHeader, err)
+		}
+		if done {
+			// The body is decoded now, so it is described as one of
+			// known length to the handler and anything it is passed on
+			// to.
+			r.Headers.Remove("Transfer-Encoding")
+			r.Headers.Override("Content-Length", strconv.Itoa(len(r.Body)))
+			r.state = Done
+		}
+		return n, nil
 	case Done:
 		return 0, errors.New("error: trying to read data in a done state")
 	default:
 		return 0, errors.New("error: unknown state")
 	}
 }
+
+// startBody picks how the body is read once the headers are parsed. A
+// chunked body is decoded; a Transfer-Encoding alongside Content-Length is
+// refused, since the two could be read differently by a server further on
+// (RFC 9112 section 6.3).
+func (r *Request) startBody() error {
+	transferEncoding, ok := r.Headers.Get("Transfer-Encoding")
+	if !ok {
+		r.state = ParsingBody
+		return nil
+	}
+	if !strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked") {
+		return fmt.Errorf("%w: %s", ErrUnsupportedTransferCoding, transferEncoding)
+	}
+	if _, ok := r.Headers.Get("Content-Length"); ok {
+		return fmt.Errorf("%w: sent with Transfer-Encoding", ErrInvalidContentLength)
+	}
+	r.state = ParsingChunkSize
+	return nil
+}
+
+// parseChunkSize reads the hexadecimal size at the start of a chunk-size
+// line, ignoring chunk extensions.
+func parseChunkSize(line string) (int64, error) {
+	sizeText, _, _ := strings.Cut(line, ";")
+	sizeText = strings.TrimRight(sizeText, " \t")
+	if sizeText == "" || strings.Trim(sizeText, "0123456789abcdefABCDEF") != "" {
+		return 0, fmt.Errorf("%w: invalid chunk size %q", ErrMalformedChunk, line)
+	}
+	size, err := strconv.ParseInt(sizeText, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid chunk size %q", ErrMalformedChunk, line)
+	}
+	return size, nil
+}
@@ -50,7 +50,7 @@ func TestRequestLineParse(t *testing.T) {
 		numBytesPerRead: 50,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrMalformedRequestLine)
 
 	// Test: Invalid method (out of order) request line
 	reader = &chunkReader{
@@ -58,7 +58,7 @@ func TestRequestLineParse(t *testing.T) {
 		numBytesPerRead: 9,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidMethod)
 
 	// Test: Invalid version in Request line
 	reader = &chunkReader{
@@ -66,7 +66,7 @@ func TestRequestLineParse(t *testing.T) {
 		numBytesPerRead: 15,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
 }
 
 func TestHeadersParse(t *testing.T) {
@@ -121,7 +121,7 @@ func TestHeadersParse(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.Nil(t, r)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrIncompleteRequest)
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -129,7 +129,7 @@ func TestHeadersParse(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrMalformedHeader)
 }
 
 func TestBodyParse(t *testing.T) {
@@ -198,6 +198,109 @@ func TestBodyParse(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
+
+	// Test: Negative content length
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nContent-Length: -1\r\n\r\nx",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidContentLength)
+}
+
+func TestChunkedBodyParse(t *testing.T) {
+	// Test: Chunks are decoded, extensions and trailers skipped
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6;name=value\r\nhello \r\n" +
+			"5\r\nworld\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n" +
+			"GET /next HTTP/1.1\r\n",
+		numBytesPerRead: 3,
+	}
+	r, rest, err := ReadRequest(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(r.Body))
+	unread, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /next HTTP/1.1\r\n", string(rest)+string(unread))
+
+	// Test: The decoded body is described by Content-Length
+	assert.Equal(t, "11", r.Headers["content-length"])
+	assert.NotContains(t, r.Headers, "transfer-encoding")
+	assert.NotContains(t, r.Headers, "x-checksum")
+
+	for name, tc := range map[string]struct {
+		data string
+		err  error
+	}{
+		"signed chunk size": {
+			data: "Transfer-Encoding: chunked\r\n\r\n+5\r\nhello\r\n0\r\n\r\n",
+			err:  ErrMalformedChunk,
+		},
+		"chunk size that is not hex": {
+			data: "Transfer-Encoding: chunked\r\n\r\nzz\r\n",
+			err:  ErrMalformedChunk,
+		},
+		"chunk data longer than its size": {
+			data: "Transfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n",
+			err:  ErrMalformedChunk,
+		},
+		"missing last chunk": {
+			data: "Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n",
+			err:  ErrIncompleteRequest,
+		},
+		"Content-Length with Transfer-Encoding": {
+			data: "Transfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n",
+			err:  ErrInvalidContentLength,
+		},
+		"coding other than chunked": {
+			data: "Transfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+			err:  ErrUnsupportedTransferCoding,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Test: Malformed or unsupported framing is rejected
+			reader := &chunkReader{
+				data:            "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\n" + tc.data,
+				numBytesPerRead: 3,
+			}
+			_, err := RequestFromReader(reader)
+			require.ErrorIs(t, err, tc.err)
+		})
+	}
+}
+
+func TestReadRequestRemainder(t *testing.T) {
+	// Test: Bytes past the body are returned, not parsed as body
+	reader := &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nContent-Length: 5\r\n\r\nhelloGET /next HTTP/1.1\r\n",
+		numBytesPerRead: 7,
+	}
+	r, rest, err := ReadRequest(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	// Whatever the parser read past the body, together with what is still
+	// unread, must be exactly the pipelined request.
+	unread, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.NotEmpty(t, rest)
+	assert.Equal(t, "GET /next HTTP/1.1\r\n", string(rest)+string(unread))
+
+	// Test: Everything after the headers of a request without a body
+	reader = &chunkReader{
+		data:            "GET /chat HTTP/1.1\r\nUpgrade: websocket\r\n\r\n\x81\x05hello",
+		numBytesPerRead: 100,
+	}
+	r, rest, err = ReadRequest(reader)
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+	assert.Equal(t, "\x81\x05hello", string(rest))
 }
 
 type chunkReader struct {
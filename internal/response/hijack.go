@@ -0,0 +1,60 @@
+package response
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+var (
+	// ErrNotHijackable is returned by Writer.Hijack when the response is
+	// not being written to a connection that can be taken over.
+	ErrNotHijackable = errors.New("response: connection cannot be hijacked")
+	// ErrHijacked is returned by Writer methods once the connection has
+	// been hijacked.
+	ErrHijacked = errors.New("response: connection has been hijacked")
+)
+
+// Hijacker is implemented by sinks that can hand their connection over to
+// the handler. Middleware sinks implement it by delegating to the Writer
+// they wrap.
+type Hijacker interface {
+	Hijack() (net.Conn, []byte, error)
+}
+
+// NewHijackableWriter returns a Writer that encodes the response onto w
+// like NewWriter, and whose Hijack method calls hijack.
+func NewHijackableWriter(w io.Writer, hijack func() (net.Conn, []byte, error)) *Writer {
+	return NewSinkWriter(&hijackableSink{wireSink: wireSink{writer: w}, hijack: hijack})
+}
+
+type hijackableSink struct {
+	wireSink
+	hijack func() (net.Conn, []byte, error)
+}
+
+func (s *hijackableSink) Hijack() (net.Conn, []byte, error) {
+	return s.hijack()
+}
+
+// Hijack takes over the connection the response is written to. It returns
+// the connection and any bytes the server read from it past the end of
+// the request, which belong to whatever protocol follows. Whatever part
+// of the response was written before is already on the wire; after Hijack
+// the Writer can no longer be used and the caller must close the
+// connection.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	h, ok := w.sink.(Hijacker)
+	if !ok {
+		return nil, nil, ErrNotHijackable
+	}
+	conn, buffered, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return conn, buffered, nil
+}
@@ -0,0 +1,317 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Response is a parsed response, the counterpart of request.Request.
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Body       []byte
+	// Trailers holds the fields sent after a chunked body.
+	Trailers headers.Headers
+
+	state         responseState
+	headOnly      bool
+	method        string
+	bodyRemaining int64
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+type responseState int
+
+const (
+	ParsingStatusLine responseState = iota
+	ParsingHeaders
+	ParsingBody
+	ParsingChunkSize
+	ParsingChunkData
+	ParsingChunkDataEnd
+	ParsingTrailers
+	ParsingUntilEOF
+	Done
+)
+
+// Framing is how a response body is delimited (RFC 9112 section 6.3).
+type Framing int
+
+const (
+	// FramingNone is a response that has no body, whatever its headers
+	// say, such as one to a HEAD request or a 304.
+	FramingNone Framing = iota
+	// FramingContentLength is a body of Content-Length bytes.
+	FramingContentLength
+	// FramingChunked is a body in chunked transfer coding, possibly
+	// followed by trailers.
+	FramingChunked
+	// FramingUntilClose is a body that runs until the connection closes.
+	FramingUntilClose
+)
+
+const parseBufferSize = 1024
+
+// Errors returned for responses that cannot be parsed, wrapped with
+// details about the offending input.
+var (
+	ErrIncompleteResponse   = errors.New("incomplete response")
+	ErrMalformedStatusLine  = errors.New("malformed status-line")
+	ErrUnsupportedVersion   = errors.New("unsupported HTTP-version")
+	ErrMalformedHeader      = errors.New("malformed header")
+	ErrInvalidContentLength = errors.New("malformed Content-Length")
+	ErrMalformedChunk       = errors.New("malformed chunked encoding")
+)
+
+// ResponseFromReader parses a complete response to a GET request,
+// reading a body without framing until EOF.
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	response, _, err := ReadResponse(reader, "GET")
+	return response, err
+}
+
+// ReadResponse parses a response to a request with the given method, which
+// decides whether it has a body, and returns the bytes it read past its
+// end. Interim 1xx responses are returned like any other.
+func ReadResponse(reader io.Reader, method string) (*Response, []byte, error) {
+	return readResponse(reader, &Response{method: method})
+}
+
+// ReadResponseHead parses only a response's status line and headers, for
+// callers that read the body themselves. It returns the bytes it read
+// past the headers, which start the body.
+func ReadResponseHead(reader io.Reader) (*Response, []byte, error) {
+	return readResponse(reader, &Response{headOnly: true})
+}
+
+func readResponse(reader io.Reader, response *Response) (*Response, []byte, error) {
+	buf := make([]byte, parseBufferSize)
+	readToIndex := 0
+	response.state = ParsingStatusLine
+	response.Headers = headers.NewHeaders()
+	response.Trailers = headers.NewHeaders()
+
+	for response.state != Done {
+		// Grow buffer if needed
+		if readToIndex >= len(buf) {
+			newBuf := make([]byte, len(buf)*2)
+			copy(newBuf, buf)
+			buf = newBuf
+		}
+
+		bytesRead, readErr := reader.Read(buf[readToIndex:])
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return nil, nil, readErr
+		}
+		readToIndex += bytesRead
+
+		bytesParsed, err := response.parse(buf[:readToIndex])
+		if err != nil {
+			return nil, nil, err
+		}
+		copy(buf, buf[bytesParsed:readToIndex])
+		readToIndex -= bytesParsed
+
+		if errors.Is(readErr, io.EOF) {
+			if response.state == ParsingUntilEOF {
+				response.state = Done
+				break
+			}
+			if response.state != Done {
+				return nil, nil, fmt.Errorf("%w, in state: %d", ErrIncompleteResponse, response.state)
+			}
+		}
+	}
+
+	return response, buf[:readToIndex], nil
+}
+
+// Framing reports how the body of a response to method is delimited, and
+// for FramingContentLength its length.
+func (r *Response) Framing(method string) (Framing, int64, error) {
+	code := r.StatusLine.StatusCode
+	if method == "HEAD" || code < 200 || code == 204 || code == StatusCodeNotModified {
+		return FramingNone, 0, nil
+	}
+	if te, ok := r.Headers.Get("Transfer-Encoding"); ok {
+		// Chunked must be the last coding applied.
+		codings := strings.Split(te, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return FramingChunked, 0, nil
+		}
+		return FramingUntilClose, 0, nil
+	}
+	value, ok := r.Headers.Get("Content-Length")
+	if !ok {
+		return FramingUntilClose, 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, 0, fmt.Errorf("%w: %s", ErrInvalidContentLength, value)
+	}
+	return FramingContentLength, n, nil
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+	for r.state != Done {
+		n, err := r.parseSingle(data[totalBytesParsed:])
+		if err != nil {
+			return 0, err
+		}
+		totalBytesParsed += n
+		if n == 0 {
+			break
+		}
+	}
+	return totalBytesParsed, nil
+}
+
+func (r *Response) parseSingle(data []byte) (int, error) {
+	switch r.state {
+	case ParsingStatusLine:
+		idx := bytes.Index(data, []byte(headers.CRLF))
+		if idx == -1 {
+			return 0, nil
+		}
+		statusLine, err := statusLineFromString(string(data[:idx]))
+		if err != nil {
+			return 0, err
+		}
+		r.StatusLine = *statusLine
+		r.state = ParsingHeaders
+		return idx + len(headers.CRLF), nil
+	case ParsingHeaders:
+		n, done, err := r.Headers.Parse(data)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrMalformedHeader, err)
+		}
+		if done {
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	case ParsingBody:
+		n := int(min(int64(len(data)), r.bodyRemaining))
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyRemaining -= int64(n)
+		if r.bodyRemaining == 0 {
+			r.state = Done
+		}
+		return n, nil
+	case ParsingChunkSize:
+		idx := bytes.Index(data, []byte(headers.CRLF))
+		if idx == -1 {
+			return 0, nil
+		}
+		line := string(data[:idx])
+		// Chunk extensions are ignored.
+		sizeText, _, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("%w: invalid chunk size %q", ErrMalformedChunk, line)
+		}
+		if size == 0 {
+			r.state = ParsingTrailers
+		} else {
+			r.bodyRemaining = size
+			r.state = ParsingChunkData
+		}
+		return idx + len(headers.CRLF), nil
+	case ParsingChunkData:
+		n := int(min(int64(len(data)), r.bodyRemaining))
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyRemaining -= int64(n)
+		if r.bodyRemaining == 0 {
+			r.state = ParsingChunkDataEnd
+		}
+		return n, nil
+	case ParsingChunkDataEnd:
+		if len(data) < len(headers.CRLF) {
+			return 0, nil
+		}
+		if string(data[:len(headers.CRLF)]) != headers.CRLF {
+			return 0, fmt.Errorf("%w: missing CRLF after chunk data", ErrMalformedChunk)
+		}
+		r.state = ParsingChunkSize
+		return len(headers.CRLF), nil
+	case ParsingTrailers:
+		n, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrMalformedHeader, err)
+		}
+		if done {
+			r.state = Done
+		}
+		return n, nil
+	case ParsingUntilEOF:
+		r.Body = append(r.Body, data...)
+		return len(data), nil
+	case Done:
+		return 0, errors.New("error: trying to read data in a done state")
+	default:
+		return 0, errors.New("error: unknown state")
+	}
+}
+
+// startBody picks the body state once the headers are parsed.
+func (r *Response) startBody() error {
+	if r.headOnly {
+		r.state = Done
+		return nil
+	}
+	framing, length, err := r.Framing(r.method)
+	if err != nil {
+		return err
+	}
+	switch framing {
+	case FramingNone:
+		r.state = Done
+	case FramingContentLength:
+		r.bodyRemaining = length
+		r.state = ParsingBody
+		if length == 0 {
+			r.state = Done
+		}
+	case FramingChunked:
+		r.state = ParsingChunkSize
+	case FramingUntilClose:
+		r.state = ParsingUntilEOF
+	}
+	return nil
+}
+
+// statusLineFromString parses "HTTP/1.1 200 OK". The reason phrase may
+// contain spaces or be empty.
+func statusLineFromString(str string) (*StatusLine, error) {
+	version, rest, ok := strings.Cut(str, " ")
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedStatusLine, str)
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+
+	if version != "HTTP/1.1" && version != "HTTP/1.0" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, version)
+	}
+	statusCode, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 || statusCode < 100 {
+		return nil, fmt.Errorf("%w: invalid status code %q", ErrMalformedStatusLine, code)
+	}
+
+	return &StatusLine{
+		HttpVersion:  strings.TrimPrefix(version, "HTTP/"),
+		StatusCode:   StatusCode(statusCode),
+		ReasonPhrase: reason,
+	}, nil
+}
@@ -0,0 +1,223 @@
+package response
+
+import (
+	"bytes"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStatusLineParse(t *testing.T) {
+	// Test: Good status line
+	reader := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusCodeOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "OK", r.StatusLine.ReasonPhrase)
+
+	// Test: Reason phrase with spaces, on HTTP/1.0
+	reader = &chunkReader{
+		data:            "HTTP/1.0 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusCodeNotFound, r.StatusLine.StatusCode)
+	assert.Equal(t, "Not Found", r.StatusLine.ReasonPhrase)
+
+	// Test: Empty reason phrase
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 599\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode(599), r.StatusLine.StatusCode)
+	assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+
+	// Test: Malformed status lines
+	for data, want := range map[string]error{
+		"HTTP/1.1\r\n\r\n":                         ErrMalformedStatusLine,
+		"HTTP/1.1 OK\r\n\r\n":                      ErrMalformedStatusLine,
+		"HTTP/1.1 2000 OK\r\n\r\n":                 ErrMalformedStatusLine,
+		"HTTP/2 200 OK\r\n\r\n":                    ErrUnsupportedVersion,
+		"HTTP/1.1 200 OK\r\nBad Header: x\r\n\r\n": ErrMalformedHeader,
+		"HTTP/1.1 200 OK\r\nContent-":              ErrIncompleteResponse,
+	} {
+		_, err := ResponseFromReader(strings.NewReader(data))
+		assert.ErrorIs(t, err, want, data)
+	}
+}
+
+func TestBodyFraming(t *testing.T) {
+	for name, tc := range map[string]struct {
+		method   string
+		data     string
+		body     string
+		trailers map[string]string
+		err      error
+	}{
+		"Content-Length": {
+			data: "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nhello world!\n",
+			body: "hello world!\n",
+		},
+		"Content-Length zero": {
+			data: "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+		},
+		"chunked": {
+			data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6;ext=1\r\n world\r\n0\r\n\r\n",
+			body: "hello world",
+		},
+		"chunked with trailers": {
+			data:     "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum, X-Len\r\n\r\na\r\n0123456789\r\n0\r\nX-Sum: abc\r\nX-Len: 10\r\n\r\n",
+			body:     "0123456789",
+			trailers: map[string]string{"x-sum": "abc", "x-len": "10"},
+		},
+		"chunked after another coding": {
+			data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip, chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+			body: "abc",
+		},
+		"until close": {
+			data: "HTTP/1.0 200 OK\r\n\r\nuntil the end",
+			body: "until the end",
+		},
+		"HEAD has no body": {
+			method: "HEAD",
+			data:   "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+		},
+		"304 has no body": {
+			data: "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n",
+		},
+		"interim response": {
+			data: "HTTP/1.1 100 Continue\r\n\r\n",
+		},
+		"short body": {
+			data: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello",
+			err:  ErrIncompleteResponse,
+		},
+		"bad Content-Length": {
+			data: "HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+			err:  ErrInvalidContentLength,
+		},
+		"bad chunk size": {
+			data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+			err:  ErrMalformedChunk,
+		},
+		"missing chunk end": {
+			data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhello\r\n0\r\n\r\n",
+			err:  ErrMalformedChunk,
+		},
+		"truncated chunked": {
+			data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel",
+			err:  ErrIncompleteResponse,
+		},
+		"bad trailer": {
+			data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nBad Trailer: x\r\n\r\n",
+			err:  ErrMalformedHeader,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = "GET"
+			}
+			// Test: Any read size gives the same result
+			for _, size := range []int{1, 3, 64, 4096} {
+				r, _, err := ReadResponse(&chunkReader{data: tc.data, numBytesPerRead: size}, method)
+				if tc.err != nil {
+					assert.ErrorIs(t, err, tc.err)
+					continue
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tc.body, string(r.Body))
+				assert.Len(t, r.Trailers, len(tc.trailers))
+				for k, v := range tc.trailers {
+					assert.Equal(t, v, r.Trailers[k])
+				}
+			}
+		})
+	}
+}
+
+func TestReadResponseRemainder(t *testing.T) {
+	// Test: Bytes past a framed response are returned
+	r, leftover, err := ReadResponse(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokHTTP/1.1 204 No Content\r\n\r\n"), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(r.Body))
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", string(leftover))
+
+	// Test: Reading only the head leaves the body unread
+	r, leftover, err = ReadResponseHead(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+	assert.Equal(t, "hello", string(leftover))
+	framing, length, err := r.Framing("GET")
+	require.NoError(t, err)
+	assert.Equal(t, FramingContentLength, framing)
+	assert.Equal(t, int64(5), length)
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	// Test: A chunked response with trailers from Writer parses back
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeOK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Content-Length")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-Length", "11")
+	require.NoError(t, w.WriteTrailers(trailers))
+
+	r, err := ResponseFromReader(&chunkReader{data: buf.String(), numBytesPerRead: 7})
+	require.NoError(t, err)
+	assert.Equal(t, StatusCodeOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "hello world", string(r.Body))
+	assert.Equal(t, "11", r.Trailers["x-content-length"])
+
+	// Test: A response with default headers parses back
+	buf.Reset()
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeBadRequest))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(4)))
+	_, err = w.WriteBody([]byte("oops"))
+	require.NoError(t, err)
+	r, err = ResponseFromReader(buf)
+	require.NoError(t, err)
+	assert.Equal(t, StatusCodeBadRequest, r.StatusLine.StatusCode)
+	assert.Equal(t, "Bad Request", r.StatusLine.ReasonPhrase)
+	assert.Equal(t, "close", r.Headers["connection"])
+	assert.Equal(t, "oops", string(r.Body))
+}
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+// Read reads up to len(p) or numBytesPerRead bytes from the string per call
+// it's useful for simulating reading a variable number of bytes per chunk from a network connection
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := cr.pos + cr.numBytesPerRead
+	if endIndex > len(cr.data) {
+		endIndex = len(cr.data)
+	}
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
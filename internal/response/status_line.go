@@ -8,20 +8,71 @@ import (
 type StatusCode int
 
 const (
-	StatusCodeOK                  StatusCode = 200
-	StatusCodeBadRequest          StatusCode = 400
-	StatusCodeInternalServerError StatusCode = 500
+	StatusCodeSwitchingProtocols   StatusCode = 101
+	StatusCodeOK                   StatusCode = 200
+	StatusCodePartialContent       StatusCode = 206
+	StatusCodeMovedPermanently     StatusCode = 301
+	StatusCodeNotModified          StatusCode = 304
+	StatusCodeBadRequest           StatusCode = 400
+	StatusCodeForbidden            StatusCode = 403
+	StatusCodeNotFound             StatusCode = 404
+	StatusCodeMethodNotAllowed     StatusCode = 405
+	StatusCodeProxyAuthRequired    StatusCode = 407
+	StatusCodePreconditionFailed   StatusCode = 412
+	StatusCodeContentTooLarge      StatusCode = 413
+	StatusCodeUnsupportedMediaType StatusCode = 415
+	StatusCodeRangeNotSatisfiable  StatusCode = 416
+	StatusCodeUpgradeRequired      StatusCode = 426
+	StatusCodeInternalServerError  StatusCode = 500
+	StatusCodeNotImplemented       StatusCode = 501
+	StatusCodeBadGateway           StatusCode = 502
+	StatusCodeServiceUnavailable   StatusCode = 503
+	StatusCodeGatewayTimeout       StatusCode = 504
 )
 
 func getStatusLine(statusCode StatusCode) []byte {
 	reasonPhrase := ""
 	switch statusCode {
+	case StatusCodeSwitchingProtocols:
+		reasonPhrase = "Switching Protocols"
 	case StatusCodeOK:
 		reasonPhrase = "OK"
+	case StatusCodePartialContent:
+		reasonPhrase = "Partial Content"
+	case StatusCodeMovedPermanently:
+		reasonPhrase = "Moved Permanently"
+	case StatusCodeNotModified:
+		reasonPhrase = "Not Modified"
 	case StatusCodeBadRequest:
 		reasonPhrase = "Bad Request"
+	case StatusCodeForbidden:
+		reasonPhrase = "Forbidden"
+	case StatusCodeNotFound:
+		reasonPhrase = "Not Found"
+	case StatusCodeMethodNotAllowed:
+		reasonPhrase = "Method Not Allowed"
+	case StatusCodeProxyAuthRequired:
+		reasonPhrase = "Proxy Authentication Required"
+	case StatusCodePreconditionFailed:
+		reasonPhrase = "Precondition Failed"
+	case StatusCodeContentTooLarge:
+		reasonPhrase = "Content Too Large"
+	case StatusCodeUnsupportedMediaType:
+		reasonPhrase = "Unsupported Media Type"
+	case StatusCodeRangeNotSatisfiable:
+		reasonPhrase = "Range Not Satisfiable"
+	case StatusCodeUpgradeRequired:
+		reasonPhrase = "Upgrade Required"
 	case StatusCodeInternalServerError:
 		reasonPhrase = "Internal Server Error"
+	case StatusCodeNotImplemented:
+		reasonPhrase = "Not Implemented"
+	case StatusCodeBadGateway:
+		reasonPhrase = "Bad Gateway"
+	case StatusCodeServiceUnavailable:
+		reasonPhrase = "Service Unavailable"
+	case StatusCodeGatewayTimeout:
+		reasonPhrase = "Gateway Timeout"
 	}
 	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase))
 }
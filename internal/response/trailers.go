@@ -0,0 +1,80 @@
+package response
+
+import (
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"strings"
+)
+
+// prohibitedTrailers lists the fields that RFC 9110 section 6.5.1 forbids
+// in a trailer section: message framing, routing, request modifiers,
+// authentication, response control and payload processing fields.
+var prohibitedTrailers = map[string]bool{
+	"transfer-encoding":   true,
+	"content-length":      true,
+	"host":                true,
+	"cache-control":       true,
+	"expect":              true,
+	"max-forwards":        true,
+	"pragma":              true,
+	"range":               true,
+	"te":                  true,
+	"if-match":            true,
+	"if-none-match":       true,
+	"if-modified-since":   true,
+	"if-unmodified-since": true,
+	"if-range":            true,
+	"authorization":       true,
+	"proxy-authorization": true,
+	"www-authenticate":    true,
+	"proxy-authenticate":  true,
+	"set-cookie":          true,
+	"age":                 true,
+	"expires":             true,
+	"date":                true,
+	"location":            true,
+	"retry-after":         true,
+	"vary":                true,
+	"warning":             true,
+	"content-encoding":    true,
+	"content-type":        true,
+	"content-range":       true,
+	"trailer":             true,
+}
+
+// IsProhibitedTrailer reports whether the field name may not be sent as a
+// trailer.
+func IsProhibitedTrailer(name string) bool {
+	return prohibitedTrailers[strings.ToLower(name)]
+}
+
+// declaredTrailers returns the set of field names announced in the
+// Trailer header. Repeated Trailer headers are joined with ", " by
+// headers.Set, so splitting on commas covers both forms.
+func declaredTrailers(h headers.Headers) map[string]bool {
+	declared := map[string]bool{}
+	value, ok := h.Get("Trailer")
+	if !ok {
+		return declared
+	}
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			declared[name] = true
+		}
+	}
+	return declared
+}
+
+// IsChunked reports whether the final transfer coding in h is chunked,
+// which is what decides how the message body is framed.
+func IsChunked(h headers.Headers) bool {
+	value, ok := h.Get("Transfer-Encoding")
+	if !ok {
+		return false
+	}
+
+	codings := strings.Split(value, ",")
+	last := strings.ToLower(strings.TrimSpace(codings[len(codings)-1]))
+	return last == "chunked"
+}
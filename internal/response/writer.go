@@ -1,9 +1,11 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"github.com/peeta98/httpfromtcp/internal/headers"
 	"io"
+	"strings"
 )
 
 type writerState int
@@ -15,84 +17,120 @@ const (
 	TrailersState
 )
 
+// Sink receives the parts of a response once Writer has checked that they
+// arrive in a valid order. Middleware can wrap a Writer in its own Sink to
+// rewrite headers or transform the body on the way to the connection.
+// WriteBody and WriteChunkedBody return how many bytes of p were written,
+// not counting any framing around them.
+type Sink interface {
+	WriteStatusLine(statusCode StatusCode) error
+	WriteHeaders(h headers.Headers) error
+	WriteBody(p []byte) (int, error)
+	WriteChunkedBody(p []byte) (int, error)
+	WriteChunkedBodyDone() (int, error)
+	WriteTrailers(h headers.Headers) error
+}
+
 type Writer struct {
-	writer      io.Writer
-	writerState writerState
+	sink         Sink
+	writerState  writerState
+	chunked      bool
+	trailers     map[string]bool
+	statusCode   StatusCode
+	bytesWritten int64
+	hijacked     bool
 }
 
 func NewWriter(w io.Writer) *Writer {
+	return NewSinkWriter(&wireSink{writer: w})
+}
+
+func NewSinkWriter(s Sink) *Writer {
 	return &Writer{
-		writer:      w,
+		sink:        s,
 		writerState: StatusLineState,
 	}
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
 	if w.writerState != StatusLineState {
 		return fmt.Errorf("cannot write status line: expected state StatusLineState, but current state is %v", w.writerState)
 	}
 
-	err := WriteStatusLine(w.writer, statusCode)
+	err := w.sink.WriteStatusLine(statusCode)
 	if err != nil {
 		return err
 	}
 	w.writerState = HeadersState
+	w.statusCode = statusCode
 
 	return nil
 }
 
 func (w *Writer) WriteHeaders(h headers.Headers) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
 	if w.writerState != HeadersState {
 		return fmt.Errorf("cannot write headers: expected state HeadersState, but current state is %v", w.writerState)
 	}
 
-	err := WriteHeaders(w.writer, h)
+	trailers := declaredTrailers(h)
+	for name := range trailers {
+		if IsProhibitedTrailer(name) {
+			return fmt.Errorf("cannot declare trailer: %s is not allowed in trailers", name)
+		}
+	}
+
+	err := w.sink.WriteHeaders(h)
 	if err != nil {
 		return err
 	}
 	w.writerState = BodyState
+	w.chunked = IsChunked(h)
+	w.trailers = trailers
 
 	return nil
 }
 
 func (w *Writer) WriteBody(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 	if w.writerState != BodyState {
 		return 0, fmt.Errorf("cannot write body: expected state BodyState, but current state is %v", w.writerState)
 	}
 
-	return w.writer.Write(p)
+	n, err := w.sink.WriteBody(p)
+	w.bytesWritten += int64(n)
+	return n, err
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 	if w.writerState != BodyState {
 		return 0, fmt.Errorf("cannot write body in state %d", w.writerState)
 	}
 
-	var nTotal int
-	chunkSizeHex := []byte(fmt.Sprintf("%x\r\n", len(p)))
-	n, err := w.writer.Write(chunkSizeHex)
-	if err != nil {
-		return 0, err
-	}
-	nTotal += n
-
-	n, err = w.writer.Write(p)
-	if err != nil {
-		return nTotal, err
-	}
-	nTotal += n
-
-	n, err = w.writer.Write([]byte("\r\n"))
-	return nTotal + n, err
+	n, err := w.sink.WriteChunkedBody(p)
+	w.bytesWritten += int64(n)
+	return n, err
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 	if w.writerState != BodyState {
 		return 0, fmt.Errorf("cannot write body in state %d", w.writerState)
 	}
 
-	finalChunkPart := []byte("0\r\n")
-	n, err := w.writer.Write(finalChunkPart)
+	n, err := w.sink.WriteChunkedBodyDone()
 	if err != nil {
 		return n, err
 	}
@@ -102,18 +140,87 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 }
 
 func (w *Writer) WriteTrailers(h headers.Headers) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
 	if w.writerState != TrailersState {
 		return fmt.Errorf("cannot write trailers in state %d", w.writerState)
 	}
 
+	if !w.chunked {
+		return errors.New("cannot write trailers: response is not using chunked transfer encoding")
+	}
+
+	for k := range h {
+		if IsProhibitedTrailer(k) {
+			return fmt.Errorf("cannot write trailer: %s is not allowed in trailers", k)
+		}
+		if !w.trailers[strings.ToLower(k)] {
+			return fmt.Errorf("cannot write trailer: %s was not declared in the Trailer header", k)
+		}
+	}
+
+	return w.sink.WriteTrailers(h)
+}
+
+// StatusCode returns the status code written so far, or 0 if the status
+// line has not been written.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns the number of body bytes written, not counting
+// chunked encoding framing.
+func (w *Writer) BytesWritten() int64 {
+	return w.bytesWritten
+}
+
+// wireSink encodes a response in HTTP/1.1 wire format.
+type wireSink struct {
+	writer io.Writer
+}
+
+func (s *wireSink) WriteStatusLine(statusCode StatusCode) error {
+	return WriteStatusLine(s.writer, statusCode)
+}
+
+func (s *wireSink) WriteHeaders(h headers.Headers) error {
+	return WriteHeaders(s.writer, h)
+}
+
+func (s *wireSink) WriteBody(p []byte) (int, error) {
+	return s.writer.Write(p)
+}
+
+func (s *wireSink) WriteChunkedBody(p []byte) (int, error) {
+	chunkSizeHex := []byte(fmt.Sprintf("%x\r\n", len(p)))
+	if _, err := s.writer.Write(chunkSizeHex); err != nil {
+		return 0, err
+	}
+
+	n, err := s.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	_, err = s.writer.Write([]byte("\r\n"))
+	return n, err
+}
+
+func (s *wireSink) WriteChunkedBodyDone() (int, error) {
+	finalChunkPart := []byte("0\r\n")
+	return s.writer.Write(finalChunkPart)
+}
+
+func (s *wireSink) WriteTrailers(h headers.Headers) error {
 	for k, v := range h {
 		headerResponse := fmt.Sprintf("%s: %s\r\n", k, v)
-		_, err := w.writer.Write([]byte(headerResponse))
+		_, err := s.writer.Write([]byte(headerResponse))
 		if err != nil {
 			return err
 		}
 	}
 
-	_, err := w.writer.Write([]byte("\r\n"))
+	_, err := s.writer.Write([]byte("\r\n"))
 	return err
 }
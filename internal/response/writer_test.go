@@ -0,0 +1,167 @@
+package response
+
+import (
+	"bytes"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWriterTrailers(t *testing.T) {
+	newChunkedWriter := func(trailers ...string) (*Writer, *bytes.Buffer) {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf)
+		require.NoError(t, w.WriteStatusLine(StatusCodeOK))
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		for _, name := range trailers {
+			h.Set("Trailer", name)
+		}
+		require.NoError(t, w.WriteHeaders(h))
+		_, err := w.WriteChunkedBody([]byte("hello"))
+		require.NoError(t, err)
+		_, err = w.WriteChunkedBodyDone()
+		require.NoError(t, err)
+		return w, buf
+	}
+
+	// Test: Declared trailers announced via two Set calls
+	w, buf := newChunkedWriter("X-Content-SHA256", "X-Content-Length")
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-SHA256", "abc")
+	trailers.Set("X-Content-Length", "5")
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Contains(t, buf.String(), "x-content-sha256: abc\r\n")
+	assert.Contains(t, buf.String(), "x-content-length: 5\r\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")))
+
+	// Test: Undeclared trailer
+	w, buf = newChunkedWriter("X-Content-SHA256")
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Other", "nope")
+	before := buf.Len()
+	require.Error(t, w.WriteTrailers(trailers))
+	assert.Equal(t, before, buf.Len())
+
+	// Test: Prohibited trailer, even when declared
+	w, _ = newChunkedWriter()
+	w.trailers["content-length"] = true
+	trailers = headers.NewHeaders()
+	trailers.Set("Content-Length", "5")
+	require.Error(t, w.WriteTrailers(trailers))
+
+	// Test: Declaring a prohibited trailer
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusCodeOK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "Transfer-Encoding")
+	require.Error(t, w.WriteHeaders(h))
+
+	// Test: Trailers on a non-chunked response
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusCodeOK))
+	h = GetDefaultHeaders(0)
+	h.Set("Trailer", "X-Content-Length")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Content-Length", "0")
+	require.Error(t, w.WriteTrailers(trailers))
+
+	// Test: No trailers on a chunked response
+	w, buf = newChunkedWriter()
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("0\r\n\r\n")))
+}
+
+func TestWriterCounters(t *testing.T) {
+	// Test: Nothing written yet
+	w := NewWriter(&bytes.Buffer{})
+	assert.Zero(t, w.StatusCode())
+	assert.Zero(t, w.BytesWritten())
+
+	// Test: Plain body
+	require.NoError(t, w.WriteStatusLine(StatusCodeNotFound))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(9)))
+	w.WriteBody([]byte("not "))
+	w.WriteBody([]byte("found"))
+	assert.Equal(t, StatusCodeNotFound, w.StatusCode())
+	assert.Equal(t, int64(9), w.BytesWritten())
+
+	// Test: Chunk framing is not counted
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusCodeOK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	w.WriteChunkedBody([]byte("hello"))
+	w.WriteChunkedBodyDone()
+	assert.Equal(t, int64(5), w.BytesWritten())
+
+	// Test: Failed plain write counts only what reached the connection
+	short := &shortWriter{left: 1 << 10}
+	w = NewWriter(short)
+	require.NoError(t, w.WriteStatusLine(StatusCodeOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	short.left = 2
+	_, err := w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+	assert.Equal(t, int64(2), w.BytesWritten())
+
+	// Test: Failed chunked write is counted the same way
+	short = &shortWriter{left: 1 << 10}
+	w = NewWriter(short)
+	require.NoError(t, w.WriteStatusLine(StatusCodeOK))
+	require.NoError(t, w.WriteHeaders(h))
+	short.left = len("5\r\n") + 2
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.Error(t, err)
+	assert.Equal(t, int64(2), w.BytesWritten())
+}
+
+// shortWriter accepts left more bytes and then fails.
+type shortWriter struct {
+	bytes.Buffer
+	left int
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	if len(p) <= s.left {
+		s.left -= len(p)
+		return s.Buffer.Write(p)
+	}
+	n, _ := s.Buffer.Write(p[:s.left])
+	s.left = 0
+	return n, io.ErrShortWrite
+}
+
+func TestWriterHijack(t *testing.T) {
+	// Test: Writers not backed by a connection cannot be hijacked
+	_, _, err := NewWriter(&bytes.Buffer{}).Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+
+	// Test: Hijack hands over the connection and disables the Writer
+	server, client := net.Pipe()
+	defer client.Close()
+	buf := &bytes.Buffer{}
+	w := NewHijackableWriter(buf, func() (net.Conn, []byte, error) {
+		return server, []byte("early"), nil
+	})
+	require.NoError(t, w.WriteStatusLine(StatusCodeSwitchingProtocols))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"upgrade": "echo"}))
+	conn, buffered, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Same(t, server, conn)
+	assert.Equal(t, "early", string(buffered))
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nupgrade: echo\r\n\r\n", buf.String())
+
+	_, err = w.WriteBody([]byte("late"))
+	assert.ErrorIs(t, err, ErrHijacked)
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, ErrHijacked)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// temporaryAcceptErrors are failures that say nothing about the health of
+// the listener itself. Running out of file descriptors (EMFILE, ENFILE) is
+// the common one: retrying straight away only spins until a descriptor is
+// freed.
+var temporaryAcceptErrors = []syscall.Errno{
+	syscall.EMFILE,
+	syscall.ENFILE,
+	syscall.ENOBUFS,
+	syscall.ENOMEM,
+	syscall.ECONNABORTED,
+	syscall.ECONNRESET,
+	syscall.EINTR,
+	syscall.EAGAIN,
+}
+
+func isTemporaryAcceptError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, errno := range temporaryAcceptErrors {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextAcceptBackoff doubles the delay before the next Accept, starting at
+// minAcceptBackoff and capped at maxAcceptBackoff.
+func nextAcceptBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return minAcceptBackoff
+	}
+	return min(backoff*2, maxAcceptBackoff)
+}
+
+// Err returns a channel that delivers the error that stopped the server
+// when the listener fails permanently. The channel is closed without a
+// value when the server is closed normally.
+func (s *Server) Err() <-chan error {
+	return s.errCh
+}
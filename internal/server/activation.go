@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by socket activation,
+// right after stdin, stdout and stderr.
+const listenFdsStart = 3
+
+// InheritedListeners returns the listening sockets passed to this process
+// through the systemd socket activation protocol (LISTEN_FDS, LISTEN_PID
+// and LISTEN_FDNAMES), or by a parent process through Handoff. It returns
+// no listeners when none were passed.
+//
+// LISTEN_PID is checked when present. Handoff leaves it out because the
+// parent cannot know the child's pid before starting it.
+//
+// The variables are removed from the environment so they are not passed
+// on to processes started later.
+func InheritedListeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	fdsValue, ok := os.LookupEnv("LISTEN_FDS")
+	if !ok {
+		return nil, nil
+	}
+	if pid, ok := os.LookupEnv("LISTEN_PID"); ok && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(fdsValue)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", fdsValue)
+	}
+
+	var names []string
+	if value, ok := os.LookupEnv("LISTEN_FDNAMES"); ok {
+		names = strings.Split(value, ":")
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// net.FileListener works on a duplicate, so the inherited
+		// descriptor is closed straight away.
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited file descriptor %d (%s): %w", listenFdsStart+i, name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// ListenOrInherit returns the first inherited listener when the process
+// was socket activated or started by Handoff, and otherwise listens on
+// addr as described by Listen.
+func ListenOrInherit(addr string) (net.Listener, error) {
+	listeners, err := InheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 {
+		return Listen(addr)
+	}
+
+	for _, extra := range listeners[1:] {
+		extra.Close()
+	}
+	return listeners[0], nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"io"
+	"net"
+)
+
+// ConnState is a stage in the life of a connection, reported to the
+// callback set with WithConnState.
+type ConnState int
+
+const (
+	// StateNew is a connection that has just been accepted. It moves to
+	// StateActive once the first byte of a request has been read.
+	StateNew ConnState = iota
+	// StateActive is a connection that is reading a request or whose
+	// request is being handled.
+	StateActive
+	// StateIdle is a connection that has finished a request and is waiting
+	// for the next one. Responses currently close the connection, so this
+	// state is only reached once keep-alive is in use.
+	StateIdle
+	// StateHijacked is a connection taken over by a handler. It is final:
+	// the server no longer tracks the connection and reports no
+	// StateClosed for it.
+	StateHijacked
+	// StateClosed is a connection the server has closed. It is final.
+	StateClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateHijacked:
+		return "hijacked"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// WithConnState calls fn whenever a connection changes state. Calls for
+// one connection are made in order from the goroutine serving it, or
+// from the accept loop for StateNew, so fn must be safe for concurrent
+// use across connections and should return quickly.
+func WithConnState(fn func(net.Conn, ConnState)) Option {
+	return func(s *Server) {
+		s.connState = fn
+	}
+}
+
+func (s *Server) setState(conn net.Conn, state ConnState) {
+	if s.connState != nil {
+		s.connState(conn, state)
+	}
+}
+
+// activeOnRead wraps a connection's reader to report StateActive once
+// the first byte of a request arrives.
+type activeOnRead struct {
+	r        io.Reader
+	activate func()
+}
+
+func (a *activeOnRead) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 && a.activate != nil {
+		a.activate()
+		a.activate = nil
+	}
+	return n, err
+}
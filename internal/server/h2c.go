@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"github.com/peeta98/httpfromtcp/internal/http2"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"log"
+	"net"
+)
+
+// WithH2C makes the server speak cleartext HTTP/2 to clients that open
+// the connection with the HTTP/2 preface (prior knowledge) or ask for it
+// with "Upgrade: h2c". Each stream reaches the handler as an ordinary
+// request with HttpVersion "2". TLS connections keep using HTTP/1.1.
+func WithH2C() Option {
+	return func(s *Server) {
+		s.h2c = true
+	}
+}
+
+// serveHTTP2 serves a connection that has switched to HTTP/2. upgrade is
+// the request that asked for the switch, or nil for prior knowledge.
+func (s *Server) serveHTTP2(conn net.Conn, buffered []byte, upgrade *request.Request) {
+	// A connection with no open streams is idle, the way an HTTP/1
+	// connection is between requests.
+	idle := true
+	s.idleConns.Add(1)
+	s.setState(conn, StateIdle)
+
+	h2 := &http2.Server{
+		Handler:     s.serveStream,
+		BaseContext: s.baseCtx,
+		Shutdown:    s.done,
+		ConnState: func(conn net.Conn, active bool) {
+			idle = !active
+			if active {
+				s.idleConns.Add(-1)
+				s.setState(conn, StateActive)
+			} else {
+				s.idleConns.Add(1)
+				s.setState(conn, StateIdle)
+			}
+		},
+	}
+
+	var err error
+	if upgrade != nil {
+		err = h2.ServeUpgrade(conn, buffered, upgrade)
+	} else {
+		err = h2.ServeConn(conn, buffered)
+	}
+	if idle {
+		s.idleConns.Add(-1)
+	}
+	if err != nil {
+		log.Printf("HTTP/2 connection from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// serveStream handles one HTTP/2 stream. Its context is already cancelled
+// when the stream is reset or the connection closes.
+func (s *Server) serveStream(w *response.Writer, req *request.Request) {
+	if s.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), s.requestTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	s.serveRequest(w, req)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readyFdEnv names the environment variable through which Handoff tells
+// the child which descriptor to report readiness on.
+const readyFdEnv = "HTTPFROMTCP_READY_FD"
+
+const handoffReadyTimeout = 30 * time.Second
+
+// handoffFdName names the listener in LISTEN_FDNAMES. Names are separated
+// by colons there, so the listening address can't be used.
+const handoffFdName = "handoff"
+
+// Handoff starts a fresh copy of the running executable, with the same
+// arguments, and passes it the server's listening socket as an inherited
+// file (LISTEN_FDS=1). It returns once the child has called NotifyReady,
+// after which the caller should Shutdown this server so in-flight requests
+// drain while the child takes new connections. Connections that arrive in
+// between wait in the socket's backlog, so none are dropped.
+func (s *Server) Handoff() (*os.Process, error) {
+	filer, ok := s.listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("cannot hand off listener of type %T", s.listener)
+	}
+
+	listenerFile, err := filer.File()
+	if err != nil {
+		return nil, err
+	}
+	defer listenerFile.Close()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		return nil, err
+	}
+
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "LISTEN_") || strings.HasPrefix(kv, readyFdEnv+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env,
+		"LISTEN_FDS=1",
+		"LISTEN_FDNAMES="+handoffFdName,
+		readyFdEnv+"="+strconv.Itoa(listenFdsStart+1),
+	)
+
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, listenerFile, readyWriter},
+	})
+	readyWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	readyReader.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	if _, err := readyReader.Read(make([]byte, 1)); err != nil {
+		process.Kill()
+		process.Release()
+		return nil, fmt.Errorf("new process did not become ready: %w", err)
+	}
+
+	// The socket now lives on in the child, so closing ours must not
+	// remove the path it is bound to.
+	if unixListener, ok := s.listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+	return process, nil
+}
+
+// NotifyReady tells the parent that started this process with Handoff that
+// it is now serving, so the parent can begin draining. It does nothing
+// when the process was not started by Handoff.
+func NotifyReady() error {
+	value, ok := os.LookupEnv(readyFdEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(readyFdEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.New("invalid " + readyFdEnv + ": " + value)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"io"
+	"net"
+	"time"
+)
+
+// OverloadPolicy decides what happens to connections that arrive while the
+// server is at its connection limit.
+type OverloadPolicy int
+
+const (
+	// OverloadWait stops accepting until a connection closes. Clients
+	// queue in the listen backlog and are served once there is room.
+	OverloadWait OverloadPolicy = iota
+	// OverloadReject accepts the connection, answers 503 Service
+	// Unavailable with a Retry-After header and closes it.
+	OverloadReject
+)
+
+const (
+	defaultRetryAfter = 5 * time.Second
+	rejectTimeout     = time.Second
+)
+
+// ConnectionStats is a snapshot of the server's connection counters.
+type ConnectionStats struct {
+	// Active is the number of connections currently being handled.
+	Active int64
+	// Accepted counts every connection handed to a handler.
+	Accepted uint64
+	// Rejected counts connections turned away with 503 because the
+	// server was at its connection limit.
+	Rejected uint64
+}
+
+func (s *Server) ConnectionStats() ConnectionStats {
+	return ConnectionStats{
+		Active:   s.activeConns.Load(),
+		Accepted: s.acceptedConns.Load(),
+		Rejected: s.rejectedConns.Load(),
+	}
+}
+
+// waitForSlot blocks until a connection slot is free. It returns false if
+// the server is closed while waiting.
+func (s *Server) waitForSlot() bool {
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *Server) tryAcquireSlot() bool {
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseSlot() {
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+}
+
+// reject answers a connection over the limit with 503. Closing a socket
+// with an unread request in its receive buffer makes the kernel send a
+// reset that can destroy the response before the client reads it, so the
+// write side is shut first and the request drained briefly. At most as
+// many rejections as the connection limit run at once; beyond that the
+// connection is simply closed.
+func (s *Server) reject(conn net.Conn) {
+	s.rejectedConns.Add(1)
+
+	if s.rejecting.Add(1) > int64(cap(s.connSlots)) {
+		s.rejecting.Add(-1)
+		conn.Close()
+		return
+	}
+
+	go func() {
+		defer s.rejecting.Add(-1)
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(rejectTimeout))
+		body := []byte("Service unavailable: too many connections")
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Retry-After", fmt.Sprintf("%d", retryAfterSeconds(s.retryAfter)))
+		if err := response.WriteStatusLine(conn, response.StatusCodeServiceUnavailable); err != nil {
+			return
+		}
+		if err := response.WriteHeaders(conn, h); err != nil {
+			return
+		}
+		if _, err := conn.Write(body); err != nil {
+			return
+		}
+
+		if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+}
+
+// retryAfterSeconds rounds d up to the whole seconds Retry-After is given
+// in, so that clients never retry sooner than asked, and at least to one.
+func retryAfterSeconds(d time.Duration) int {
+	seconds := int((d + time.Second - 1) / time.Second)
+	return max(seconds, 1)
+}
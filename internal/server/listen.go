@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const unixPrefix = "unix:"
+
+// Listen opens a listener for addr. Addresses of the form "unix:/path"
+// listen on a Unix domain socket; anything else is a TCP host:port such as
+// ":42069" or "127.0.0.1:0".
+func Listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return listener, err
+	}
+
+	// A socket file left behind by a process that died without cleaning
+	// up blocks the listen. Only remove it when it is a socket and nobody
+	// answers on it; anything else at the path is left alone.
+	if info, statErr := os.Lstat(path); statErr != nil || info.Mode()&fs.ModeSocket == 0 {
+		return nil, err
+	}
+	if conn, dialErr := net.Dial("unix", path); dialErr == nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// ServeAddr is like Serve but listens on an address string as understood
+// by Listen, including Unix domain sockets.
+func ServeAddr(addr string, handler Handler, opts ...Option) (*Server, error) {
+	listener, err := Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return ServeListener(listener, handler, opts...)
+}
+
+// ServeListener serves connections accepted from listener, which the
+// server takes ownership of and closes in Close.
+func ServeListener(listener net.Listener, handler Handler, opts ...Option) (*Server, error) {
+	if listener == nil {
+		return nil, errors.New("nil listener")
+	}
+	return serve(listener, handler, nil, opts), nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"errors"
+	"github.com/peeta98/httpfromtcp/internal/metrics"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverMetrics are the metrics every Server maintains.
+type serverMetrics struct {
+	registry     *metrics.Registry
+	requests     *metrics.Counter
+	duration     *metrics.Histogram
+	requestSize  *metrics.Histogram
+	responseSize *metrics.Histogram
+	parseErrors  *metrics.Counter
+	metricsPath  string
+	routeLabel   func(*request.Request) string
+}
+
+func (s *Server) initMetrics() {
+	r := metrics.NewRegistry()
+	m := &s.metrics
+	m.registry = r
+	m.requests = r.Counter("http_requests_total",
+		"Requests handled, by method, route and response status.", "method", "route", "status")
+	m.duration = r.Histogram("http_request_duration_seconds",
+		"Time spent handling requests, from the request being parsed to the handler returning.",
+		metrics.DurationBuckets, "method", "route")
+	m.requestSize = r.Histogram("http_request_size_bytes",
+		"Size of request bodies.", metrics.SizeBuckets, "method", "route")
+	m.responseSize = r.Histogram("http_response_size_bytes",
+		"Size of response bodies.", metrics.SizeBuckets, "method", "route")
+	m.parseErrors = r.Counter("http_request_parse_errors_total",
+		"Requests that could not be parsed, by kind of error.", "type")
+
+	r.GaugeFunc("http_connections_active", "Connections currently handling a request.", func() float64 {
+		return float64(s.activeConns.Load() - s.idleConns.Load())
+	})
+	r.GaugeFunc("http_connections_idle", "Connections open and waiting for a request.", func() float64 {
+		return float64(s.idleConns.Load())
+	})
+	r.CounterFunc("http_connections_accepted_total", "Connections accepted and handed to a handler.", func() float64 {
+		return float64(s.acceptedConns.Load())
+	})
+	r.CounterFunc("http_connections_rejected_total", "Connections refused because of the connection limit.", func() float64 {
+		return float64(s.rejectedConns.Load())
+	})
+}
+
+// Metrics returns the registry holding the server's metrics. Programs can
+// register metrics of their own in it to have them exposed alongside.
+func (s *Server) Metrics() *metrics.Registry {
+	return s.metrics.registry
+}
+
+// WithMetrics serves the server's metrics in the Prometheus text format
+// on GET requests to path, ahead of the handler.
+func WithMetrics(path string) Option {
+	return func(s *Server) {
+		s.metrics.metricsPath = path
+	}
+}
+
+// WithRouteLabel sets how requests are mapped to the route label of the
+// request metrics. Every label value adds series that are kept for the
+// life of the server, so routes must come from a small, fixed set, as
+// with RouteLabels; by default every request is labelled OtherRoute.
+func WithRouteLabel(route func(*request.Request) string) Option {
+	return func(s *Server) {
+		s.metrics.routeLabel = route
+	}
+}
+
+// OtherRoute is the route label of requests matching no known route.
+const OtherRoute = "other"
+
+// RouteLabels returns a route label function for WithRouteLabel. A request
+// is labelled with the longest of routes that its path equals or is below,
+// so "/assets" covers "/assets/css/a.css", and with OtherRoute when none
+// matches. CONNECT and absolute-form requests are OtherRoute too.
+func RouteLabels(routes ...string) func(*request.Request) string {
+	return func(req *request.Request) string {
+		path := requestPath(req)
+		label := OtherRoute
+		for _, route := range routes {
+			under := path == route || (route != "/" && strings.HasPrefix(path, strings.TrimSuffix(route, "/")+"/"))
+			if under && (label == OtherRoute || len(route) > len(label)) {
+				label = route
+			}
+		}
+		return label
+	}
+}
+
+// metricMethods are the methods request metrics are labelled with. Any
+// other method is labelled "OTHER", as clients can send arbitrary ones.
+var metricMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE"}
+
+func methodLabel(method string) string {
+	if slices.Contains(metricMethods, method) {
+		return method
+	}
+	return "OTHER"
+}
+
+func requestPath(req *request.Request) string {
+	path, _, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	return path
+}
+
+func (s *Server) isMetricsRequest(req *request.Request) bool {
+	return s.metrics.metricsPath != "" && requestPath(req) == s.metrics.metricsPath
+}
+
+func (s *Server) serveMetrics(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD" {
+		body := []byte("Method Not Allowed")
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Allow", "GET, HEAD")
+		w.WriteStatusLine(response.StatusCodeMethodNotAllowed)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+		return
+	}
+
+	var body strings.Builder
+	s.metrics.registry.WriteText(&body)
+	h := response.GetDefaultHeaders(body.Len())
+	h.Override("Content-Type", metrics.ContentType)
+	h.Set("Cache-Control", "no-store")
+	w.WriteStatusLine(response.StatusCodeOK)
+	w.WriteHeaders(h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody([]byte(body.String()))
+	}
+}
+
+// observeRequest records a handled request.
+func (s *Server) observeRequest(w *response.Writer, req *request.Request, start time.Time) {
+	route := s.metrics.metricsPath
+	if !s.isMetricsRequest(req) {
+		route = OtherRoute
+		if s.metrics.routeLabel != nil {
+			route = s.metrics.routeLabel(req)
+		}
+	}
+	method := methodLabel(req.RequestLine.Method)
+	m := &s.metrics
+	m.requests.Inc(method, route, strconv.Itoa(int(w.StatusCode())))
+	m.duration.Observe(time.Since(start).Seconds(), method, route)
+	m.requestSize.Observe(float64(len(req.Body)), method, route)
+	m.responseSize.Observe(float64(w.BytesWritten()), method, route)
+}
+
+var parseErrorTypes = []struct {
+	err error
+	typ string
+}{
+	{request.ErrIncompleteRequest, "incomplete"},
+	{request.ErrMalformedRequestLine, "malformed_request_line"},
+	{request.ErrInvalidMethod, "invalid_method"},
+	{request.ErrUnsupportedVersion, "unsupported_version"},
+	{request.ErrMalformedHeader, "malformed_header"},
+	{request.ErrInvalidContentLength, "invalid_content_length"},
+	{request.ErrMalformedChunk, "malformed_chunk"},
+	{request.ErrUnsupportedTransferCoding, "unsupported_transfer_coding"},
+}
+
+// parseErrorType names the kind of a RequestFromReader error for the
+// parse error metric. Errors from reading the connection are "read".
+func parseErrorType(err error) string {
+	for _, t := range parseErrorTypes {
+		if errors.Is(err, t.err) {
+			return t.typ
+		}
+	}
+	return "read"
+}
@@ -0,0 +1,14 @@
+package server
+
+// Middleware decorates a Handler with behaviour that runs around it, such
+// as compressing the response or logging the request.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with the given middleware. The first middleware listed is
+// the outermost, so it sees the request first and the response last.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
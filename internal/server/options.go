@@ -0,0 +1,34 @@
+package server
+
+import "time"
+
+// Option configures a Server. Options are passed to Serve and its
+// variants.
+type Option func(*Server)
+
+// WithMaxConnections limits how many connections are open at once. What
+// happens to connections beyond the limit is decided by policy.
+func WithMaxConnections(limit int, policy OverloadPolicy) Option {
+	return func(s *Server) {
+		if limit > 0 {
+			s.connSlots = make(chan struct{}, limit)
+			s.overloadPolicy = policy
+		}
+	}
+}
+
+// WithRetryAfter sets the Retry-After delay sent with 503 responses when
+// connections are rejected under OverloadReject.
+func WithRetryAfter(d time.Duration) Option {
+	return func(s *Server) {
+		s.retryAfter = d
+	}
+}
+
+// WithRequestTimeout cancels a request's context once it has been handled
+// for longer than d.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = d
+	}
+}
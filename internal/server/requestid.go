@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+)
+
+// maxRequestIDLength bounds IDs taken from the client, which end up in
+// logs and response headers.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID is a middleware that gives every request an ID, stored in the
+// request's context and echoed in the X-Request-ID response header. An ID
+// already set by the client or a proxy in front is kept.
+func RequestID(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		id, ok := req.Headers.Get("X-Request-ID")
+		if !ok || id == "" || len(id) > maxRequestIDLength {
+			id = newRequestID()
+		}
+
+		ctx := context.WithValue(req.Context(), requestIDKey{}, id)
+		next(response.NewSinkWriter(requestIDSink{Writer: w, id: id}), req.WithContext(ctx))
+	}
+}
+
+// RequestIDFromContext returns the ID the RequestID middleware stored in
+// ctx.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type requestIDSink struct {
+	*response.Writer
+	id string
+}
+
+func (s requestIDSink) WriteHeaders(h headers.Headers) error {
+	h.Override("X-Request-ID", s.id)
+	return s.Writer.WriteHeaders(h)
+}
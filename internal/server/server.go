@@ -1,15 +1,24 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/http2"
 	"github.com/peeta98/httpfromtcp/internal/request"
 	"github.com/peeta98/httpfromtcp/internal/response"
 	"io"
 	"log"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+const tlsHandshakeTimeout = 10 * time.Second
+
 type Handler func(w *response.Writer, req *request.Request)
 
 type HandlerError struct {
@@ -26,29 +35,109 @@ func (he HandlerError) Write(w io.Writer) {
 }
 
 type Server struct {
-	handler  Handler
-	listener net.Listener
-	closed   atomic.Bool
+	handler   Handler
+	listener  net.Listener
+	tlsConfig *tls.Config
+	closed    atomic.Bool
+	done      chan struct{}
+	errCh     chan error
+
+	// baseCtx is the parent of every request's context. It is cancelled
+	// by Close, or by Shutdown when draining takes too long.
+	baseCtx        context.Context
+	cancelBase     context.CancelFunc
+	requestTimeout time.Duration
+
+	// mu orders tracking new connections against Close, so Shutdown never
+	// starts waiting while a connection is still being added.
+	mu       sync.Mutex
+	inFlight sync.WaitGroup
+
+	// connSlots is a semaphore holding one token per open connection when
+	// a connection limit is configured.
+	connSlots      chan struct{}
+	overloadPolicy OverloadPolicy
+	retryAfter     time.Duration
+	rejecting      atomic.Int64
+
+	activeConns   atomic.Int64
+	idleConns     atomic.Int64
+	acceptedConns atomic.Uint64
+	rejectedConns atomic.Uint64
+
+	metrics   serverMetrics
+	connState func(net.Conn, ConnState)
+	h2c       bool
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return nil, err
-	}
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	return ServeAddr(fmt.Sprintf(":%d", port), handler, opts...)
+}
 
+func serve(listener net.Listener, handler Handler, tlsConfig *tls.Config, opts []Option) *Server {
+	baseCtx, cancelBase := context.WithCancel(context.Background())
 	server := &Server{
-		handler:  handler,
-		listener: listener,
+		baseCtx:    baseCtx,
+		cancelBase: cancelBase,
+		handler:    handler,
+		listener:   listener,
+		tlsConfig:  tlsConfig,
+		done:       make(chan struct{}),
+		errCh:      make(chan error, 1),
+		retryAfter: defaultRetryAfter,
+	}
+	server.initMetrics()
+	for _, opt := range opts {
+		opt(server)
 	}
 
 	go server.listen()
 
-	return server, nil
+	return server
+}
+
+// Addr returns the address the server is listening on. With port 0 this
+// is where the actual port can be found.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
+// Close stops the server from accepting connections and cancels the
+// context of every request still being handled.
 func (s *Server) Close() error {
-	s.closed.Store(true)
+	err := s.stopAccepting()
+	s.cancelBase()
+	return err
+}
+
+// Shutdown stops accepting new connections and waits for the ones already
+// accepted to finish. If ctx is done first, the contexts of the remaining
+// requests are cancelled and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stopAccepting()
+
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		s.cancelBase()
+		return err
+	case <-ctx.Done():
+		s.cancelBase()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) stopAccepting() error {
+	s.mu.Lock()
+	if !s.closed.Swap(true) {
+		close(s.done)
+	}
+	s.mu.Unlock()
 	if s.listener != nil {
 		err := s.listener.Close()
 		return err
@@ -57,34 +146,182 @@ func (s *Server) Close() error {
 }
 
 func (s *Server) listen() {
+	defer close(s.errCh)
+
+	waitForSlot := s.connSlots != nil && s.overloadPolicy == OverloadWait
+	var backoff time.Duration
 	for {
+		if waitForSlot && !s.waitForSlot() {
+			return
+		}
+
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if waitForSlot {
+				s.releaseSlot()
+			}
 			if s.closed.Load() {
 				return
 			}
 
-			log.Printf("Error accepting connection: %v", err)
+			if !isTemporaryAcceptError(err) {
+				log.Printf("Error accepting connection, stopping server: %v", err)
+				s.errCh <- err
+				s.stopAccepting()
+				return
+			}
+
+			backoff = nextAcceptBackoff(backoff)
+			log.Printf("Error accepting connection: %v; retrying in %v", err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.done:
+				return
+			}
 			continue
 		}
+		backoff = 0
+
+		if s.tlsConfig != nil {
+			conn = tls.Server(conn, s.tlsConfig)
+		}
+
+		if s.connSlots != nil && s.overloadPolicy == OverloadReject && !s.tryAcquireSlot() {
+			s.reject(conn)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closed.Load() {
+			s.mu.Unlock()
+			s.releaseSlot()
+			conn.Close()
+			return
+		}
+		s.inFlight.Add(1)
+		s.mu.Unlock()
+
+		s.acceptedConns.Add(1)
+		s.activeConns.Add(1)
+		s.setState(conn, StateNew)
 
 		go s.handle(conn)
 	}
 }
 
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	// Once a handler hijacks the connection it is no longer ours to close
+	// or to count.
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			conn.Close()
+			s.setState(conn, StateClosed)
+			s.release()
+		}
+	}()
 
-	w := response.NewWriter(conn)
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	var (
+		unparsed []byte
+		watcher  *connWatcher
+	)
+	w := response.NewHijackableWriter(conn, func() (net.Conn, []byte, error) {
+		if watcher == nil {
+			return nil, nil, errors.New("server: connection cannot be hijacked before the request is read")
+		}
+		buffered := append(unparsed, watcher.stop()...)
+		hijacked = true
+		s.setState(conn, StateHijacked)
+		s.release()
+		return conn, buffered, nil
+	})
 
-	req, err := request.RequestFromReader(conn)
+	s.idleConns.Add(1)
+	var r io.Reader = &activeOnRead{r: conn, activate: func() {
+		s.setState(conn, StateActive)
+	}}
+	h2c := s.h2c && tlsState == nil
+	if h2c {
+		sniffed, isHTTP2, err := http2.MatchPreface(r)
+		if isHTTP2 {
+			s.idleConns.Add(-1)
+			s.serveHTTP2(conn, nil, nil)
+			return
+		}
+		if err == nil {
+			r = io.MultiReader(bytes.NewReader(sniffed), r)
+		}
+	}
+	req, unparsed, err := request.ReadRequest(r)
+	s.idleConns.Add(-1)
 	if err != nil {
-		w.WriteStatusLine(response.StatusCodeBadRequest)
+		s.metrics.parseErrors.Inc(parseErrorType(err))
+		statusCode := response.StatusCodeBadRequest
+		if errors.Is(err, request.ErrUnsupportedTransferCoding) {
+			statusCode = response.StatusCodeNotImplemented
+		}
+		w.WriteStatusLine(statusCode)
 		body := []byte(fmt.Sprintf("Error parsing request: %v", err))
 		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
 		w.WriteBody(body)
 		return
 	}
 
+	req.TLS = tlsState
+	req.RemoteAddr = conn.RemoteAddr()
+	req.LocalAddr = conn.LocalAddr()
+
+	if h2c && http2.IsUpgradeRequest(req) {
+		s.serveHTTP2(conn, unparsed, req)
+		return
+	}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if s.requestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(s.baseCtx, s.requestTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(s.baseCtx)
+	}
+	defer cancel()
+
+	watcher = watchConn(conn, cancel)
+	defer watcher.stop()
+
+	s.serveRequest(w, req.WithContext(ctx))
+}
+
+// serveRequest passes a request to the handler, or to the metrics endpoint,
+// and records it.
+func (s *Server) serveRequest(w *response.Writer, req *request.Request) {
+	start := time.Now()
+	defer s.observeRequest(w, req, start)
+
+	if s.isMetricsRequest(req) {
+		s.serveMetrics(w, req)
+		return
+	}
 	s.handler(w, req)
 }
+
+// release gives up the server's hold on a connection: it stops counting
+// towards the connection limit and Shutdown no longer waits for it.
+func (s *Server) release() {
+	s.activeConns.Add(-1)
+	s.releaseSlot()
+	s.inFlight.Done()
+}
@@ -0,0 +1,933 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certA, keyA := ca.issueFiles(t, "a.test", false)
+	certB, keyB := ca.issueFiles(t, "b.test", false)
+
+	config, err := NewTLSConfig(KeyPair{CertFile: certA, KeyFile: keyA}, KeyPair{CertFile: certB, KeyFile: keyB})
+	require.NoError(t, err)
+
+	s, err := ServeTLSConfig(0, config, tlsInfoHandler)
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.Addr().String()
+
+	// Test: ALPN negotiates http/1.1 and the state reaches the handler
+	out, state := tlsRoundTrip(t, addr, &tls.Config{ServerName: "a.test", RootCAs: ca.pool, NextProtos: []string{"h2", "http/1.1"}})
+	assert.Equal(t, "http/1.1", state.NegotiatedProtocol)
+	assert.Contains(t, out, "protocol=http/1.1")
+	assert.Contains(t, out, fmt.Sprintf("version=%x", state.Version))
+	assert.Contains(t, out, "peers=0")
+
+	// Test: Certificate chosen by SNI
+	_, state = tlsRoundTrip(t, addr, &tls.Config{ServerName: "b.test", RootCAs: ca.pool})
+	assert.Equal(t, "b.test", state.PeerCertificates[0].Subject.CommonName)
+
+	// Test: Mutual TLS exposes the client certificate
+	clientCert := ca.issue(t, "client.test", true)
+	mtlsConfig := config.Clone()
+	mtlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	mtlsConfig.ClientCAs = ca.pool
+	mtls, err := ServeTLSConfig(0, mtlsConfig, tlsInfoHandler)
+	require.NoError(t, err)
+	defer mtls.Close()
+
+	out, _ = tlsRoundTrip(t, mtls.Addr().String(), &tls.Config{
+		ServerName:   "a.test",
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	assert.Contains(t, out, "peers=1 client.test")
+}
+
+func TestServeTLSPlaintextRequest(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueFiles(t, "a.test", false)
+	s, err := ServeTLS(0, certFile, keyFile, tlsInfoHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: A plaintext request never reaches the handler
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: a.test\r\n\r\n")
+	out, _ := io.ReadAll(conn)
+	assert.NotContains(t, string(out), "protocol=")
+}
+
+func TestServeAddr(t *testing.T) {
+	// Test: Loopback address with an ephemeral port
+	s, err := ServeAddr("127.0.0.1:0", okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+	tcpAddr, ok := s.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+	assert.True(t, tcpAddr.IP.IsLoopback())
+	assert.NotZero(t, tcpAddr.Port)
+	assert.Contains(t, roundTrip(t, "tcp", s.Addr().String()), "HTTP/1.1 200 OK\r\n")
+
+	// Test: Unix domain socket
+	path := filepath.Join(t.TempDir(), "app.sock")
+	s, err = ServeAddr("unix:"+path, okHandler)
+	require.NoError(t, err)
+	assert.Equal(t, "unix", s.Addr().Network())
+	assert.Equal(t, path, s.Addr().String())
+	assert.Contains(t, roundTrip(t, "unix", path), "HTTP/1.1 200 OK\r\n")
+
+	// Test: Socket in use by a live server is not stolen
+	_, err = Listen("unix:" + path)
+	require.Error(t, err)
+
+	// Test: Socket file removed on close
+	require.NoError(t, s.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: Stale socket file left behind is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	s, err = ServeAddr("unix:"+path, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Contains(t, roundTrip(t, "unix", path), "HTTP/1.1 200 OK\r\n")
+
+	// Test: Regular file at the socket path is not removed
+	file := filepath.Join(t.TempDir(), "not-a-socket")
+	require.NoError(t, os.WriteFile(file, []byte("keep me"), 0o644))
+	_, err = Listen("unix:" + file)
+	require.ErrorIs(t, err, syscall.EADDRINUSE)
+	contents, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "keep me", string(contents))
+
+	// Test: Listener supplied by the caller
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err = ServeListener(listener, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, listener.Addr(), s.Addr())
+	assert.Contains(t, roundTrip(t, "tcp", s.Addr().String()), "HTTP/1.1 200 OK\r\n")
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s, err := ServeAddr("127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		okHandler(w, req)
+	})
+	require.NoError(t, err)
+	addr := s.Addr().String()
+
+	result := make(chan string)
+	go func() {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		out, _ := io.ReadAll(conn)
+		result <- string(out)
+	}()
+	<-started
+
+	shutdownDone := make(chan error)
+	go func() {
+		shutdownDone <- s.Shutdown(context.Background())
+	}()
+
+	// Test: New connections are refused while draining
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: Shutdown waits for the in-flight request
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned before the in-flight request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Contains(t, <-result, "HTTP/1.1 200 OK\r\n")
+	require.NoError(t, <-shutdownDone)
+
+	// Test: Shutdown gives up when the context ends
+	s, err = ServeAddr("127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		time.Sleep(time.Second)
+	})
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+}
+
+func TestHandoff(t *testing.T) {
+	t.Setenv(handoffChildEnv, "1")
+	path := filepath.Join(t.TempDir(), "app.sock")
+	s, err := ServeAddr("unix:"+path, pidHandler)
+	require.NoError(t, err)
+	assert.Contains(t, roundTrip(t, "unix", path), "pid="+strconv.Itoa(os.Getpid()))
+
+	process, err := s.Handoff()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		process.Kill()
+		process.Wait()
+	})
+	require.NoError(t, s.Shutdown(context.Background()))
+
+	// Test: The socket survives the parent closing it and the child serves it
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Contains(t, roundTrip(t, "unix", path), "pid="+strconv.Itoa(process.Pid))
+}
+
+func TestInheritedListeners(t *testing.T) {
+	// Test: Nothing inherited
+	listeners, err := InheritedListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+
+	// Test: Descriptors meant for another process are ignored
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", "1")
+	listeners, err = InheritedListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+	_, ok := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, ok)
+
+	// Test: Malformed count
+	t.Setenv("LISTEN_FDS", "many")
+	_, err = InheritedListeners()
+	require.Error(t, err)
+}
+
+// handoffChildEnv marks the test binary started by TestHandoff, which
+// should serve the inherited socket instead of running the tests.
+const handoffChildEnv = "HTTPFROMTCP_TEST_HANDOFF_CHILD"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(handoffChildEnv) == "1" {
+		runHandoffChild()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runHandoffChild() {
+	listener, err := ListenOrInherit("127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "child:", err)
+		os.Exit(1)
+	}
+	if _, err := ServeListener(listener, pidHandler); err != nil {
+		fmt.Fprintln(os.Stderr, "child:", err)
+		os.Exit(1)
+	}
+	if err := NotifyReady(); err != nil {
+		fmt.Fprintln(os.Stderr, "child:", err)
+		os.Exit(1)
+	}
+	// The parent kills us when it is done; this only guards against
+	// being left behind.
+	time.Sleep(30 * time.Second)
+	os.Exit(0)
+}
+
+func pidHandler(w *response.Writer, _ *request.Request) {
+	body := []byte(fmt.Sprintf("pid=%d", os.Getpid()))
+	w.WriteStatusLine(response.StatusCodeOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestMaxConnections(t *testing.T) {
+	newBlockingServer := func(policy OverloadPolicy, opts ...Option) (*Server, chan struct{}, chan struct{}) {
+		started := make(chan struct{}, 10)
+		release := make(chan struct{})
+		opts = append(opts, WithMaxConnections(1, policy))
+		s, err := ServeAddr("127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+			started <- struct{}{}
+			<-release
+			okHandler(w, req)
+		}, opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s, started, release
+	}
+	sendRequest := func(addr string) chan string {
+		result := make(chan string, 1)
+		go func() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				result <- err.Error()
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			out, _ := io.ReadAll(conn)
+			result <- string(out)
+		}()
+		return result
+	}
+
+	// Test: OverloadWait holds the second connection until the first closes
+	s, started, release := newBlockingServer(OverloadWait)
+	first := sendRequest(s.Addr().String())
+	<-started
+	second := sendRequest(s.Addr().String())
+	select {
+	case <-started:
+		t.Fatal("second connection handled while at the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, int64(1), s.ConnectionStats().Active)
+	close(release)
+	assert.Contains(t, <-first, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, <-second, "HTTP/1.1 200 OK\r\n")
+	assert.Equal(t, uint64(2), s.ConnectionStats().Accepted)
+	assert.Zero(t, s.ConnectionStats().Rejected)
+
+	// Test: OverloadReject answers 503 with Retry-After
+	s, started, release = newBlockingServer(OverloadReject, WithRetryAfter(30*time.Second))
+	first = sendRequest(s.Addr().String())
+	<-started
+	out := <-sendRequest(s.Addr().String())
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"), out)
+	assert.Contains(t, out, "retry-after: 30\r\n")
+	assert.Equal(t, uint64(1), s.ConnectionStats().Rejected)
+	close(release)
+	assert.Contains(t, <-first, "HTTP/1.1 200 OK\r\n")
+
+	// Test: The slot is freed once the connection closes
+	require.Eventually(t, func() bool { return s.ConnectionStats().Active == 0 }, time.Second, 10*time.Millisecond)
+	third := sendRequest(s.Addr().String())
+	<-started
+	assert.Contains(t, <-third, "HTTP/1.1 200 OK\r\n")
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	// Test: Whole seconds are kept
+	assert.Equal(t, 30, retryAfterSeconds(30*time.Second))
+
+	// Test: Fractions round up
+	assert.Equal(t, 2, retryAfterSeconds(1500*time.Millisecond))
+
+	// Test: Short or zero durations still ask for a second
+	assert.Equal(t, 1, retryAfterSeconds(200*time.Millisecond))
+	assert.Equal(t, 1, retryAfterSeconds(0))
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	// Test: Backoff doubles up to the cap
+	assert.Equal(t, minAcceptBackoff, nextAcceptBackoff(0))
+	assert.Equal(t, 2*minAcceptBackoff, nextAcceptBackoff(minAcceptBackoff))
+	assert.Equal(t, maxAcceptBackoff, nextAcceptBackoff(maxAcceptBackoff))
+
+	// Test: Classification of accept errors
+	assert.True(t, isTemporaryAcceptError(&net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}))
+	assert.False(t, isTemporaryAcceptError(&net.OpError{Op: "accept", Err: syscall.EBADF}))
+	assert.False(t, isTemporaryAcceptError(net.ErrClosed))
+
+	// Test: Temporary errors are retried with increasing delays
+	emfile := &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	listener := &scriptedListener{results: []acceptResult{{err: emfile}, {err: emfile}, {err: emfile}, {conn: serverConn}}}
+	start := time.Now()
+	s, err := ServeListener(listener, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	go fmt.Fprint(client, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	out, _ := io.ReadAll(client)
+	assert.Contains(t, string(out), "HTTP/1.1 200 OK\r\n")
+	assert.GreaterOrEqual(t, time.Since(start), minAcceptBackoff*(1+2+4))
+
+	// Test: A permanent error stops the server and is reported
+	listener = &scriptedListener{results: []acceptResult{{err: emfile}, {err: &net.OpError{Op: "accept", Err: syscall.EBADF}}}}
+	s, err = ServeListener(listener, okHandler)
+	require.NoError(t, err)
+	select {
+	case err := <-s.Err():
+		require.ErrorIs(t, err, syscall.EBADF)
+	case <-time.After(time.Second):
+		t.Fatal("server did not report the permanent error")
+	}
+	_, open := <-s.Err()
+	assert.False(t, open)
+	assert.True(t, listener.closed.Load())
+
+	// Test: Closing normally closes the channel without an error
+	s, err = ServeAddr("127.0.0.1:0", okHandler)
+	require.NoError(t, err)
+	s.Close()
+	err, open = <-s.Err()
+	assert.NoError(t, err)
+	assert.False(t, open)
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// scriptedListener returns the given results from Accept in order, then
+// blocks until closed.
+type scriptedListener struct {
+	results []acceptResult
+	closed  atomic.Bool
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	l.once.Do(func() { l.done = make(chan struct{}) })
+	if len(l.results) > 0 {
+		r := l.results[0]
+		l.results = l.results[1:]
+		return r.conn, r.err
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *scriptedListener) Close() error {
+	l.once.Do(func() { l.done = make(chan struct{}) })
+	if !l.closed.Swap(true) {
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *scriptedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestRequestContext(t *testing.T) {
+	ctxDone := make(chan error, 1)
+	waitForCancel := func(w *response.Writer, req *request.Request) {
+		select {
+		case <-req.Context().Done():
+			ctxDone <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			ctxDone <- nil
+		}
+	}
+
+	// Test: Client hanging up cancels the context
+	s, err := ServeAddr("127.0.0.1:0", waitForCancel)
+	require.NoError(t, err)
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	require.ErrorIs(t, <-ctxDone, context.Canceled)
+
+	// Test: Request timeout
+	s, err = ServeAddr("127.0.0.1:0", waitForCancel, WithRequestTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.ErrorIs(t, <-ctxDone, context.DeadlineExceeded)
+
+	// Test: Closing the server cancels in-flight requests
+	s, err = ServeAddr("127.0.0.1:0", waitForCancel)
+	require.NoError(t, err)
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	require.ErrorIs(t, <-ctxDone, context.Canceled)
+
+	// Test: Requests built outside the server have a background context
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, context.Background(), req.Context())
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(func(w *response.Writer, req *request.Request) {
+		seen, _ = RequestIDFromContext(req.Context())
+		okHandler(w, req)
+	})
+
+	// Test: ID generated and echoed
+	out := serveRaw(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Len(t, seen, 16)
+	assert.Contains(t, out, "x-request-id: "+seen+"\r\n")
+
+	// Test: ID from the client is kept
+	out = serveRaw(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-ID: abc-123\r\n\r\n")
+	assert.Equal(t, "abc-123", seen)
+	assert.Contains(t, out, "x-request-id: abc-123\r\n")
+}
+
+func TestMetrics(t *testing.T) {
+	srv, err := ServeAddr("127.0.0.1:0", okHandler, WithMetrics("/metrics"), WithRouteLabel(RouteLabels("/assets")))
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	send := func(raw string) string {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = fmt.Fprint(conn, raw)
+		require.NoError(t, err)
+		// Malformed requests are answered before being read in full, so
+		// the connection may be reset rather than closed.
+		out, _ := io.ReadAll(conn)
+		return string(out)
+	}
+
+	send("GET /assets/a.css?v=1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send("POST /assets/b.css HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	send("GET / HTTP/1.0\r\n\r\n")
+	send("get / HTTP/1.1\r\n\r\n")
+	send("BREW /pot-1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	out := send("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip\r\n\r\n")
+
+	// Test: Unsupported transfer codings get 501
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 501 Not Implemented\r\n"), out)
+
+	// Test: Metrics are served on the configured path
+	out = send("GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+	assert.Contains(t, out, "content-type: text/plain; version=0.0.4; charset=utf-8\r\n")
+
+	// Test: Requests are counted by method, route and status
+	assert.Contains(t, out, `http_requests_total{method="GET",route="/assets",status="200"} 1`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="POST",route="/assets",status="200"} 1`+"\n")
+	assert.Contains(t, out, `http_request_size_bytes_bucket{method="POST",route="/assets",le="100"} 1`+"\n")
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="GET",route="/assets"} 1`+"\n")
+	assert.Contains(t, out, "# TYPE http_request_duration_seconds histogram\n")
+
+	// Test: Unknown methods and routes share a label
+	assert.Contains(t, out, `http_requests_total{method="OTHER",route="other",status="200"} 1`+"\n")
+	assert.NotContains(t, out, "BREW")
+	assert.NotContains(t, out, "pot-1")
+
+	// Test: Parse errors are counted by type
+	assert.Contains(t, out, `http_request_parse_errors_total{type="unsupported_version"} 1`+"\n")
+	assert.Contains(t, out, `http_request_parse_errors_total{type="invalid_method"} 1`+"\n")
+	assert.Contains(t, out, `http_request_parse_errors_total{type="unsupported_transfer_coding"} 1`+"\n")
+
+	// Test: Connection gauges and counters, once earlier connections
+	// have been released
+	assert.Contains(t, out, "http_connections_accepted_total 7\n")
+	assert.Eventually(t, func() bool {
+		out := send("GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		return strings.Contains(out, "http_connections_active 1\n") &&
+			strings.Contains(out, "http_connections_idle 0\n")
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: Metrics path only answers GET and HEAD
+	out = send("DELETE /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"), out)
+}
+
+func TestConnState(t *testing.T) {
+	var mu sync.Mutex
+	states := make(map[string][]ConnState)
+	closed := make(chan struct{}, 2)
+	record := func(conn net.Conn, state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := conn.RemoteAddr().String()
+		states[key] = append(states[key], state)
+		if state == StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	addrHandler := func(w *response.Writer, req *request.Request) {
+		body := []byte(req.RemoteAddr.String() + " -> " + req.LocalAddr.String())
+		w.WriteStatusLine(response.StatusCodeOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	srv, err := ServeAddr("127.0.0.1:0", addrHandler, WithConnState(record))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: A served request goes through new, active and closed, and the
+	// handler sees both addresses
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	served := conn.LocalAddr().String()
+	out := roundTripConn(t, conn)
+	assert.True(t, strings.HasSuffix(out, served+" -> "+srv.Addr().String()), out)
+
+	// Test: A connection closed before sending anything never becomes
+	// active
+	conn, err = net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	silent := conn.LocalAddr().String()
+	conn.Close()
+
+	for range 2 {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("connections were not closed")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateClosed}, states[served])
+	assert.Equal(t, []ConnState{StateNew, StateClosed}, states[silent])
+	assert.Equal(t, "hijacked", StateHijacked.String())
+}
+
+func TestHijack(t *testing.T) {
+	states := make(chan ConnState, 10)
+	hijackedConns := make(chan net.Conn, 1)
+	echo := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeSwitchingProtocols)
+		h := headers.NewHeaders()
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", "echo")
+		w.WriteHeaders(h)
+
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+		hijackedConns <- conn
+		// Serve the new protocol after the handler returns, to check the
+		// server leaves the connection alone.
+		go func() {
+			defer conn.Close()
+			conn.Write(append([]byte("echo:"), buffered...))
+			io.Copy(conn, conn)
+		}()
+	}
+	srv, err := ServeAddr("127.0.0.1:0", echo, WithConnState(func(_ net.Conn, state ConnState) {
+		states <- state
+	}))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: Bytes sent right behind the request reach the new protocol
+	_, err = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\n\r\nearly")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", resp)
+	for line := ""; line != "\r\n"; {
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+	}
+	got := make([]byte, len("echo:early"))
+	_, err = io.ReadFull(reader, got)
+	require.NoError(t, err)
+	assert.Equal(t, "echo:early", string(got))
+
+	// Test: The connection outlives the handler
+	<-hijackedConns
+	_, err = fmt.Fprint(conn, "ping")
+	require.NoError(t, err)
+	got = make([]byte, 4)
+	_, err = io.ReadFull(reader, got)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(got))
+
+	// Test: Hijacked connections leave the server's bookkeeping
+	assert.Equal(t, int64(0), srv.ConnectionStats().Active)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	assert.Equal(t, StateNew, <-states)
+	assert.Equal(t, StateActive, <-states)
+	assert.Equal(t, StateHijacked, <-states)
+	assert.Empty(t, states)
+}
+
+func TestH2C(t *testing.T) {
+	var mu sync.Mutex
+	var states []ConnState
+	versionHandler := func(w *response.Writer, req *request.Request) {
+		body := []byte("HTTP/" + req.RequestLine.HttpVersion + " " + req.RequestLine.RequestTarget)
+		w.WriteStatusLine(response.StatusCodeOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	srv, err := ServeAddr("127.0.0.1:0", versionHandler, WithH2C(), WithConnState(func(_ net.Conn, state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+	}))
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	// Test: Clients with prior knowledge share one connection
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{Protocols: protocols}
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		resp, err := client.Get("http://" + addr + path)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		assert.Equal(t, "HTTP/2 "+path, string(body))
+	}
+	assert.Equal(t, uint64(1), srv.ConnectionStats().Accepted)
+
+	// Test: The connection is idle between streams
+	transport.CloseIdleConnections()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(states) > 0 && states[len(states)-1] == StateClosed
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateIdle, StateActive, StateIdle}, states[:5])
+	mu.Unlock()
+
+	// Test: HTTP/1.1 is still served
+	out := roundTrip(t, "tcp", addr)
+	assert.True(t, strings.HasSuffix(out, "HTTP/1.1 /"), out)
+
+	// Test: Upgrade: h2c switches protocols and the server's SETTINGS
+	// follow the 101 response
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for line := ""; line != "\r\n"; {
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+	}
+	frameHeader := make([]byte, 9)
+	_, err = io.ReadFull(reader, frameHeader)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x4), frameHeader[3], "SETTINGS frame type")
+}
+
+func TestRouteLabels(t *testing.T) {
+	label := RouteLabels("/", "/video", "/httpbin", "/assets/", "/assets/css")
+	for target, route := range map[string]string{
+		"/":                   "/",
+		"/video":              "/video",
+		"/videos":             OtherRoute,
+		"/httpbin/get?a=b":    "/httpbin",
+		"/assets/img/a.png":   "/assets/",
+		"/assets/css/a.css":   "/assets/css",
+		"/unknown/path":       OtherRoute,
+		"http://example.com/": OtherRoute,
+		"example.com:443":     OtherRoute,
+	} {
+		req := &request.Request{RequestLine: request.RequestLine{RequestTarget: target}}
+		assert.Equal(t, route, label(req), target)
+	}
+}
+
+func serveRaw(t *testing.T, handler Handler, raw string) string {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	buf := &strings.Builder{}
+	handler(response.NewWriter(buf), req)
+	return buf.String()
+}
+
+func okHandler(w *response.Writer, _ *request.Request) {
+	body := []byte("ok")
+	w.WriteStatusLine(response.StatusCodeOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func roundTrip(t *testing.T, network, addr string) string {
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err)
+	return roundTripConn(t, conn)
+}
+
+func roundTripConn(t *testing.T, conn net.Conn) string {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err := fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func tlsInfoHandler(w *response.Writer, req *request.Request) {
+	if req.TLS == nil {
+		w.WriteStatusLine(response.StatusCodeBadRequest)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return
+	}
+
+	body := fmt.Sprintf("protocol=%s version=%x peers=%d", req.TLS.NegotiatedProtocol, req.TLS.Version, len(req.TLS.PeerCertificates))
+	if len(req.TLS.PeerCertificates) > 0 {
+		body += " " + req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	w.WriteStatusLine(response.StatusCodeOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func tlsRoundTrip(t *testing.T, addr string, config *tls.Config) (string, tls.ConnectionState) {
+	conn, err := tls.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", config.ServerName)
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"), string(out))
+	return string(out), conn.ConnectionState()
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "httpfromtcp test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issueDER(t *testing.T, name string, client bool) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	usage := x509.ExtKeyUsageServerAuth
+	if client {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return der, key
+}
+
+func (ca *testCA) issue(t *testing.T, name string, client bool) tls.Certificate {
+	der, key := ca.issueDER(t, name, client)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) issueFiles(t *testing.T, name string, client bool) (string, string) {
+	der, key := ca.issueDER(t, name, client)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// KeyPair names a PEM encoded certificate and its private key.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// NewTLSConfig loads the given key pairs into a tls.Config. When more than
+// one is given, the certificate is picked by the server name the client
+// sends with SNI, falling back to the first pair.
+func NewTLSConfig(pairs ...KeyPair) (*tls.Config, error) {
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no certificates given")
+	}
+
+	config := &tls.Config{}
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading key pair %s: %w", pair.CertFile, err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	return config, nil
+}
+
+// ServeTLS is like Serve but only accepts TLS connections, using the
+// certificate and key in the given files.
+func ServeTLS(port int, certFile, keyFile string, handler Handler, opts ...Option) (*Server, error) {
+	config, err := NewTLSConfig(KeyPair{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		return nil, err
+	}
+	return ServeTLSConfig(port, config, handler, opts...)
+}
+
+// ServeTLSConfig is like Serve but only accepts TLS connections configured
+// by config. Set config.ClientAuth and config.ClientCAs to require client
+// certificates; handlers can then inspect them through Request.TLS.
+func ServeTLSConfig(port int, config *tls.Config, handler Handler, opts ...Option) (*Server, error) {
+	return ServeTLSAddr(fmt.Sprintf(":%d", port), config, handler, opts...)
+}
+
+// ServeTLSAddr is like ServeTLSConfig but listens on an address string as
+// understood by Listen.
+func ServeTLSAddr(addr string, config *tls.Config, handler Handler, opts ...Option) (*Server, error) {
+	listener, err := Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return ServeTLSListener(listener, config, handler, opts...)
+}
+
+// ServeTLSListener is like ServeListener but performs a TLS handshake on
+// every accepted connection. The listener itself stays a plain one, so it
+// can still be handed over to another process with Handoff.
+func ServeTLSListener(listener net.Listener, config *tls.Config, handler Handler, opts ...Option) (*Server, error) {
+	if listener == nil {
+		return nil, errors.New("nil listener")
+	}
+	return serve(listener, handler, prepareTLSConfig(config), opts), nil
+}
+
+// prepareTLSConfig returns a copy of config that advertises HTTP/1.1 over
+// ALPN and refuses protocol versions older than TLS 1.2.
+func prepareTLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	return config
+}
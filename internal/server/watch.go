@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// maxWatchedBytes bounds how much a connWatcher reads of what the client
+// sends while its request is being handled.
+const maxWatchedBytes = 64 * 1024
+
+// aLongTimeAgo is a read deadline in the past, used to interrupt a
+// blocked Read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connWatcher reads from a connection in the background while a handler
+// runs, so that the client hanging up cancels the request's context.
+type connWatcher struct {
+	conn     net.Conn
+	cancel   context.CancelFunc
+	stopping atomic.Bool
+	stopped  bool
+	done     chan struct{}
+	// buffered holds whatever the client sent while being watched.
+	buffered []byte
+}
+
+func watchConn(conn net.Conn, cancel context.CancelFunc) *connWatcher {
+	w := &connWatcher{
+		conn:   conn,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *connWatcher) run() {
+	defer close(w.done)
+
+	buf := make([]byte, 512)
+	for {
+		n, err := w.conn.Read(buf)
+		w.buffered = append(w.buffered, buf[:n]...)
+		if err == nil {
+			// Past the limit the client is sending more than a stray
+			// pipelined request; leave the rest unread until someone
+			// takes over the connection.
+			if len(w.buffered) >= maxWatchedBytes {
+				return
+			}
+			continue
+		}
+
+		if w.stopping.Load() && errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		w.cancel()
+		return
+	}
+}
+
+// stop ends the background read and returns the bytes it consumed, leaving
+// the connection ready for normal reads again. Only the first call touches
+// the connection, which may have been hijacked since.
+func (w *connWatcher) stop() []byte {
+	if w.stopped {
+		return w.buffered
+	}
+	w.stopped = true
+	w.stopping.Store(true)
+	w.conn.SetReadDeadline(aLongTimeAgo)
+	<-w.done
+	w.conn.SetReadDeadline(time.Time{})
+	return w.buffered
+}
@@ -0,0 +1,196 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeat is how often a comment is sent on an otherwise quiet
+// stream when Config.Heartbeat is zero, so proxies don't time it out.
+const DefaultHeartbeat = 15 * time.Second
+
+type Config struct {
+	// Heartbeat is the interval between keep-alive comments. Zero selects
+	// DefaultHeartbeat and a negative value disables them.
+	Heartbeat time.Duration
+	// Retry, if set, is sent at the start of the stream to tell the
+	// client how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+// Event is a single server-sent event. Data may span several lines.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry changes the client's reconnection delay when non-zero.
+	Retry time.Duration
+}
+
+// Stream writes an event stream as a chunked response. It is safe for
+// concurrent use.
+type Stream struct {
+	w           *response.Writer
+	ctx         context.Context
+	lastEventID string
+
+	mu     sync.Mutex
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewStream starts an event stream in response to req. The handler sends
+// events until Done is closed or it has nothing more to say, then calls
+// Close.
+func NewStream(w *response.Writer, req *request.Request, cfg Config) (*Stream, error) {
+	h := response.GetDefaultHeaders(0)
+	h.Remove("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Override("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	if err := w.WriteStatusLine(response.StatusCodeOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	lastEventID, _ := req.Headers.Get("Last-Event-ID")
+	s := &Stream{
+		w:           w,
+		ctx:         req.Context(),
+		lastEventID: strings.TrimSpace(lastEventID),
+		stop:        make(chan struct{}),
+	}
+
+	if cfg.Retry > 0 {
+		if err := s.write(fmt.Sprintf("retry: %d\n\n", cfg.Retry.Milliseconds())); err != nil {
+			return nil, err
+		}
+	}
+
+	heartbeat := cfg.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = DefaultHeartbeat
+	}
+	if heartbeat > 0 {
+		s.wg.Add(1)
+		go s.heartbeat(heartbeat)
+	}
+	return s, nil
+}
+
+// LastEventID returns the Last-Event-ID the client sent when reconnecting,
+// so the handler can resume after the last event it received.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed when the client disconnects or the request is otherwise
+// cancelled.
+func (s *Stream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Send writes an event. It fails once the client has gone away.
+func (s *Stream) Send(ev Event) error {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return errors.New("sse: event ID must not contain line breaks or NUL")
+	}
+	if strings.ContainsAny(ev.Event, "\r\n") {
+		return errors.New("sse: event name must not contain line breaks")
+	}
+
+	var b strings.Builder
+	if ev.ID != "" {
+		b.WriteString("id: " + ev.ID + "\n")
+	}
+	if ev.Event != "" {
+		b.WriteString("event: " + ev.Event + "\n")
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", ev.Retry.Milliseconds())
+	}
+	if ev.Data != "" || ev.Event != "" {
+		data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+		data = strings.ReplaceAll(data, "\r", "\n")
+		for _, line := range strings.Split(data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	if b.Len() == 0 {
+		return errors.New("sse: empty event")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Close stops the heartbeat and ends the response.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	s.mu.Unlock()
+	s.wg.Wait()
+
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+	if _, err := s.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	return s.w.WriteTrailers(headers.NewHeaders())
+}
+
+func (s *Stream) write(text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("sse: stream closed")
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	_, err := s.w.WriteChunkedBody([]byte(text))
+	return err
+}
+
+func (s *Stream) heartbeat(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Comment("heartbeat"); err != nil {
+				return
+			}
+		case <-s.stop:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
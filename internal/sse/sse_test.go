@@ -0,0 +1,94 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	req, err := request.RequestFromReader(strings.NewReader(
+		"GET /events HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 41\r\n\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+
+	s, err := NewStream(response.NewWriter(buf), req, Config{Heartbeat: -1, Retry: 3 * time.Second})
+	require.NoError(t, err)
+
+	// Test: Last-Event-ID from the reconnecting client
+	assert.Equal(t, "41", s.LastEventID())
+
+	require.NoError(t, s.Send(Event{ID: "42", Event: "update", Data: "line one\r\nline two\nline three"}))
+	require.NoError(t, s.Send(Event{Data: "plain"}))
+	require.NoError(t, s.Comment("just saying"))
+	require.NoError(t, s.Close())
+
+	out := buf.String()
+	// Test: Event stream headers on a chunked response
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+	assert.Contains(t, out, "content-type: text/event-stream\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, out, "content-length")
+
+	// Test: Fields, multi-line data and comments in separate chunks
+	assert.Contains(t, out, "\r\nretry: 3000\n\n\r\n")
+	assert.Contains(t, out, "\r\nid: 42\nevent: update\ndata: line one\ndata: line two\ndata: line three\n\n\r\n")
+	assert.Contains(t, out, "\r\ndata: plain\n\n\r\n")
+	assert.Contains(t, out, "\r\n: just saying\n\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "0\r\n\r\n"), out)
+
+	// Test: Invalid events and writes after Close are refused
+	assert.Error(t, s.Send(Event{Data: "late"}))
+	s2, err := NewStream(response.NewWriter(&bytes.Buffer{}), req, Config{Heartbeat: -1})
+	require.NoError(t, err)
+	assert.Error(t, s2.Send(Event{ID: "a\nb", Data: "x"}))
+	assert.Error(t, s2.Send(Event{}))
+}
+
+func TestStreamHeartbeatAndDisconnect(t *testing.T) {
+	stopped := make(chan error, 1)
+	srv, err := server.ServeAddr("127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		s, err := NewStream(w, req, Config{Heartbeat: 20 * time.Millisecond})
+		require.NoError(t, err)
+		s.Send(Event{Data: "hello"})
+		<-s.Done()
+		stopped <- s.Send(Event{Data: "gone"})
+		s.Close()
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	// Test: Heartbeat comments keep arriving on a quiet stream
+	r := bufio.NewReader(conn)
+	heartbeats := 0
+	for heartbeats < 2 {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == ": heartbeat\n" {
+			heartbeats++
+		}
+	}
+
+	// Test: The stream notices the client hanging up
+	conn.Close()
+	select {
+	case err := <-stopped:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not stop after the client disconnected")
+	}
+}
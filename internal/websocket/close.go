@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Close status codes (RFC 6455 section 7.4.1).
+const (
+	CloseNormalClosure       = 1000
+	CloseGoingAway           = 1001
+	CloseProtocolError       = 1002
+	CloseUnsupportedData     = 1003
+	CloseNoStatusReceived    = 1005
+	CloseAbnormalClosure     = 1006
+	CloseInvalidPayload      = 1007
+	ClosePolicyViolation     = 1008
+	CloseMessageTooBig       = 1009
+	CloseMandatoryExtension  = 1010
+	CloseInternalServerError = 1011
+)
+
+// CloseError is returned by ReadMessage when the peer closes the
+// connection. Code is CloseNoStatusReceived if the peer sent no code.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: closed with code %d: %s", e.Code, e.Reason)
+}
+
+func parseClosePayload(payload []byte) (*CloseError, error) {
+	switch {
+	case len(payload) == 0:
+		return &CloseError{Code: CloseNoStatusReceived}, nil
+	case len(payload) == 1:
+		return nil, fmt.Errorf("%w: truncated close code", ErrProtocol)
+	}
+
+	code := int(binary.BigEndian.Uint16(payload))
+	if !validSendCode(code) {
+		return nil, fmt.Errorf("%w: invalid close code %d", ErrProtocol, code)
+	}
+	reason := payload[2:]
+	if !utf8.Valid(reason) {
+		return nil, ErrInvalidUTF8
+	}
+	return &CloseError{Code: code, Reason: string(reason)}, nil
+}
+
+// validSendCode reports whether code may appear in a close frame. 1005,
+// 1006 and 1015 only describe closes locally and are never sent.
+func validSendCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,482 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the kind of a data message, which is also the opcode of
+// its first frame.
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+const (
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	// maxControlPayload is the largest payload of a control frame
+	// (RFC 6455 section 5.5).
+	maxControlPayload = 125
+
+	// closeWriteTimeout bounds how long sending a close frame in reply to
+	// a protocol error may block.
+	closeWriteTimeout = 5 * time.Second
+)
+
+var (
+	// ErrCloseSent is returned when writing a data message after the
+	// close handshake has been started.
+	ErrCloseSent = errors.New("websocket: close sent")
+	// ErrMessageTooBig is returned by ReadMessage when a message exceeds
+	// the size limit. The connection is closed with CloseMessageTooBig.
+	ErrMessageTooBig = errors.New("websocket: message too big")
+	// ErrInvalidUTF8 is returned by ReadMessage when a text message or a
+	// close reason is not valid UTF-8. The connection is closed with
+	// CloseInvalidPayload.
+	ErrInvalidUTF8 = errors.New("websocket: invalid UTF-8")
+	// ErrProtocol is returned by ReadMessage when the peer breaks the
+	// framing rules. The connection is closed with CloseProtocolError.
+	ErrProtocol = errors.New("websocket: protocol error")
+)
+
+// Conn is a WebSocket connection. One goroutine may read while others
+// write: writes are serialised, and control frames may be sent while a
+// fragmented message is being written.
+type Conn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	isServer       bool
+	maxMessageSize int64
+	subprotocol    string
+
+	// writeMu guards writes of single frames, messageMu a whole data
+	// message so fragments of two messages never interleave.
+	writeMu   sync.Mutex
+	messageMu sync.Mutex
+	closeSent bool
+
+	// Read state, owned by the reading goroutine.
+	readErr     error
+	pongHandler func(data []byte)
+}
+
+func newConn(conn net.Conn, buffered []byte, isServer bool, maxMessageSize int64) *Conn {
+	var r io.Reader = conn
+	if len(buffered) > 0 {
+		r = io.MultiReader(bytes.NewReader(buffered), conn)
+	}
+	return &Conn{
+		conn:           conn,
+		reader:         bufio.NewReader(r),
+		isServer:       isServer,
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+// Subprotocol returns the subprotocol selected during the handshake, or ""
+// if none was.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// NetConn returns the underlying connection, for setting deadlines or
+// reading addresses.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// SetPongHandler sets a function called from ReadMessage with the payload
+// of every pong frame received.
+func (c *Conn) SetPongHandler(h func(data []byte)) {
+	c.pongHandler = h
+}
+
+// Close closes the underlying connection without a close handshake. To
+// close cleanly, call WriteClose and keep reading until ReadMessage
+// returns a *CloseError.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+type frameHeader struct {
+	fin     bool
+	opcode  byte
+	masked  bool
+	maskKey [4]byte
+	length  int64
+}
+
+func isControl(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+// ReadMessage returns the next data message, reassembled from its
+// fragments. Ping frames are answered and pong frames passed to the pong
+// handler along the way. When the peer closes the connection, the close
+// is echoed and a *CloseError is returned. Once ReadMessage has returned
+// an error, it returns the same error on every later call.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	typ, data, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		c.failOnError(err)
+	}
+	return typ, data, err
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var (
+		typ     MessageType
+		message []byte
+		started bool
+	)
+	for {
+		h, err := c.readFrameHeader()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if isControl(h.opcode) {
+			if err := c.handleControl(h); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		switch {
+		case h.opcode == opContinuation && !started:
+			return 0, nil, fmt.Errorf("%w: continuation frame without a message", ErrProtocol)
+		case h.opcode != opContinuation && started:
+			return 0, nil, fmt.Errorf("%w: new message inside a fragmented message", ErrProtocol)
+		case h.opcode == opText || h.opcode == opBinary:
+			typ = MessageType(h.opcode)
+			started = true
+		case h.opcode != opContinuation:
+			return 0, nil, fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, h.opcode)
+		}
+
+		// Check the size before reading, so a peer cannot make us allocate
+		// more than the limit.
+		if int64(len(message))+h.length > c.maxMessageSize {
+			return 0, nil, ErrMessageTooBig
+		}
+		payload, err := c.readPayload(h)
+		if err != nil {
+			return 0, nil, err
+		}
+		message = append(message, payload...)
+
+		if h.fin {
+			if typ == TextMessage && !utf8.Valid(message) {
+				return 0, nil, ErrInvalidUTF8
+			}
+			if message == nil {
+				message = []byte{}
+			}
+			return typ, message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrameHeader() (frameHeader, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(c.reader, b[:2]); err != nil {
+		return frameHeader{}, err
+	}
+
+	h := frameHeader{
+		fin:    b[0]&finBit != 0,
+		opcode: b[0] & 0x0F,
+		masked: b[1]&maskBit != 0,
+		length: int64(b[1] & 0x7F),
+	}
+	if b[0]&rsvBits != 0 {
+		return h, fmt.Errorf("%w: reserved bits set without an extension", ErrProtocol)
+	}
+	// Clients must mask every frame and servers must not (RFC 6455
+	// section 5.1).
+	if h.masked != c.isServer {
+		return h, fmt.Errorf("%w: frame masking is wrong for this side", ErrProtocol)
+	}
+
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(c.reader, b[:2]); err != nil {
+			return h, err
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.reader, b[:8]); err != nil {
+			return h, err
+		}
+		length := binary.BigEndian.Uint64(b[:8])
+		if length>>63 != 0 {
+			return h, fmt.Errorf("%w: payload length out of range", ErrProtocol)
+		}
+		h.length = int64(length)
+	}
+
+	if isControl(h.opcode) {
+		if !h.fin {
+			return h, fmt.Errorf("%w: fragmented control frame", ErrProtocol)
+		}
+		if h.length > maxControlPayload {
+			return h, fmt.Errorf("%w: control frame payload too long", ErrProtocol)
+		}
+	}
+
+	if h.masked {
+		if _, err := io.ReadFull(c.reader, h.maskKey[:]); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+func (c *Conn) readPayload(h frameHeader) ([]byte, error) {
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if h.masked {
+		maskBytes(h.maskKey, payload)
+	}
+	return payload, nil
+}
+
+func (c *Conn) handleControl(h frameHeader) error {
+	payload, err := c.readPayload(h)
+	if err != nil {
+		return err
+	}
+
+	switch h.opcode {
+	case opPing:
+		err := c.writeControl(opPong, payload)
+		if errors.Is(err, ErrCloseSent) {
+			return nil
+		}
+		return err
+	case opPong:
+		if c.pongHandler != nil {
+			c.pongHandler(payload)
+		}
+		return nil
+	case opClose:
+		closeErr, err := parseClosePayload(payload)
+		if err != nil {
+			return err
+		}
+		// Echo the status code to complete the handshake, unless we
+		// started it.
+		echo := closeErr.Code
+		if echo == CloseNoStatusReceived {
+			echo = CloseNormalClosure
+		}
+		c.writeClose(echo, "")
+		return closeErr
+	}
+	return fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, h.opcode)
+}
+
+// failOnError starts the close handshake with the status code matching a
+// read error, when the error is one the peer should hear about.
+func (c *Conn) failOnError(err error) {
+	var code int
+	switch {
+	case errors.Is(err, ErrProtocol):
+		code = CloseProtocolError
+	case errors.Is(err, ErrInvalidUTF8):
+		code = CloseInvalidPayload
+	case errors.Is(err, ErrMessageTooBig):
+		code = CloseMessageTooBig
+	default:
+		return
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+	c.writeClose(code, "")
+}
+
+// WriteMessage sends data as a single-frame message.
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	if typ != TextMessage && typ != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", typ)
+	}
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	return c.writeDataFrame(true, byte(typ), data)
+}
+
+// NextWriter returns a writer for a message sent in fragments: every
+// Write sends one frame and Close sends the final one. Other data
+// messages wait until the writer is closed.
+func (c *Conn) NextWriter(typ MessageType) (io.WriteCloser, error) {
+	if typ != TextMessage && typ != BinaryMessage {
+		return nil, fmt.Errorf("websocket: invalid message type %d", typ)
+	}
+	c.messageMu.Lock()
+	return &messageWriter{c: c, opcode: byte(typ)}, nil
+}
+
+type messageWriter struct {
+	c      *Conn
+	opcode byte
+	closed bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("websocket: write to closed message writer")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.c.writeDataFrame(false, w.opcode, p); err != nil {
+		return 0, err
+	}
+	w.opcode = opContinuation
+	return len(p), nil
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.c.messageMu.Unlock()
+	return w.c.writeDataFrame(true, w.opcode, nil)
+}
+
+// WritePing sends a ping frame. The peer answers with a pong carrying the
+// same data, which is passed to the pong handler.
+func (c *Conn) WritePing(data []byte) error {
+	return c.writeControl(opPing, data)
+}
+
+// WritePong sends an unsolicited pong frame, which peers use as a
+// one-way heartbeat.
+func (c *Conn) WritePong(data []byte) error {
+	return c.writeControl(opPong, data)
+}
+
+// WriteClose starts the close handshake. The caller should keep reading
+// until ReadMessage returns the peer's *CloseError, then call Close.
+func (c *Conn) WriteClose(code int, reason string) error {
+	if !validSendCode(code) {
+		return fmt.Errorf("websocket: invalid close code %d", code)
+	}
+	if len(reason)+2 > maxControlPayload {
+		return errors.New("websocket: close reason too long")
+	}
+	return c.writeClose(code, reason)
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	return c.writeControl(opClose, payload)
+}
+
+func (c *Conn) writeControl(opcode byte, payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return errors.New("websocket: control frame payload too long")
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	return c.writeFrameLocked(true, opcode, payload)
+}
+
+func (c *Conn) writeDataFrame(fin bool, opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	return c.writeFrameLocked(fin, opcode, payload)
+}
+
+// writeFrameLocked encodes a frame and sends it in one write. Frames from
+// clients are masked with a fresh key.
+func (c *Conn) writeFrameLocked(fin bool, opcode byte, payload []byte) error {
+	b0 := opcode
+	if fin {
+		b0 |= finBit
+	}
+	var maskFlag byte
+	if !c.isServer {
+		maskFlag = maskBit
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, b0)
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskFlag|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskFlag|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.isServer {
+		frame = append(frame, payload...)
+	} else {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(key, frame[start:])
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// maskBytes applies the masking transform, which is its own inverse
+// (RFC 6455 section 5.3).
+func maskBytes(key [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= key[i%4]
+	}
+}
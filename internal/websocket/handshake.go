@@ -0,0 +1,169 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/headers"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// acceptGUID is appended to Sec-WebSocket-Key to compute
+// Sec-WebSocket-Accept (RFC 6455 section 1.3).
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultMaxMessageSize is the largest message a Conn accepts when the
+// Upgrader does not set one.
+const DefaultMaxMessageSize = 1 << 20
+
+// Upgrader performs the opening handshake that turns an HTTP request into
+// a WebSocket connection.
+type Upgrader struct {
+	// Subprotocols lists the subprotocols the server supports, in order
+	// of preference. The first one the client also offers is selected.
+	Subprotocols []string
+	// MaxMessageSize limits the size of a message, after reassembling
+	// fragments. Zero selects DefaultMaxMessageSize.
+	MaxMessageSize int64
+	// CheckOrigin decides whether to accept a request, usually by looking
+	// at its Origin header. When nil, only requests without an Origin or
+	// from the same host as the Host header are accepted, so other sites
+	// can't open connections from their visitors' browsers.
+	CheckOrigin func(req *request.Request) bool
+}
+
+// Upgrade completes the handshake and takes over the connection. If the
+// request is not a valid WebSocket handshake, Upgrade writes an error
+// response and returns an error; the handler should just return.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	key, err := u.check(w, req)
+	if err != nil {
+		return nil, err
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	subprotocol := u.selectSubprotocol(req)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	if err := w.WriteStatusLine(response.StatusCodeSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	maxMessageSize := u.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	c := newConn(conn, buffered, true, maxMessageSize)
+	c.subprotocol = subprotocol
+	return c, nil
+}
+
+// check validates the handshake request, answering it with an error
+// response if it is not acceptable. It returns the Sec-WebSocket-Key.
+func (u *Upgrader) check(w *response.Writer, req *request.Request) (string, error) {
+	fail := func(code response.StatusCode, msg string, extra ...string) (string, error) {
+		body := []byte(msg)
+		h := response.GetDefaultHeaders(len(body))
+		for i := 0; i+1 < len(extra); i += 2 {
+			h.Set(extra[i], extra[i+1])
+		}
+		w.WriteStatusLine(code)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+		return "", fmt.Errorf("websocket: handshake failed: %s", msg)
+	}
+
+	if req.RequestLine.Method != "GET" {
+		return fail(response.StatusCodeMethodNotAllowed, "WebSocket handshake must use GET", "Allow", "GET")
+	}
+	if !hasToken(req.Headers, "Connection", "upgrade") || !hasToken(req.Headers, "Upgrade", "websocket") {
+		return fail(response.StatusCodeUpgradeRequired, "Expected Upgrade: websocket",
+			"Upgrade", "websocket", "Connection", "Upgrade")
+	}
+	if version, _ := req.Headers.Get("Sec-WebSocket-Version"); strings.TrimSpace(version) != "13" {
+		return fail(response.StatusCodeUpgradeRequired, "Unsupported WebSocket version",
+			"Sec-WebSocket-Version", "13")
+	}
+	key, _ := req.Headers.Get("Sec-WebSocket-Key")
+	key = strings.TrimSpace(key)
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return fail(response.StatusCodeBadRequest, "Invalid Sec-WebSocket-Key")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return fail(response.StatusCodeForbidden, "Origin not allowed")
+	}
+	return key, nil
+}
+
+// sameOrigin reports whether the request has no Origin header or one whose
+// host matches the Host header.
+func sameOrigin(req *request.Request) bool {
+	origin, ok := req.Headers.Get("Origin")
+	if !ok {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host, _ := req.Headers.Get("Host")
+	return strings.EqualFold(u.Host, host)
+}
+
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	offered := headerTokens(req.Headers, "Sec-WebSocket-Protocol")
+	for _, supported := range u.Subprotocols {
+		// Subprotocol names are case-sensitive (RFC 6455 section 11.5).
+		if slices.Contains(offered, supported) {
+			return supported
+		}
+	}
+	return ""
+}
+
+// acceptKey computes Sec-WebSocket-Accept for a Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerTokens splits a comma-separated header into its trimmed elements.
+func headerTokens(h headers.Headers, name string) []string {
+	value, ok := h.Get(name)
+	if !ok {
+		return nil
+	}
+	var tokens []string
+	for _, token := range strings.Split(value, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+func hasToken(h headers.Headers, name, token string) bool {
+	return slices.ContainsFunc(headerTokens(h, name), func(t string) bool {
+		return strings.EqualFold(t, token)
+	})
+}
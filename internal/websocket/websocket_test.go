@@ -0,0 +1,224 @@
+package websocket
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/peeta98/httpfromtcp/internal/request"
+	"github.com/peeta98/httpfromtcp/internal/response"
+	"github.com/peeta98/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Test: Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestHandshake(t *testing.T) {
+	upgrader := &Upgrader{Subprotocols: []string{"chat.v2", "chat.v1"}}
+	addr := serveEcho(t, upgrader)
+
+	// Test: Server preference wins among offered subprotocols
+	_, status, h := dial(t, addr, "Sec-WebSocket-Protocol: chat.v1, chat.v2")
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols", status)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", h["sec-websocket-accept"])
+	assert.Equal(t, "chat.v2", h["sec-websocket-protocol"])
+
+	// Test: No subprotocol header when none match
+	_, _, h = dial(t, addr, "Sec-WebSocket-Protocol: other")
+	assert.NotContains(t, h, "sec-websocket-protocol")
+
+	// Test: By default a browser on the same host may connect
+	_, status, _ = dial(t, addr, "Origin: http://localhost")
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols", status)
+
+	// Test: Invalid handshakes are answered with an error response
+	for name, tc := range map[string]struct {
+		raw    string
+		status string
+	}{
+		"not GET": {
+			"POST / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+			"HTTP/1.1 405 Method Not Allowed",
+		},
+		"no upgrade": {
+			"GET / HTTP/1.1\r\nHost: x\r\n\r\n",
+			"HTTP/1.1 426 Upgrade Required",
+		},
+		"wrong version": {
+			"GET / HTTP/1.1\r\nHost: x\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+			"HTTP/1.1 426 Upgrade Required",
+		},
+		"cross-site origin": {
+			"GET / HTTP/1.1\r\nHost: x\r\nOrigin: http://evil.example\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+			"HTTP/1.1 403 Forbidden",
+		},
+		"short key": {
+			"GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: c2hvcnQ=\r\n\r\n",
+			"HTTP/1.1 400 Bad Request",
+		},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprint(conn, tc.raw)
+		out, _ := io.ReadAll(conn)
+		conn.Close()
+		assert.True(t, strings.HasPrefix(string(out), tc.status+"\r\n"), "%s: %s", name, out)
+		if name == "wrong version" {
+			assert.Contains(t, string(out), "sec-websocket-version: 13\r\n")
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	addr := serveEcho(t, &Upgrader{MaxMessageSize: 70_000})
+	c, _, _ := dial(t, addr)
+
+	// Test: Text and binary messages, including 16- and 64-bit lengths
+	for _, msg := range []struct {
+		typ  MessageType
+		data string
+	}{
+		{TextMessage, "hello"},
+		{BinaryMessage, "\x00\x01\x02"},
+		{TextMessage, strings.Repeat("a", 300)},
+		{BinaryMessage, strings.Repeat("b", 66_000)},
+		{TextMessage, ""},
+	} {
+		require.NoError(t, c.WriteMessage(msg.typ, []byte(msg.data)))
+		typ, data, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, msg.typ, typ)
+		assert.Equal(t, msg.data, string(data))
+	}
+
+	// Test: Fragmented message with a ping between fragments
+	pongs := make(chan string, 1)
+	c.SetPongHandler(func(data []byte) { pongs <- string(data) })
+	mw, err := c.NextWriter(TextMessage)
+	require.NoError(t, err)
+	io.WriteString(mw, "frag")
+	require.NoError(t, c.WritePing([]byte("are you there")))
+	io.WriteString(mw, "mented ✓")
+	require.NoError(t, mw.Close())
+	typ, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, typ)
+	assert.Equal(t, "fragmented ✓", string(data))
+	assert.Equal(t, "are you there", <-pongs)
+
+	// Test: Close handshake initiated by the client, echoed without a reason
+	require.NoError(t, c.WriteClose(CloseNormalClosure, "bye"))
+	assert.ErrorIs(t, c.WriteMessage(TextMessage, []byte("late")), ErrCloseSent)
+	_, _, err = c.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseNormalClosure, closeErr.Code)
+	assert.Empty(t, closeErr.Reason)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	addr := serveEcho(t, &Upgrader{MaxMessageSize: 16})
+
+	expectClose := func(name string, c *Conn, code int) {
+		_, _, err := c.ReadMessage()
+		var closeErr *CloseError
+		if assert.ErrorAs(t, err, &closeErr, name) {
+			assert.Equal(t, code, closeErr.Code, name)
+		}
+	}
+
+	// Test: Invalid UTF-8 in a text message
+	c, _, _ := dial(t, addr)
+	require.NoError(t, c.WriteMessage(TextMessage, []byte{0xff, 0xfe}))
+	expectClose("invalid UTF-8", c, CloseInvalidPayload)
+
+	// Test: Message over the size limit, even when fragmented
+	c, _, _ = dial(t, addr)
+	mw, _ := c.NextWriter(BinaryMessage)
+	mw.Write(make([]byte, 10))
+	mw.Write(make([]byte, 10))
+	mw.Close()
+	expectClose("too big", c, CloseMessageTooBig)
+
+	// Test: Frames from the client must be masked
+	c, _, _ = dial(t, addr)
+	c.conn.Write([]byte{finBit | opText, 2, 'h', 'i'})
+	expectClose("unmasked", c, CloseProtocolError)
+
+	// Test: Continuation without a message
+	c, _, _ = dial(t, addr)
+	c.writeDataFrame(true, opContinuation, []byte("x"))
+	expectClose("stray continuation", c, CloseProtocolError)
+
+	// Test: Close code that must not be sent
+	c, _, _ = dial(t, addr)
+	c.writeControl(opClose, []byte{0x03, 0xed}) // 1005
+	expectClose("reserved close code", c, CloseProtocolError)
+}
+
+// serveEcho starts a server that upgrades every request and echoes
+// messages back until the connection closes.
+func serveEcho(t *testing.T, upgrader *Upgrader) string {
+	srv, err := server.ServeAddr("127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		c, err := upgrader.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			typ, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(typ, data); err != nil {
+				return
+			}
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr().String()
+}
+
+// dial performs a client handshake and returns a client Conn with the
+// response status line and headers.
+func dial(t *testing.T, addr string, extraHeaders ...string) (*Conn, string, map[string]string) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := "GET /chat HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+	for _, h := range extraHeaders {
+		req += h + "\r\n"
+	}
+	_, err = fmt.Fprint(conn, req+"\r\n")
+	require.NoError(t, err)
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	h := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		name, value, _ := strings.Cut(strings.TrimSpace(line), ":")
+		h[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+
+	buffered, _ := r.Peek(r.Buffered())
+	c := newConn(conn, buffered, false, DefaultMaxMessageSize)
+	return c, strings.TrimSpace(status), h
+}